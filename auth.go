@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/internal"
+	"gopkg.in/yaml.v3"
+)
+
+// API roles, each allowed everything the previous ones are
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+// apiToken grants a role to the clients presenting it
+type apiToken struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Role  string `yaml:"role"`
+}
+
+// loadAPITokens reads the API tokens file. Without the file the API keeps working
+// unauthenticated, except for the endpoints requiring the admin role.
+func loadAPITokens(path string) ([]apiToken, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	var file struct {
+		Tokens []apiToken `yaml:"tokens"`
+	}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	for _, token := range file.Tokens {
+		if token.Name == "" || token.Token == "" {
+			return nil, fmt.Errorf("every token in %s needs a name and a token", path)
+		}
+		if roleRanks[token.Role] == 0 {
+			return nil, fmt.Errorf("token %s has unknown role %q, expected viewer, operator or admin", token.Name, token.Role)
+		}
+	}
+	return file.Tokens, nil
+}
+
+// authorize checks that a request carries a token with at least the given role, answering
+// the request when it does not. The token is read from the Authorization bearer header.
+func authorize(w http.ResponseWriter, r *http.Request, tokens []apiToken, role string) bool {
+	return authorizeToken(w, r, tokens, role, presentedToken(r, false))
+}
+
+// authorizeStream is authorize for the WebSocket and server-sent events endpoints, which
+// also accept the token query parameter as browsers cannot set headers on those connections.
+// Elsewhere the parameter is refused, as URLs end up in proxy access logs.
+func authorizeStream(w http.ResponseWriter, r *http.Request, tokens []apiToken, role string) bool {
+	return authorizeToken(w, r, tokens, role, presentedToken(r, true))
+}
+
+// authorizeToken checks that the presented token has at least the given role
+func authorizeToken(w http.ResponseWriter, r *http.Request, tokens []apiToken, role, presented string) bool {
+	if len(tokens) == 0 {
+		if role == roleAdmin {
+			http.Error(w, "Admin endpoints require an API token file", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token.Token)) != 1 {
+			continue
+		}
+		if roleRanks[token.Role] < roleRanks[role] {
+			log.Printf("API: %s (%s) denied %s %s", token.Name, token.Role, r.Method, r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+// presentedToken returns the token of a request, from the Authorization bearer header or,
+// when query is set, the token query parameter
+func presentedToken(r *http.Request, query bool) string {
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if presented == "" && query {
+		presented = r.URL.Query().Get("token")
+	}
+	return presented
+}
+
+// callerName returns the name of the token an authorized request carries, or the remote
+// address of the client when the API is unauthenticated
+func callerName(r *http.Request, tokens []apiToken) string {
+	// Only called once authorized, so the query parameter was accepted when it is set
+	presented := presentedToken(r, true)
+	for _, token := range tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(token.Token)) == 1 {
+			return token.Name
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "anonymous (" + host + ")"
+}
+
+// apiAudit returns the audit entry of an operation run through the API by the caller of r
+func apiAudit(r *http.Request, tokens []apiToken, operation, module string, args ...string) internal.AuditEntry {
+	return internal.AuditEntry{User: callerName(r, tokens), Source: internal.AuditAPI, Operation: operation, Module: module, Args: args}
+}
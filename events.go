@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/internal"
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// eventHeartbeat is how often an idle event stream gets a comment, so that proxies keep it open
+const eventHeartbeat = 30 * time.Second
+
+// eventHub passes the docker events watched by the API server to the connected clients
+type eventHub struct {
+	mu      sync.Mutex
+	clients map[chan internal.ModuleEvent]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{clients: make(map[chan internal.ModuleEvent]bool)}
+}
+
+func (h *eventHub) subscribe() chan internal.ModuleEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client := make(chan internal.ModuleEvent, 64)
+	h.clients[client] = true
+	return client
+}
+
+func (h *eventHub) unsubscribe(client chan internal.ModuleEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.clients, client)
+}
+
+// publish sends an event to every client, dropping it for clients too slow to keep up
+func (h *eventHub) publish(event internal.ModuleEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients {
+		select {
+		case client <- event:
+		default:
+		}
+	}
+}
+
+// serveEvents streams the events of a module, of every module when moduleName is empty, as
+// server-sent events: the last ?tail=20 recorded ones, then the new ones as they happen
+func serveEvents(config shared.Configuration, hub *eventHub, w http.ResponseWriter, r *http.Request, moduleName string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	tail := 20
+	if value := r.URL.Query().Get("tail"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid tail", http.StatusBadRequest)
+			return
+		}
+		tail = parsed
+	}
+
+	client := hub.subscribe()
+	defer hub.unsubscribe(client)
+	recent, err := internal.ReadEvents(config, moduleName, tail)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	send := func(event internal.ModuleEvent) {
+		data, _ := json.Marshal(event)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Action, data)
+	}
+	for _, event := range recent {
+		send(event)
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-client:
+			if moduleName != "" && event.Module != moduleName {
+				continue
+			}
+			send(event)
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		}
+		flusher.Flush()
+	}
+}
@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 //	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
 	"github.com/FrancescoCorbosiero/go-docker-manager/internal"
+	"github.com/FrancescoCorbosiero/go-docker-manager/pkg/utils"
 )
 
 // ContainerStatus represents the status info for a container
@@ -33,20 +39,41 @@ type ModuleInfo struct {
 
 // ServerConfig holds the web server configuration
 type ServerConfig struct {
-	Port     string `json:"port"`
-	BasePath string `json:"base_path"`
+	Port       string `json:"port"`
+	BasePath   string `json:"base_path"`
+	TokensFile string `json:"tokens_file"`
+	// AllowedOrigins are the web origins, besides the API host, allowed to open terminals
+	AllowedOrigins []string `json:"allowed_origins"`
 }
 
 // APIServer implements a simple web server for container management
-func startAPIServer(config shared.Configuration) {
+func startAPIServer(config shared.Configuration, port string, allowedOrigins []string) {
 	// Load server configuration
 	serverConfig := ServerConfig{
-		Port:     "8080",
-		BasePath: "/api",
+		Port:           port,
+		BasePath:       "/api",
+		TokensFile:     "api-tokens.yml",
+		AllowedOrigins: allowedOrigins,
+	}
+
+	// API clients get a quick conflict instead of waiting long for a locked module
+	if config.LockTimeout == 0 || config.LockTimeout > 30*time.Second {
+		config.LockTimeout = 30 * time.Second
+	}
+
+	tokens, err := loadAPITokens(serverConfig.TokensFile)
+	if err != nil {
+		log.Fatalf("Failed to load API tokens: %v", err)
+	}
+	if len(tokens) == 0 {
+		log.Printf("No %s found, the API is unauthenticated and admin endpoints are disabled", serverConfig.TokensFile)
 	}
 
 	// Create API endpoints
 	http.HandleFunc(serverConfig.BasePath+"/modules", func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, tokens, roleViewer) {
+			return
+		}
 		modules, err := listModules(config)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to list modules: %v", err), http.StatusInternalServerError)
@@ -58,7 +85,10 @@ func startAPIServer(config shared.Configuration) {
 	})
 
 	http.HandleFunc(serverConfig.BasePath+"/templates", func(w http.ResponseWriter, r *http.Request) {
-		templates, err := listTemplates(config)
+		if !authorize(w, r, tokens, roleViewer) {
+			return
+		}
+		templates, err := internal.ListTemplates(config)
 		if err != nil {
 			http.Error(w, fmt.Sprintf("Failed to list templates: %v", err), http.StatusInternalServerError)
 			return
@@ -68,11 +98,37 @@ func startAPIServer(config shared.Configuration) {
 		json.NewEncoder(w).Encode(templates)
 	})
 
+	http.HandleFunc(serverConfig.BasePath+"/certs", func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, tokens, roleViewer) {
+			return
+		}
+		days := 21
+		if value := r.URL.Query().Get("days"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil {
+				http.Error(w, "Invalid days", http.StatusBadRequest)
+				return
+			}
+			days = parsed
+		}
+		report, err := internal.ListCertificates(config, days)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list certificates: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+
 	http.HandleFunc(serverConfig.BasePath+"/dock", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
 			return
 		}
+		if !authorize(w, r, tokens, roleOperator) {
+			return
+		}
 
 		var moduleConfig shared.ModuleConfig
 		err := json.NewDecoder(r.Body).Decode(&moduleConfig)
@@ -81,21 +137,325 @@ func startAPIServer(config shared.Configuration) {
 			return
 		}
 
-		err = internal.DockContainer(config, moduleConfig.Name, moduleConfig.Template)
+		args := append([]string{"template=" + moduleConfig.Template}, snippetArgs(moduleConfig.Snippets)...)
+		err = internal.Audited(config, apiAudit(r, tokens, "dock", moduleConfig.Name, args...), func() error {
+			return internal.DockContainer(config, moduleConfig.Name, moduleConfig.Template, moduleConfig.Snippets, internal.DockFailureRollback)
+		})
 		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to dock container: %v", err), http.StatusInternalServerError)
+			http.Error(w, fmt.Sprintf("Failed to dock container: %v", err), errorStatus(err))
 			return
 		}
 
+		// ?wait=true[&timeout=5m] answers only once the services are healthy
+		if r.URL.Query().Get("wait") == "true" {
+			timeout := 5 * time.Minute
+			if value := r.URL.Query().Get("timeout"); value != "" {
+				if timeout, err = time.ParseDuration(value); err != nil {
+					http.Error(w, fmt.Sprintf("Invalid timeout: %v", err), http.StatusBadRequest)
+					return
+				}
+			}
+			if err := internal.WaitHealthy(moduleConfig.Name, timeout, 0); err != nil {
+				http.Error(w, fmt.Sprintf("Container is not healthy: %v", err), http.StatusGatewayTimeout)
+				return
+			}
+		}
+
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": "Container started successfully"})
 	})
 
+	// Alert rules of alerts.yml are evaluated in the background
+	go watchAlerts(config)
+
+	// Resource usage of the modules for Prometheus, collected in the background
+	collector := &statsCollector{}
+	go collector.run(config)
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		if !authorize(w, r, tokens, roleViewer) {
+			return
+		}
+		collector.serveMetrics(w, r)
+	})
+
+	// Docker events of the modules, recorded and streamed to clients as server-sent events
+	hub := newEventHub()
+	go internal.WatchEvents(context.Background(), config, hub.publish)
+	http.HandleFunc(serverConfig.BasePath+"/events", func(w http.ResponseWriter, r *http.Request) {
+		if !authorizeStream(w, r, tokens, roleViewer) {
+			return
+		}
+		serveEvents(config, hub, w, r, "")
+	})
+
+	// Per-service operations: /modules/{name}/services[/{service}/{action}], and the events
+	// of a module: /modules/{name}/events
+	http.HandleFunc(serverConfig.BasePath+"/modules/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, serverConfig.BasePath+"/modules/"), "/")
+		if moduleName, found := strings.CutSuffix(path, "/events"); found && !strings.Contains(moduleName, "/") {
+			if !authorizeStream(w, r, tokens, roleViewer) {
+				return
+			}
+			serveEvents(config, hub, w, r, moduleName)
+			return
+		}
+		handleModuleServices(config, tokens, serverConfig.AllowedOrigins, w, r, path)
+	})
+
 	// Start the web server
 	log.Printf("Starting API server on port %s", serverConfig.Port)
 	log.Fatal(http.ListenAndServe(":"+serverConfig.Port, nil))
 }
 
+// handleModuleServices serves the per-service endpoints of a module
+func handleModuleServices(config shared.Configuration, tokens []apiToken, allowedOrigins []string, w http.ResponseWriter, r *http.Request, path string) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) < 2 || parts[1] != "services" {
+		http.NotFound(w, r)
+		return
+	}
+	moduleName := parts[0]
+
+	// GET /modules/{name}/services lists the services and their containers
+	if len(parts) == 2 {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorize(w, r, tokens, roleViewer) {
+			return
+		}
+		services, err := internal.ListServices(config, moduleName)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list services: %v", err), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(services)
+		return
+	}
+	if len(parts) != 4 {
+		http.NotFound(w, r)
+		return
+	}
+	service, action := parts[2], parts[3]
+
+	if action == "logs" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorize(w, r, tokens, roleViewer) {
+			return
+		}
+		tail := 100
+		if value := r.URL.Query().Get("tail"); value != "" {
+			if _, err := fmt.Sscan(value, &tail); err != nil {
+				http.Error(w, "Invalid tail", http.StatusBadRequest)
+				return
+			}
+		}
+		logs, err := internal.ServiceLogs(config, moduleName, []string{service}, tail)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read logs: %v", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, logs)
+		return
+	}
+
+	// exec opens a terminal over WebSocket, or runs a command and returns its output on POST
+	if action == "exec" {
+		if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			if !authorizeStream(w, r, tokens, roleAdmin) {
+				return
+			}
+			args := append([]string{"service=" + service}, r.URL.Query()["command"]...)
+			internal.Audited(config, apiAudit(r, tokens, "terminal", moduleName, args...), func() error {
+				return serveTerminal(config, w, r, moduleName, service, allowedOrigins)
+			})
+			return
+		}
+		if !authorize(w, r, tokens, roleAdmin) {
+			return
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if action != "exec" && !authorize(w, r, tokens, roleOperator) {
+		return
+	}
+
+	var err error
+	services := []string{service}
+	audit := apiAudit(r, tokens, action, moduleName, "service="+service)
+	switch action {
+	case "restart":
+		strategy := r.URL.Query().Get("strategy")
+		if strategy == "" {
+			strategy = internal.RestartInPlace
+		}
+		if !internal.ValidRestartStrategy(strategy) {
+			http.Error(w, fmt.Sprintf("Invalid strategy %q", strategy), http.StatusBadRequest)
+			return
+		}
+		audit.Args = append(audit.Args, "strategy="+strategy)
+		err = internal.Audited(config, audit, func() error {
+			return internal.RestartContainer(config, moduleName, strategy, services, 5*time.Minute)
+		})
+	case "stop":
+		err = internal.Audited(config, audit, func() error { return internal.StopServices(config, moduleName, services) })
+	case "start":
+		err = internal.Audited(config, audit, func() error { return internal.StartServices(config, moduleName, services) })
+	case "pull":
+		err = internal.Audited(config, audit, func() error { return internal.PullServices(config, moduleName, services) })
+	case "exec":
+		var request struct {
+			Command []string `json:"command"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		var output strings.Builder
+		exitCode := 0
+		if len(request.Command) == 0 {
+			http.Error(w, "A command is required", http.StatusBadRequest)
+			return
+		}
+		audit.Args = append(audit.Args, request.Command...)
+		err = internal.Audited(config, audit, func() error {
+			return internal.ExecService(config, moduleName, service, request.Command, false, nil, &output, &output)
+		})
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitCode, err = exitErr.ExitCode(), nil
+		}
+		if err == nil {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{"output": output.String(), "exit_code": exitCode})
+			return
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to %s service %s: %v", action, service, err), errorStatus(err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success", "message": fmt.Sprintf("Service %s: %s done", service, action)})
+}
+
+// snippetArgs returns the snippets of a dock request as -with items, such as
+// "with=redis:network=wordpress-network"
+func snippetArgs(snippets []shared.SnippetRef) []string {
+	args := []string{}
+	for _, snippet := range snippets {
+		item := snippet.Name
+		keys := make([]string, 0, len(snippet.Params))
+		for key := range snippet.Params {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			item += ":" + key + "=" + snippet.Params[key]
+		}
+		args = append(args, "with="+item)
+	}
+	return args
+}
+
+// errorStatus returns the HTTP status for an operation error: conflict while the module
+// is locked by another operation, internal error otherwise
+func errorStatus(err error) int {
+	if _, locked := err.(*internal.LockError); locked {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+// terminalMessage is a control message of the terminal WebSocket. Binary frames carry raw
+// terminal input and output; text frames carry these JSON messages.
+type terminalMessage struct {
+	Type string `json:"type"`           // input, resize or exit
+	Data string `json:"data,omitempty"` // input
+	Cols uint16 `json:"cols,omitempty"` // resize
+	Rows uint16 `json:"rows,omitempty"` // resize
+	Code *int   `json:"code,omitempty"` // exit
+}
+
+// serveTerminal connects a WebSocket client to a shell, or to the command given in the
+// repeated command query parameter, in a service container. It returns once the session
+// ends, with an error when it could not start or the command failed.
+func serveTerminal(config shared.Configuration, w http.ResponseWriter, r *http.Request, moduleName, service string, allowedOrigins []string) error {
+	terminal, err := internal.StartTerminal(config, moduleName, service, r.URL.Query()["command"])
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to start terminal: %v", err), http.StatusInternalServerError)
+		return err
+	}
+	defer terminal.Close()
+
+	ws, err := utils.UpgradeWebSocket(w, r, allowedOrigins)
+	if err != nil {
+		log.Printf("Terminal for %s/%s: %v", moduleName, service, err)
+		return err
+	}
+	defer ws.Close()
+	log.Printf("Terminal opened on %s/%s from %s", moduleName, service, r.RemoteAddr)
+
+	// Client input, until the client goes away
+	go func() {
+		for {
+			messageType, data, err := ws.ReadMessage()
+			if err != nil {
+				terminal.Close()
+				return
+			}
+			if messageType == utils.BinaryMessage {
+				terminal.Input.Write(data)
+				continue
+			}
+			var message terminalMessage
+			if json.Unmarshal(data, &message) != nil {
+				continue
+			}
+			switch message.Type {
+			case "input":
+				terminal.Input.Write([]byte(message.Data))
+			case "resize":
+				terminal.Resize(message.Cols, message.Rows)
+			}
+		}
+	}()
+
+	// Terminal output, until the command exits
+	buffer := make([]byte, 4096)
+	for {
+		n, err := terminal.Output.Read(buffer)
+		if n > 0 && ws.WriteMessage(utils.BinaryMessage, buffer[:n]) != nil {
+			break
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	code, _ := terminal.Wait()
+	exit, _ := json.Marshal(terminalMessage{Type: "exit", Code: &code})
+	ws.WriteMessage(utils.TextMessage, exit)
+	log.Printf("Terminal closed on %s/%s with exit code %d", moduleName, service, code)
+	if code != 0 {
+		return fmt.Errorf("exit code %d", code)
+	}
+	return nil
+}
+
 // listModules returns information about all modules in the compose directory
 func listModules(config shared.Configuration) ([]ModuleInfo, error) {
 	var modules []ModuleInfo
@@ -121,14 +481,18 @@ func listModules(config shared.Configuration) ([]ModuleInfo, error) {
 			continue
 		}
 
-		// Get template name by checking the content (this is an approximation)
+		// Get template name from the module metadata, falling back to comparing content
 		templateName := "unknown"
-		for _, templateEntry := range mustListTemplates(config) {
-			// Compare docker-compose files to determine the template
-			templateComposeFile := filepath.Join(config.TemplatesDir, templateEntry, "docker-compose.yml")
-			if compareFiles(composeFile, templateComposeFile) {
-				templateName = templateEntry
-				break
+		if metadata, err := internal.LoadModuleMetadata(config, moduleName); err == nil && metadata.Template != "" {
+			templateName = metadata.Template
+		} else {
+			for _, templateEntry := range mustListTemplates(config) {
+				// Compare docker-compose files to determine the template
+				templateComposeFile := filepath.Join(config.TemplatesDir, templateEntry, "docker-compose.yml")
+				if compareFiles(composeFile, templateComposeFile) {
+					templateName = templateEntry
+					break
+				}
 			}
 		}
 
@@ -167,22 +531,12 @@ func listModules(config shared.Configuration) ([]ModuleInfo, error) {
 func listTemplates(config shared.Configuration) ([]string, error) {
 	templates := []string{}
 
-	// Read the templates directory
-	entries, err := os.ReadDir(config.TemplatesDir)
+	infos, err := internal.ListTemplates(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read templates directory: %v", err)
+		return nil, err
 	}
-
-	// Filter for directories containing docker-compose.yml
-	for _, entry := range entries {
-		if entry.IsDir() {
-			templateDir := filepath.Join(config.TemplatesDir, entry.Name())
-			composePath := filepath.Join(templateDir, "docker-compose.yml")
-			
-			if _, err := os.Stat(composePath); err == nil {
-				templates = append(templates, entry.Name())
-			}
-		}
+	for _, info := range infos {
+		templates = append(templates, info.Name)
 	}
 
 	return templates, nil
@@ -240,8 +594,7 @@ func restoreModule(config shared.Configuration, moduleName, backupName string) e
 
 // updateEnvVar updates an environment variable in a module's .env file
 func updateEnvVar(config shared.Configuration, moduleName, key, value string) error {
-	// Implementation would update a specific environment variable
-	return nil
+	return internal.SetEnv(config, moduleName, map[string]string{key: value})
 }
 
 // getContainerLogs returns logs for a specific container
@@ -1,3 +1,5 @@
 module github.com/FrancescoCorbosiero/go-docker-manager
 
 go 1.20
+
+require gopkg.in/yaml.v3 v3.0.1
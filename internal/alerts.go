@@ -0,0 +1,466 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+	"gopkg.in/yaml.v3"
+)
+
+// alertStateName is the file of the compose dir remembering pending and firing alerts
+const alertStateName = ".alerts.json"
+
+// Alert rule types
+const (
+	RuleUnhealthy   = "unhealthy"
+	RuleRestartLoop = "restart_loop"
+	RuleCertExpiry  = "cert_expiry"
+	RuleDisk        = "disk"
+	RuleBackupAge   = "backup_age"
+	RuleQuota       = "quota"
+)
+
+// Notification statuses
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+// AlertRule declares a condition that fires an alert once it holds for a while
+type AlertRule struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// Select restricts module rules to the modules matched, like -select; all when empty
+	Select string `yaml:"select,omitempty"`
+	// For is how long the condition must hold before the alert fires
+	For time.Duration `yaml:"for,omitempty"`
+	// Threshold is the restart count, days left, or disk percentage, depending on the type
+	Threshold float64       `yaml:"threshold,omitempty"`
+	Window    time.Duration `yaml:"window,omitempty"`
+	MaxAge    time.Duration `yaml:"max_age,omitempty"`
+	Path      string        `yaml:"path,omitempty"`
+	// Notify lists the notifiers of the rule, every notifier when empty
+	Notify []string `yaml:"notify,omitempty"`
+}
+
+// AlertsConfig is the content of the alerts file
+type AlertsConfig struct {
+	Rules     []AlertRule    `yaml:"rules"`
+	Notifiers []NotifierSpec `yaml:"notifiers"`
+	// Repeat sends firing alerts again after this long, never when 0
+	Repeat time.Duration `yaml:"repeat,omitempty"`
+}
+
+// Alert is a rule condition currently holding, for one module, service, domain or path
+type Alert struct {
+	Key     string `json:"key"`
+	Rule    string `json:"rule"`
+	Module  string `json:"module,omitempty"`
+	Summary string `json:"summary"`
+}
+
+// alertState is what the state file remembers of an alert between evaluations
+type alertState struct {
+	Alert      Alert     `json:"alert"`
+	Since      time.Time `json:"since"`
+	Firing     bool      `json:"firing"`
+	NotifiedAt time.Time `json:"notified_at,omitempty"`
+}
+
+// LoadAlertsConfig reads the alerts file, nil when there is none
+func LoadAlertsConfig(config shared.Configuration) (*AlertsConfig, error) {
+	if config.AlertsFile == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(config.AlertsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alerts file: %v", err)
+	}
+
+	var alerts AlertsConfig
+	if err := yaml.Unmarshal(content, &alerts); err != nil {
+		return nil, fmt.Errorf("failed to parse alerts file: %v", err)
+	}
+	if problems := validateAlertsConfig(&alerts); len(problems) > 0 {
+		return nil, fmt.Errorf("invalid alerts file: %s", strings.Join(problems, "; "))
+	}
+	return &alerts, nil
+}
+
+// validateAlertsConfig checks the rules and notifiers, filling in default thresholds
+func validateAlertsConfig(alerts *AlertsConfig) []string {
+	problems := []string{}
+	notifiers := make(map[string]bool)
+	for i, spec := range alerts.Notifiers {
+		if spec.Name == "" {
+			problems = append(problems, fmt.Sprintf("notifier #%d has no name", i+1))
+			continue
+		}
+		if notifiers[spec.Name] {
+			problems = append(problems, fmt.Sprintf("notifier %s is declared twice", spec.Name))
+		}
+		notifiers[spec.Name] = true
+		if _, err := newNotifier(spec); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	rules := make(map[string]bool)
+	for i := range alerts.Rules {
+		rule := &alerts.Rules[i]
+		if rule.Name == "" {
+			problems = append(problems, fmt.Sprintf("rule #%d has no name", i+1))
+			continue
+		}
+		if rules[rule.Name] {
+			problems = append(problems, fmt.Sprintf("rule %s is declared twice", rule.Name))
+		}
+		rules[rule.Name] = true
+		if rule.Select != "" {
+			if _, err := ParseSelector(rule.Select); err != nil {
+				problems = append(problems, fmt.Sprintf("rule %s: %v", rule.Name, err))
+			}
+		}
+		for _, name := range rule.Notify {
+			if !notifiers[name] {
+				problems = append(problems, fmt.Sprintf("rule %s notifies unknown notifier %s", rule.Name, name))
+			}
+		}
+
+		switch rule.Type {
+		case RuleUnhealthy:
+		case RuleRestartLoop:
+			if rule.Threshold == 0 {
+				rule.Threshold = 3
+			}
+			if rule.Window == 0 {
+				rule.Window = 10 * time.Minute
+			}
+		case RuleCertExpiry:
+			if rule.Threshold == 0 {
+				rule.Threshold = 14
+			}
+		case RuleDisk:
+			if rule.Threshold == 0 {
+				rule.Threshold = 90
+			}
+			if rule.Path == "" {
+				rule.Path = "/"
+			}
+		case RuleBackupAge:
+			if rule.MaxAge == 0 {
+				problems = append(problems, fmt.Sprintf("rule %s needs a max_age", rule.Name))
+			}
+		case RuleQuota:
+		default:
+			problems = append(problems, fmt.Sprintf("rule %s has unknown type %q, expected %s, %s, %s, %s, %s or %s",
+				rule.Name, rule.Type, RuleUnhealthy, RuleRestartLoop, RuleCertExpiry, RuleDisk, RuleBackupAge, RuleQuota))
+		}
+	}
+	return problems
+}
+
+// EvaluateAlerts returns the alerts whose condition holds now, ignoring how long it held,
+// and the names of the rules that failed. A failing rule is logged and its alerts found so
+// far kept, so the others still run and its alerts are not taken for resolved.
+func EvaluateAlerts(config shared.Configuration, alerts *AlertsConfig) ([]Alert, map[string]bool) {
+	current := []Alert{}
+	failed := make(map[string]bool)
+	for _, rule := range alerts.Rules {
+		found, err := evaluateRule(config, rule)
+		if err != nil {
+			log.Printf("Alert rule %s not fully evaluated: %v", rule.Name, err)
+			failed[rule.Name] = true
+		}
+		current = append(current, found...)
+	}
+	return current, failed
+}
+
+// evaluateRule returns the alerts of one rule. A module that cannot be checked is skipped;
+// the alerts of the others are returned along with the error.
+func evaluateRule(config shared.Configuration, rule AlertRule) ([]Alert, error) {
+	alert := func(subject, module, format string, args ...interface{}) Alert {
+		return Alert{Key: rule.Name + "/" + subject, Rule: rule.Name, Module: module, Summary: fmt.Sprintf(format, args...)}
+	}
+	alerts := []Alert{}
+
+	switch rule.Type {
+	case RuleCertExpiry:
+		report, err := ListCertificates(config, int(rule.Threshold))
+		if err != nil {
+			return nil, err
+		}
+		for _, certificate := range report.Certificates {
+			if certificate.DaysLeft < int(rule.Threshold) {
+				alerts = append(alerts, alert(certificate.Domain, strings.Join(certificate.Modules, ","),
+					"certificate of %s expires in %d days (%s)", certificate.Domain, certificate.DaysLeft, certificate.NotAfter.Format("2006-01-02")))
+			}
+		}
+		// The certificates of an unreadable store are unknown, not renewed
+		if len(report.FailedStores) > 0 {
+			return alerts, fmt.Errorf("certificates of %s not read", strings.Join(report.FailedStores, ", "))
+		}
+		return alerts, nil
+	case RuleDisk:
+		used, total, err := filesystemUsage(rule.Path)
+		if err != nil {
+			return nil, err
+		}
+		if percent := float64(used) * 100 / float64(total); total > 0 && percent >= rule.Threshold {
+			alerts = append(alerts, alert(rule.Path, "", "disk of %s is %.0f%% full (%s of %s)", rule.Path, percent, formatBytes(int64(used)), formatBytes(int64(total))))
+		}
+		return alerts, nil
+	}
+
+	modules, err := ruleModules(config, rule)
+	if err != nil {
+		return nil, err
+	}
+	switch rule.Type {
+	case RuleUnhealthy:
+		skipped := []string{}
+		for _, module := range modules {
+			if metadata, _ := LoadModuleMetadata(config, module); desiredState(metadata) == DesiredStopped {
+				continue
+			}
+			containers, err := ProjectContainers(module)
+			if err != nil {
+				skipped = append(skipped, fmt.Sprintf("%s: %v", module, err))
+				continue
+			}
+			if len(containers) == 0 {
+				alerts = append(alerts, alert(module, module, "%s has no containers", module))
+				continue
+			}
+			failing := []string{}
+			for _, container := range containers {
+				if health := containerHealth(container); health == HealthUnhealthy || health == HealthStopped {
+					failing = append(failing, container.Service+" "+health)
+				}
+			}
+			if len(failing) > 0 {
+				alerts = append(alerts, alert(module, module, "%s is unhealthy: %s", module, strings.Join(failing, ", ")))
+			}
+		}
+		if len(skipped) > 0 {
+			return alerts, fmt.Errorf("modules not checked: %s", strings.Join(skipped, "; "))
+		}
+	case RuleRestartLoop:
+		events, err := ReadEvents(config, "", 0)
+		if err != nil {
+			return nil, err
+		}
+		since := time.Now().Add(-rule.Window)
+		deaths := make(map[string]int)
+		for _, event := range events {
+			if event.Action == "die" && event.Time.After(since) && containsString(modules, event.Module) {
+				deaths[event.Module+"/"+event.Service]++
+			}
+		}
+		for _, key := range sortedKeys(deaths) {
+			if float64(deaths[key]) >= rule.Threshold {
+				module, service, _ := strings.Cut(key, "/")
+				alerts = append(alerts, alert(key, module, "%s of %s exited %d times in %s", service, module, deaths[key], rule.Window))
+			}
+		}
+	case RuleBackupAge:
+		for _, module := range modules {
+			last := lastBackup(config, module)
+			switch {
+			case last.IsZero():
+				alerts = append(alerts, alert(module, module, "%s has no backup", module))
+			case time.Since(last) > rule.MaxAge:
+				alerts = append(alerts, alert(module, module, "last backup of %s is from %s", module, last.Format("2006-01-02 15:04")))
+			}
+		}
+	case RuleQuota:
+		usages, err := sampleDiskUsage(config)
+		if err != nil {
+			return nil, err
+		}
+		for _, usage := range usages {
+			if warning := quotaWarning(usage); warning != "" && containsString(modules, usage.Module) {
+				alerts = append(alerts, alert(usage.Module, usage.Module, "%s", warning))
+			}
+		}
+	}
+	return alerts, nil
+}
+
+// ruleModules returns the modules a rule applies to
+func ruleModules(config shared.Configuration, rule AlertRule) ([]string, error) {
+	if rule.Select == "" {
+		return ListModuleNames(config)
+	}
+	selector, err := ParseSelector(rule.Select)
+	if err != nil {
+		return nil, err
+	}
+	return SelectModules(config, selector)
+}
+
+// ProcessAlerts evaluates the rules and notifies the alerts that started firing, once their
+// condition held for the rule duration, and those that resolved. Pending and firing alerts are
+// remembered in the state file so that every alert is notified once, whichever process runs
+// the evaluation. It returns the notifications sent.
+func ProcessAlerts(config shared.Configuration, alerts *AlertsConfig) ([]Notification, error) {
+	lock, err := acquireLock(config, "alerts", "alert state", "evaluate alerts")
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Unlock()
+
+	state, err := loadAlertState(config)
+	if err != nil {
+		return nil, err
+	}
+	notifiers := make(map[string]Notifier)
+	for _, spec := range alerts.Notifiers {
+		if notifiers[spec.Name], err = newNotifier(spec); err != nil {
+			return nil, err
+		}
+	}
+	rules := make(map[string]AlertRule)
+	for _, rule := range alerts.Rules {
+		rules[rule.Name] = rule
+	}
+
+	now := time.Now()
+	sent := []Notification{}
+	current := make(map[string]bool)
+	found, failed := EvaluateAlerts(config, alerts)
+	for _, alert := range found {
+		current[alert.Key] = true
+		entry, known := state[alert.Key]
+		if !known {
+			entry = &alertState{Since: now}
+			state[alert.Key] = entry
+		}
+		entry.Alert = alert
+
+		repeat := entry.Firing && alerts.Repeat > 0 && now.Sub(entry.NotifiedAt) >= alerts.Repeat
+		if (entry.Firing && !repeat) || now.Sub(entry.Since) < rules[alert.Rule].For {
+			continue
+		}
+		notification := Notification{Status: AlertFiring, Alert: alert, Since: entry.Since, Time: now}
+		if err := notify(notifiers, rules[alert.Rule], notification); err != nil {
+			log.Printf("Alert %s not notified, retrying at the next evaluation: %v", alert.Key, err)
+			continue
+		}
+		entry.Firing, entry.NotifiedAt = true, now
+		sent = append(sent, notification)
+	}
+
+	for _, key := range sortedKeys(state) {
+		entry := state[key]
+		// The alerts of a rule that failed are kept until it can tell again
+		if current[key] || failed[entry.Alert.Rule] {
+			continue
+		}
+		if entry.Firing {
+			notification := Notification{Status: AlertResolved, Alert: entry.Alert, Since: entry.Since, Time: now}
+			if err := notify(notifiers, rules[entry.Alert.Rule], notification); err != nil {
+				log.Printf("Resolution of alert %s not notified, retrying at the next evaluation: %v", key, err)
+				continue
+			}
+			sent = append(sent, notification)
+		}
+		delete(state, key)
+	}
+
+	return sent, saveAlertState(config, state)
+}
+
+// notify sends a notification to the notifiers of a rule. It fails only when every one of
+// them failed, so that a broken notifier does not repeat the others.
+func notify(notifiers map[string]Notifier, rule AlertRule, notification Notification) error {
+	names := rule.Notify
+	if len(names) == 0 {
+		names = sortedKeys(notifiers)
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	failures := []string{}
+	for _, name := range names {
+		if err := notifiers[name].Notify(notification); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+	if len(failures) > 0 {
+		log.Printf("Alert %s %s: %s", notification.Alert.Key, notification.Status, strings.Join(failures, "; "))
+	}
+	if len(failures) == len(names) {
+		return fmt.Errorf("every notifier failed: %s", strings.Join(failures, "; "))
+	}
+	log.Printf("Alert %s %s: %s", notification.Alert.Key, notification.Status, notification.Alert.Summary)
+	return nil
+}
+
+// loadAlertState reads the alerts remembered from previous evaluations
+func loadAlertState(config shared.Configuration) (map[string]*alertState, error) {
+	state := make(map[string]*alertState)
+	content, err := os.ReadFile(filepath.Join(config.ComposeDir, alertStateName))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alert state: %v", err)
+	}
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse alert state: %v", err)
+	}
+	return state, nil
+}
+
+// saveAlertState writes the pending and firing alerts
+func saveAlertState(config shared.Configuration, state map[string]*alertState) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(config.ComposeDir, alertStateName), content, 0644); err != nil {
+		return fmt.Errorf("failed to write alert state: %v", err)
+	}
+	return nil
+}
+
+// PrintAlerts prints the alerts currently holding, with the time they started and whether
+// they were notified
+func PrintAlerts(config shared.Configuration, alerts *AlertsConfig) error {
+	state, err := loadAlertState(config)
+	if err != nil {
+		return err
+	}
+	current, _ := EvaluateAlerts(config, alerts)
+	if len(current) == 0 {
+		fmt.Println("No alert")
+		return nil
+	}
+
+	sort.SliceStable(current, func(i, j int) bool { return current[i].Key < current[j].Key })
+	for _, alert := range current {
+		status := "pending"
+		since := "now"
+		if entry, known := state[alert.Key]; known {
+			since = entry.Since.Local().Format("2006-01-02 15:04")
+			if entry.Firing {
+				status = AlertFiring
+			}
+		}
+		fmt.Printf("%-8s %-20s %-16s %s\n", status, alert.Rule, since, alert.Summary)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// auditLogName is the file of the compose dir holding the audit log, one JSON per line. It
+// is only ever appended to.
+const auditLogName = ".audit.jsonl"
+
+// Sources of audited operations
+const (
+	AuditCLI       = "cli"
+	AuditAPI       = "api"
+	AuditReconcile = "reconcile"
+)
+
+// Outcomes of audited operations
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// auditContainersName is the name under which the containers of a module appear in the diff
+const auditContainersName = "containers"
+
+// secretPattern matches KEY=VALUE and key: value assignments of credentials, in arguments
+// and module files. References such as ${DB_PASSWORD} are kept.
+var secretPattern = regexp.MustCompile(`(?i)([\w.-]*(?:password|passwd|secret|token|api_?key|auth_?key|private_?key|salt|credential)[\w.-]*["']?\s*[:=]\s*)([^$\s].*)`)
+
+// AuditEntry records an operation changing a module: who ran it, with which arguments,
+// when, how it ended and the diff of the module files and containers it produced
+type AuditEntry struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	User      string    `json:"user"`
+	Source    string    `json:"source"`
+	Operation string    `json:"operation"`
+	Module    string    `json:"module,omitempty"`
+	Args      []string  `json:"args,omitempty"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error,omitempty"`
+	Diff      string    `json:"diff,omitempty"`
+}
+
+// CurrentUser returns the name of the user running the process, the one who ran sudo when
+// run through it
+func CurrentUser() string {
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" && sudoUser != name {
+		return sudoUser + " (sudo)"
+	}
+	return name
+}
+
+// Audited runs an operation and appends it to the audit log with its outcome and diff. The
+// entry gives the user, source, operation, module and arguments; secrets in the arguments
+// and the diff are redacted. Failing to record is logged, the operation error is returned.
+func Audited(config shared.Configuration, entry AuditEntry, run func() error) error {
+	entry.Start = time.Now()
+	before := auditSnapshot(config, entry.Module)
+
+	err := run()
+
+	entry.End = time.Now()
+	entry.Outcome = AuditSuccess
+	if err != nil {
+		entry.Outcome, entry.Error = AuditFailure, err.Error()
+	}
+	entry.Args = redactArgs(entry.Args)
+	entry.Diff = auditDiff(before, auditSnapshot(config, entry.Module))
+	if recordErr := RecordAudit(config, entry); recordErr != nil {
+		log.Printf("Failed to record %s of %s in the audit log: %v", entry.Operation, entry.Module, recordErr)
+	}
+	return err
+}
+
+// RecordAudit appends an entry to the audit log, readable only by its owner
+func RecordAudit(config shared.Configuration, entry AuditEntry) error {
+	audit, err := openJSONLog(filepath.Join(config.ComposeDir, auditLogName), 0, 0600)
+	if err != nil {
+		return err
+	}
+	return audit.append(entry)
+}
+
+// auditSnapshot returns the managed files of a module and a line per container with its
+// state and image, by file name. It is empty for a module without directory.
+func auditSnapshot(config shared.Configuration, moduleName string) map[string]string {
+	snapshot := map[string]string{}
+	if moduleName == "" {
+		return snapshot
+	}
+	if module, err := readModuleFiles(filepath.Join(config.ComposeDir, moduleName)); err == nil {
+		for name, content := range module.Files {
+			snapshot[name] = content
+		}
+	}
+	if containers, err := ProjectContainers(moduleName); err == nil && len(containers) > 0 {
+		lines := []string{}
+		for _, container := range containers {
+			lines = append(lines, fmt.Sprintf("%s %s %s %s", container.Service, container.Name, container.State, container.Image))
+		}
+		sort.Strings(lines)
+		snapshot[auditContainersName] = strings.Join(lines, "\n") + "\n"
+	}
+	return snapshot
+}
+
+// auditDiff returns the unified diff of every file and of the containers between two
+// snapshots, with redacted secrets. A changed secret is marked as such.
+func auditDiff(before, after map[string]string) string {
+	names := []string{}
+	for _, name := range append(append([]string{}, moduleFileNames...), auditContainersName) {
+		if _, found := before[name]; found {
+			names = append(names, name)
+		} else if _, found := after[name]; found {
+			names = append(names, name)
+		}
+	}
+
+	var diff strings.Builder
+	for _, name := range names {
+		oldName, newName := "a/"+name, "b/"+name
+		if _, found := before[name]; !found {
+			oldName = "/dev/null"
+		}
+		if _, found := after[name]; !found {
+			newName = "/dev/null"
+		}
+		diff.WriteString(unifiedDiff(oldName, newName, redactText(before[name], ""), redactText(after[name], before[name])))
+	}
+	return diff.String()
+}
+
+// redactText redacts the secrets of a text. Lines with a secret absent from previous are
+// marked as changed, so that the diff still shows which secrets changed.
+func redactText(text, previous string) string {
+	previousLines := make(map[string]bool)
+	for _, line := range splitLines(previous) {
+		previousLines[line] = true
+	}
+	lines := splitLines(text)
+	for i, line := range lines {
+		redacted := redactSecret(line)
+		if redacted != line && previous != "" && !previousLines[line] {
+			redacted += " (changed)"
+		}
+		lines[i] = redacted
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// redactArgs returns the arguments with the values of secrets redacted
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	for i, arg := range args {
+		redacted[i] = redactSecret(arg)
+	}
+	return redacted
+}
+
+// redactSecret replaces the value of a credential assignment
+func redactSecret(text string) string {
+	return secretPattern.ReplaceAllString(text, "${1}[redacted]")
+}
+
+// ReadAudit returns the last limit entries of the audit log concerning a module, of every
+// module when moduleName is empty, oldest first
+func ReadAudit(config shared.Configuration, moduleName string, limit int) ([]AuditEntry, error) {
+	entries := []AuditEntry{}
+	err := readJSONLog(filepath.Join(config.ComposeDir, auditLogName), func(line []byte) {
+		var entry AuditEntry
+		if json.Unmarshal(line, &entry) == nil && (moduleName == "" || entry.Module == moduleName) {
+			entries = append(entries, entry)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the audit log: %v", err)
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
+
+// PrintAudit prints audit entries, one line each followed by their diff
+func PrintAudit(entries []AuditEntry) {
+	for _, entry := range entries {
+		outcome := entry.Outcome
+		if entry.Error != "" {
+			outcome += ": " + entry.Error
+		}
+		fmt.Printf("%s  %-20s %-12s %-26s %s  %s (%s)\n", entry.Start.Local().Format("2006-01-02 15:04:05"),
+			orDash(entry.Module), entry.Operation, entry.User+" via "+entry.Source, strings.Join(entry.Args, " "), outcome,
+			entry.End.Sub(entry.Start).Round(time.Millisecond))
+		if entry.Diff != "" {
+			for _, line := range splitLines(entry.Diff) {
+				fmt.Printf("    %s\n", line)
+			}
+		}
+	}
+}
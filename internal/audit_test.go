@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRedactSecret(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"DB_PASSWORD=hunter2", "DB_PASSWORD=[redacted]"},
+		{"MYSQL_ROOT_PASSWORD = s3cret value", "MYSQL_ROOT_PASSWORD = [redacted]"},
+		{"      api_key: abc123", "      api_key: [redacted]"},
+		{`  "auth_token": "abc"`, `  "auth_token": [redacted]`},
+		{"WORDPRESS_DB_PASSWORD: ${DB_PASSWORD}", "WORDPRESS_DB_PASSWORD: ${DB_PASSWORD}"},
+		{"DB_PASSWORD=", "DB_PASSWORD="},
+		{"-set=SECRET_KEY=abc", "-set=SECRET_KEY=[redacted]"},
+		{"with=redis:password=y", "with=redis:password=[redacted]"},
+		{"DB_USER=wordpress", "DB_USER=wordpress"},
+		{"image: nginx:1.25", "image: nginx:1.25"},
+	}
+	for _, test := range tests {
+		if got := redactSecret(test.text); got != test.want {
+			t.Errorf("redactSecret(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+
+	args := []string{"-module", "site1", "DB_PASSWORD=hunter2"}
+	if got := strings.Join(redactArgs(args), " "); got != "-module site1 DB_PASSWORD=[redacted]" {
+		t.Errorf("redactArgs = %s", got)
+	}
+	if args[2] != "DB_PASSWORD=hunter2" {
+		t.Errorf("redactArgs modified its arguments")
+	}
+}
+
+func TestRedactText(t *testing.T) {
+	previous := "DB_USER=wordpress\nDB_PASSWORD=old\nAPI_TOKEN=same\n"
+	tests := []struct {
+		name     string
+		text     string
+		previous string
+		want     string
+	}{
+		{"without previous", previous, "", "DB_USER=wordpress\nDB_PASSWORD=[redacted]\nAPI_TOKEN=[redacted]\n"},
+		{"changed secret", "DB_USER=wordpress\nDB_PASSWORD=new\nAPI_TOKEN=same\n", previous,
+			"DB_USER=wordpress\nDB_PASSWORD=[redacted] (changed)\nAPI_TOKEN=[redacted]\n"},
+		{"empty", "", previous, ""},
+	}
+	for _, test := range tests {
+		if got := redactText(test.text, test.previous); got != test.want {
+			t.Errorf("%s: redactText = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestAuditDiff(t *testing.T) {
+	before := map[string]string{
+		"docker-compose.yml": "services:\n  web:\n    image: nginx:1.24\n",
+		".env":               "DB_USER=wordpress\nDB_PASSWORD=old\n",
+		ModuleMetadataFile:   "depends_on: [proxy]\n",
+		auditContainersName:  "web site1-web-1 running nginx:1.24\n",
+	}
+	tests := []struct {
+		name      string
+		before    map[string]string
+		after     map[string]string
+		want      []string
+		forbidden []string
+	}{
+		{
+			name:   "unchanged",
+			before: before,
+			after:  before,
+		},
+		{
+			name:   "changed file and containers",
+			before: before,
+			after: map[string]string{
+				"docker-compose.yml": "services:\n  web:\n    image: nginx:1.25\n",
+				".env":               before[".env"],
+				ModuleMetadataFile:   before[ModuleMetadataFile],
+				auditContainersName:  "web site1-web-1 running nginx:1.25\n",
+			},
+			want:      []string{"--- a/docker-compose.yml", "-    image: nginx:1.24", "+    image: nginx:1.25", "--- a/containers", "+web site1-web-1 running nginx:1.25"},
+			forbidden: []string{".env"},
+		},
+		{
+			name:   "changed secret",
+			before: before,
+			after: map[string]string{
+				"docker-compose.yml": before["docker-compose.yml"],
+				".env":               "DB_USER=wordpress\nDB_PASSWORD=new\n",
+				ModuleMetadataFile:   before[ModuleMetadataFile],
+				auditContainersName:  before[auditContainersName],
+			},
+			want:      []string{"-DB_PASSWORD=[redacted]", "+DB_PASSWORD=[redacted] (changed)"},
+			forbidden: []string{"old", "new", "docker-compose.yml"},
+		},
+		{
+			name:      "module created",
+			before:    map[string]string{},
+			after:     map[string]string{".env": "DB_PASSWORD=new\n"},
+			want:      []string{"--- /dev/null", "+++ b/.env", "+DB_PASSWORD=[redacted]"},
+			forbidden: []string{"new\n", "(changed)"},
+		},
+		{
+			name:   "module removed",
+			before: before,
+			after:  map[string]string{},
+			want:   []string{"+++ /dev/null", "-DB_PASSWORD=[redacted]", "-web site1-web-1 running nginx:1.24"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			diff := auditDiff(test.before, test.after)
+			if len(test.want) == 0 && diff != "" {
+				t.Errorf("diff of identical snapshots = %q", diff)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(diff, want) {
+					t.Errorf("diff lacks %q:\n%s", want, diff)
+				}
+			}
+			for _, forbidden := range test.forbidden {
+				if strings.Contains(diff, forbidden) {
+					t.Errorf("diff contains %q:\n%s", forbidden, diff)
+				}
+			}
+		})
+	}
+}
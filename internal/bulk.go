@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// selectorTerm is one condition of a module selector
+type selectorTerm struct {
+	kind  string // all, name, template, label or tag
+	key   string
+	value string
+}
+
+// ModuleSelector selects modules by name, template, metadata label or tag
+type ModuleSelector struct {
+	terms []selectorTerm
+}
+
+// ParseSelector parses a comma-separated list of conditions that must all match:
+// "all", "name=GLOB" (or a bare glob), "template=NAME", "label=KEY" or "label=KEY=VALUE"
+// and "tag=TAG"
+func ParseSelector(value string) (ModuleSelector, error) {
+	selector := ModuleSelector{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if item == "all" {
+			selector.terms = append(selector.terms, selectorTerm{kind: "all"})
+			continue
+		}
+
+		kind, argument, found := strings.Cut(item, "=")
+		if !found {
+			kind, argument = "name", item
+		}
+		term := selectorTerm{kind: kind, value: argument}
+		switch kind {
+		case "name":
+			if _, err := filepath.Match(argument, ""); err != nil {
+				return selector, fmt.Errorf("invalid name pattern %q: %v", argument, err)
+			}
+		case "template", "tag":
+		case "label":
+			term.key, term.value, _ = strings.Cut(argument, "=")
+		default:
+			return selector, fmt.Errorf("unknown selector %q, expected all, name, template, label or tag", kind)
+		}
+		if argument == "" {
+			return selector, fmt.Errorf("selector %s needs a value", kind)
+		}
+		selector.terms = append(selector.terms, term)
+	}
+	if len(selector.terms) == 0 {
+		return selector, fmt.Errorf("empty selector")
+	}
+	return selector, nil
+}
+
+// matches reports whether a module satisfies every condition of the selector
+func (s ModuleSelector) matches(moduleName string, metadata shared.ModuleMetadata) bool {
+	for _, term := range s.terms {
+		switch term.kind {
+		case "name":
+			if ok, _ := filepath.Match(term.value, moduleName); !ok {
+				return false
+			}
+		case "template":
+			if metadata.Template != term.value {
+				return false
+			}
+		case "label":
+			value, exists := metadata.Labels[term.key]
+			if !exists || (term.value != "" && value != term.value) {
+				return false
+			}
+		case "tag":
+			if !containsString(metadata.Tags, term.value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// SelectModules returns the modules matched by a selector
+func SelectModules(config shared.Configuration, selector ModuleSelector) ([]string, error) {
+	names, err := ListModuleNames(config)
+	if err != nil {
+		return nil, err
+	}
+
+	selected := []string{}
+	for _, name := range names {
+		// Modules without metadata only match on their name
+		metadata, _ := LoadModuleMetadata(config, name)
+		if selector.matches(name, metadata) {
+			selected = append(selected, name)
+		}
+	}
+	return selected, nil
+}
+
+// BulkResult is the outcome of an operation on one module
+type BulkResult struct {
+	Module   string
+	Err      error
+	Duration time.Duration
+	// Skipped is why the module was left alone, empty when the operation ran
+	Skipped string
+}
+
+// RunBulk runs an operation on every module with at most workers at a time, printing
+// progress as modules finish. Failures do not stop the other modules.
+func RunBulk(modules []string, workers int, operation string, run func(module string) error) []BulkResult {
+	if workers < 1 {
+		workers = 1
+	}
+	results := make([]BulkResult, len(modules))
+	jobs := make(chan int)
+	var progress sync.Mutex
+	done := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i < len(modules); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				start := time.Now()
+				err := run(modules[index])
+				results[index] = BulkResult{Module: modules[index], Err: err, Duration: time.Since(start)}
+
+				progress.Lock()
+				done++
+				printBulkProgress(done, len(modules), operation, results[index])
+				progress.Unlock()
+			}
+		}()
+	}
+
+	for index := range modules {
+		jobs <- index
+	}
+	close(jobs)
+	wg.Wait()
+	return results
+}
+
+// printBulkProgress prints the outcome of one module of a bulk operation
+func printBulkProgress(done, total int, operation string, result BulkResult) {
+	status := "✅"
+	if result.Err != nil {
+		status = "❌"
+	} else if result.Skipped != "" {
+		status = "⏭️"
+	}
+	fmt.Printf("[%d/%d] %s %s %s (%s)\n", done, total, status, operation, result.Module, result.Duration.Round(100*time.Millisecond))
+}
+
+// PrintBulkSummary prints a table of the results and returns the number of failures
+func PrintBulkSummary(operation string, results []BulkResult) int {
+	width := len("MODULE")
+	for _, result := range results {
+		if len(result.Module) > width {
+			width = len(result.Module)
+		}
+	}
+
+	failures, skipped := 0, 0
+	fmt.Printf("\n%-*s  %-7s  %8s  %s\n", width, "MODULE", "RESULT", "DURATION", "ERROR")
+	for _, result := range results {
+		status, message := "ok", ""
+		if result.Err != nil {
+			failures++
+			status = "failed"
+			// Keep the table on one line per module
+			message = strings.SplitN(result.Err.Error(), "\n", 2)[0]
+		} else if result.Skipped != "" {
+			skipped++
+			status, message = "skipped", result.Skipped
+		}
+		line := fmt.Sprintf("%-*s  %-7s  %8s  %s", width, result.Module, status, result.Duration.Round(100*time.Millisecond), message)
+		fmt.Println(strings.TrimRight(line, " "))
+	}
+	if skipped > 0 {
+		fmt.Printf("\n%s: %d succeeded, %d skipped, %d failed\n", operation, len(results)-failures-skipped, skipped, failures)
+	} else {
+		fmt.Printf("\n%s: %d succeeded, %d failed\n", operation, len(results)-failures, failures)
+	}
+	return failures
+}
@@ -0,0 +1,614 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	utils "github.com/FrancescoCorbosiero/go-docker-manager/pkg/utils"
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+	"gopkg.in/yaml.v3"
+)
+
+// CatalogLockFile records where a cached catalog version came from
+const CatalogLockFile = ".catalog.lock.yml"
+
+// CatalogSource describes a remote or local source of templates
+type CatalogSource struct {
+	Name string `yaml:"name"`
+	// Type is one of git, tarball or path
+	Type string `yaml:"type"`
+	// URL is the git repository, tarball URL (may contain {version}) or local path
+	URL string `yaml:"url"`
+	// Ref is the default version: a git ref, or a label for tarball and path sources
+	Ref string `yaml:"ref"`
+	// Path is the subdirectory of the source holding the templates
+	Path string `yaml:"path"`
+	// StripComponents removes leading directories from tarball entries, like tar does
+	StripComponents int `yaml:"strip_components"`
+	// Checksums pins the sha256 of tarball archives per version
+	Checksums map[string]string `yaml:"checksums"`
+	// VerifySignature requires a valid GPG signature on the git tag or commit,
+	// or on the tarball through SignatureURL
+	VerifySignature bool   `yaml:"verify_signature"`
+	SignatureURL    string `yaml:"signature_url"`
+}
+
+// catalogsFile is the layout of the catalogs configuration file
+type catalogsFile struct {
+	Catalogs []CatalogSource `yaml:"catalogs"`
+}
+
+// CatalogLock is stored next to a cached catalog version
+type CatalogLock struct {
+	Source   string    `yaml:"source"`
+	Version  string    `yaml:"version"`
+	Commit   string    `yaml:"commit,omitempty"`
+	Archive  string    `yaml:"archive_sha256,omitempty"`
+	Tree     string    `yaml:"tree_sha256"`
+	SyncedAt time.Time `yaml:"synced_at"`
+}
+
+// LoadCatalogs reads the configured catalog sources
+func LoadCatalogs(config shared.Configuration) ([]CatalogSource, error) {
+	if config.CatalogsFile == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(config.CatalogsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalogs file: %v", err)
+	}
+
+	var file catalogsFile
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse catalogs file: %v", err)
+	}
+
+	for i, source := range file.Catalogs {
+		if source.Name == "" || strings.ContainsAny(source.Name, "/@") {
+			return nil, fmt.Errorf("catalog #%d has an invalid name %q", i+1, source.Name)
+		}
+		switch source.Type {
+		case "git", "tarball", "path":
+		default:
+			return nil, fmt.Errorf("catalog %s has unknown type %q (expected git, tarball or path)", source.Name, source.Type)
+		}
+		if source.URL == "" {
+			return nil, fmt.Errorf("catalog %s has no url", source.Name)
+		}
+	}
+	return file.Catalogs, nil
+}
+
+// findCatalog returns the configured catalog with the given name
+func findCatalog(config shared.Configuration, name string) (CatalogSource, error) {
+	catalogs, err := LoadCatalogs(config)
+	if err != nil {
+		return CatalogSource{}, err
+	}
+	for _, source := range catalogs {
+		if source.Name == name {
+			return source, nil
+		}
+	}
+	return CatalogSource{}, fmt.Errorf("catalog %s is not configured in %s", name, config.CatalogsFile)
+}
+
+// IsCatalogReference reports whether a template name has the catalog/template[@version] form
+func IsCatalogReference(templateName string) bool {
+	return strings.Contains(templateName, "/")
+}
+
+// ParseCatalogReference splits catalog/template[@version] into its parts
+func ParseCatalogReference(reference string) (catalog, template, version string, err error) {
+	parts := strings.SplitN(reference, "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("invalid catalog template reference %q, expected catalog/template@version", reference)
+	}
+	catalog = parts[0]
+	template = parts[1]
+	if i := strings.LastIndex(template, "@"); i >= 0 {
+		version = template[i+1:]
+		template = template[:i]
+	}
+	if template == "" || strings.Contains(template, "/") {
+		return "", "", "", fmt.Errorf("invalid catalog template reference %q, expected catalog/template@version", reference)
+	}
+	return catalog, template, version, nil
+}
+
+// catalogTemplateConfig returns a configuration whose templates directory points at the
+// cached catalog version of a catalog/template@version reference, syncing it when missing
+func catalogTemplateConfig(config shared.Configuration, reference string) (shared.Configuration, string, error) {
+	catalogName, templateName, version, err := ParseCatalogReference(reference)
+	if err != nil {
+		return config, "", err
+	}
+
+	source, err := findCatalog(config, catalogName)
+	if err != nil {
+		return config, "", err
+	}
+	if version == "" {
+		version = defaultCatalogVersion(source)
+	}
+
+	versionDir, err := catalogVersionDir(config, catalogName, version)
+	if err != nil {
+		return config, "", err
+	}
+	if _, err := os.Stat(versionDir); os.IsNotExist(err) {
+		if err := SyncCatalog(config, catalogName, version); err != nil {
+			return config, "", err
+		}
+	} else if err := VerifyCatalogVersion(config, catalogName, version); err != nil {
+		return config, "", err
+	}
+
+	catalogConfig := config
+	catalogConfig.TemplatesDir = versionDir
+	return catalogConfig, templateName, nil
+}
+
+// defaultCatalogVersion returns the version used when a reference does not name one
+func defaultCatalogVersion(source CatalogSource) string {
+	switch {
+	case source.Ref != "":
+		return source.Ref
+	case source.Type == "git":
+		return "HEAD"
+	default:
+		return "local"
+	}
+}
+
+// catalogVersionDir returns the cache directory of a catalog version. Versions that would
+// name the catalog dir itself, its parent or a hidden work dir are rejected.
+func catalogVersionDir(config shared.Configuration, catalogName, version string) (string, error) {
+	name := strings.ReplaceAll(strings.TrimSpace(version), "/", "_")
+	// A leading dash would be taken as an option by git
+	if name == "" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "-") || strings.Contains(name, string(os.PathSeparator)) {
+		return "", fmt.Errorf("invalid version %q for catalog %s", version, catalogName)
+	}
+	return filepath.Join(config.CatalogDir, catalogName, name), nil
+}
+
+// SyncCatalog fetches a catalog version into the cache, replacing any previous copy.
+// An empty version syncs the default ref of the catalog.
+func SyncCatalog(config shared.Configuration, catalogName, version string) error {
+	source, err := findCatalog(config, catalogName)
+	if err != nil {
+		return err
+	}
+	if version == "" {
+		version = defaultCatalogVersion(source)
+	}
+	versionDir, err := catalogVersionDir(config, source.Name, version)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Syncing catalog %s (%s %s) at version %s", source.Name, source.Type, source.URL, version)
+
+	if err := os.MkdirAll(filepath.Join(config.CatalogDir, source.Name), 0755); err != nil {
+		return fmt.Errorf("failed to create catalog directory: %v", err)
+	}
+	workDir, err := os.MkdirTemp(filepath.Join(config.CatalogDir, source.Name), ".sync-")
+	if err != nil {
+		return fmt.Errorf("failed to create catalog work directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	fetchedDir := filepath.Join(workDir, "source")
+	lock := CatalogLock{Source: source.URL, Version: version, SyncedAt: time.Now().UTC()}
+
+	switch source.Type {
+	case "git":
+		lock.Commit, err = fetchGitCatalog(source, version, fetchedDir)
+	case "tarball":
+		lock.Archive, err = fetchTarballCatalog(source, version, workDir, fetchedDir)
+	case "path":
+		err = copyTree(source.URL, fetchedDir)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch catalog %s: %v", source.Name, err)
+	}
+
+	// Keep only the configured subdirectory
+	templatesDir := fetchedDir
+	if source.Path != "" {
+		templatesDir = filepath.Join(fetchedDir, filepath.Clean(source.Path))
+		if !strings.HasPrefix(templatesDir, fetchedDir+string(os.PathSeparator)) {
+			return fmt.Errorf("catalog %s has a path outside of the source", source.Name)
+		}
+		if _, err := os.Stat(templatesDir); err != nil {
+			return fmt.Errorf("catalog %s has no directory %s at version %s", source.Name, source.Path, version)
+		}
+	}
+
+	lock.Tree, err = treeChecksum(templatesDir)
+	if err != nil {
+		return fmt.Errorf("failed to checksum catalog %s: %v", source.Name, err)
+	}
+	if err := writeCatalogLock(templatesDir, lock); err != nil {
+		return err
+	}
+
+	// Swap the fetched version into place
+	if err := os.RemoveAll(versionDir); err != nil {
+		return fmt.Errorf("failed to remove previous catalog version: %v", err)
+	}
+	if err := os.Rename(templatesDir, versionDir); err != nil {
+		return fmt.Errorf("failed to move catalog version into place: %v", err)
+	}
+
+	log.Printf("Catalog %s version %s cached in %s (tree sha256 %s)", source.Name, version, versionDir, lock.Tree)
+	fmt.Printf("Catalog %s version %s synced\n", source.Name, version)
+	return nil
+}
+
+// fetchGitCatalog clones a git source at ref and returns the checked out commit
+func fetchGitCatalog(source CatalogSource, ref, destination string) (string, error) {
+	if output, err := exec.Command("git", "clone", "--quiet", "--no-checkout", source.URL, destination).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git clone failed: %v, output: %s", err, output)
+	}
+	commit, err := resolveGitRef(destination, ref)
+	if err != nil {
+		return "", err
+	}
+	if output, err := exec.Command("git", "-C", destination, "checkout", "--quiet", "--detach", commit).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("git checkout of %s failed: %v, output: %s", ref, err, output)
+	}
+
+	if source.VerifySignature {
+		// Prefer the tag signature when ref is a tag, otherwise check the commit
+		verify := exec.Command("git", "-C", destination, "verify-tag", ref)
+		if exec.Command("git", "-C", destination, "rev-parse", "--verify", "--quiet", "refs/tags/"+ref).Run() != nil {
+			verify = exec.Command("git", "-C", destination, "verify-commit", "HEAD")
+		}
+		if output, err := verify.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("signature verification of %s failed: %v, output: %s", ref, err, output)
+		}
+	}
+
+	output, err := exec.Command("git", "-C", destination, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read checked out commit: %v", err)
+	}
+
+	if err := os.RemoveAll(filepath.Join(destination, ".git")); err != nil {
+		return "", fmt.Errorf("failed to remove git metadata: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// resolveGitRef returns the commit a ref names in a fresh clone, trying a tag, then a branch
+// of the origin, then a commit
+func resolveGitRef(repository, ref string) (string, error) {
+	if ref == "" || strings.HasPrefix(ref, "-") {
+		return "", fmt.Errorf("invalid git ref %q", ref)
+	}
+	for _, candidate := range []string{"refs/tags/" + ref, "refs/remotes/origin/" + ref, ref} {
+		output, err := exec.Command("git", "-C", repository, "rev-parse", "--verify", "--quiet", candidate+"^{commit}").Output()
+		if err == nil {
+			return strings.TrimSpace(string(output)), nil
+		}
+	}
+	return "", fmt.Errorf("git ref %s not found in the catalog repository", ref)
+}
+
+// fetchTarballCatalog downloads, verifies and extracts a tarball source
+func fetchTarballCatalog(source CatalogSource, version, workDir, destination string) (string, error) {
+	archivePath := filepath.Join(workDir, "catalog.tar.gz")
+	if err := download(strings.ReplaceAll(source.URL, "{version}", version), archivePath); err != nil {
+		return "", err
+	}
+
+	checksum, err := fileChecksum(archivePath)
+	if err != nil {
+		return "", err
+	}
+	if expected, pinned := source.Checksums[version]; pinned {
+		if strings.TrimPrefix(expected, "sha256:") != checksum {
+			return "", fmt.Errorf("checksum mismatch for version %s: expected %s, got sha256:%s", version, expected, checksum)
+		}
+	} else {
+		log.Printf("Catalog %s has no checksum pinned for version %s (sha256:%s)", source.Name, version, checksum)
+	}
+
+	if source.VerifySignature {
+		if source.SignatureURL == "" {
+			return "", fmt.Errorf("verify_signature requires signature_url for tarball catalogs")
+		}
+		signaturePath := archivePath + ".asc"
+		if err := download(strings.ReplaceAll(source.SignatureURL, "{version}", version), signaturePath); err != nil {
+			return "", err
+		}
+		if output, err := exec.Command("gpg", "--verify", signaturePath, archivePath).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("signature verification failed: %v, output: %s", err, output)
+		}
+	}
+
+	if err := extractTarball(archivePath, destination, source.StripComponents); err != nil {
+		return "", err
+	}
+	return checksum, nil
+}
+
+// download fetches an http(s) URL or copies a local file:// or plain path
+func download(url, destination string) error {
+	var reader io.ReadCloser
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		client := &http.Client{Timeout: 5 * time.Minute}
+		response, err := client.Get(url)
+		if err != nil {
+			return fmt.Errorf("failed to download %s: %v", url, err)
+		}
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return fmt.Errorf("failed to download %s: %s", url, response.Status)
+		}
+		reader = response.Body
+	} else {
+		file, err := os.Open(strings.TrimPrefix(url, "file://"))
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", url, err)
+		}
+		reader = file
+	}
+	defer reader.Close()
+
+	file, err := os.Create(destination)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, reader); err != nil {
+		return fmt.Errorf("failed to download %s: %v", url, err)
+	}
+	return nil
+}
+
+// extractTarball extracts a gzipped tarball, dropping the first strip path components
+func extractTarball(archivePath, destination string, strip int) error {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return fmt.Errorf("failed to read tarball: %v", err)
+	}
+	defer gzipReader.Close()
+
+	reader := tar.NewReader(gzipReader)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read tarball: %v", err)
+		}
+
+		parts := strings.Split(strings.Trim(filepath.ToSlash(filepath.Clean("/"+header.Name)), "/"), "/")
+		if len(parts) <= strip {
+			continue
+		}
+		target := filepath.Join(destination, filepath.Join(parts[strip:]...))
+		if !strings.HasPrefix(target, destination+string(os.PathSeparator)) {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode)&0755|0644)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, reader); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		default:
+			// Links and devices are never needed by templates
+		}
+	}
+
+	if _, err := os.Stat(destination); err != nil {
+		return fmt.Errorf("tarball is empty after stripping %d components", strip)
+	}
+	return nil
+}
+
+// copyTree copies a local directory, skipping git metadata
+func copyTree(source, destination string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+
+		target := filepath.Join(destination, relative)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return utils.CopyFile(path, target)
+	})
+}
+
+// fileChecksum returns the hex sha256 of a file
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// treeChecksum returns a sha256 over the relative paths and contents of every file in dir
+func treeChecksum(dir string) (string, error) {
+	files := []string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && info.Name() != CatalogLockFile {
+			relative, err := filepath.Rel(dir, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(relative))
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+
+	hash := sha256.New()
+	for _, file := range files {
+		checksum, err := fileChecksum(filepath.Join(dir, file))
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(hash, "%s  %s\n", checksum, file)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeCatalogLock writes the lock file of a cached catalog version
+func writeCatalogLock(dir string, lock CatalogLock) error {
+	content, err := yaml.Marshal(lock)
+	if err != nil {
+		return fmt.Errorf("failed to encode catalog lock: %v", err)
+	}
+	return os.WriteFile(filepath.Join(dir, CatalogLockFile), content, 0644)
+}
+
+// readCatalogLock reads the lock file of a cached catalog version
+func readCatalogLock(dir string) (CatalogLock, error) {
+	var lock CatalogLock
+	content, err := os.ReadFile(filepath.Join(dir, CatalogLockFile))
+	if err != nil {
+		return lock, err
+	}
+	err = yaml.Unmarshal(content, &lock)
+	return lock, err
+}
+
+// VerifyCatalogVersion checks that a cached catalog version was not modified since it was synced
+func VerifyCatalogVersion(config shared.Configuration, catalogName, version string) error {
+	versionDir, err := catalogVersionDir(config, catalogName, version)
+	if err != nil {
+		return err
+	}
+	lock, err := readCatalogLock(versionDir)
+	if err != nil {
+		return fmt.Errorf("catalog %s version %s has no valid lock file, sync it again: %v", catalogName, version, err)
+	}
+
+	checksum, err := treeChecksum(versionDir)
+	if err != nil {
+		return fmt.Errorf("failed to checksum catalog %s version %s: %v", catalogName, version, err)
+	}
+	if checksum != lock.Tree {
+		return fmt.Errorf("catalog %s version %s was modified since it was synced (expected tree sha256 %s, got %s)", catalogName, version, lock.Tree, checksum)
+	}
+	return nil
+}
+
+// PrintCatalogs prints the configured catalogs with their cached versions and templates
+func PrintCatalogs(config shared.Configuration) error {
+	catalogs, err := LoadCatalogs(config)
+	if err != nil {
+		return err
+	}
+	if len(catalogs) == 0 {
+		fmt.Printf("No catalogs configured in %s\n", config.CatalogsFile)
+		return nil
+	}
+
+	for _, source := range catalogs {
+		fmt.Printf("%s (%s %s, default ref %s)\n", source.Name, source.Type, source.URL, source.Ref)
+
+		entries, err := os.ReadDir(filepath.Join(config.CatalogDir, source.Name))
+		if err != nil {
+			fmt.Println("  not synced")
+			continue
+		}
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			versionDir := filepath.Join(config.CatalogDir, source.Name, entry.Name())
+			lock, err := readCatalogLock(versionDir)
+			if err != nil {
+				fmt.Printf("  @%s (missing lock file)\n", entry.Name())
+				continue
+			}
+			detail := lock.SyncedAt.Format(time.RFC3339)
+			if lock.Commit != "" {
+				detail = fmt.Sprintf("commit %.12s, %s", lock.Commit, detail)
+			}
+			fmt.Printf("  @%s (%s)\n", lock.Version, detail)
+
+			versionConfig := config
+			versionConfig.TemplatesDir = versionDir
+			templates, err := ListTemplates(versionConfig)
+			if err != nil {
+				continue
+			}
+			for _, template := range templates {
+				fmt.Printf("    %s/%s@%s\n", source.Name, template.Name, lock.Version)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// catalogTemplate is the compose file of the template every test catalog holds
+const catalogTemplate = "services:\n  web:\n    image: nginx:1.25\n"
+
+// catalogFixture returns a configuration whose catalogs file declares the given sources
+func catalogFixture(t *testing.T, sources string) shared.Configuration {
+	t.Helper()
+	root := t.TempDir()
+	config := shared.Configuration{CatalogsFile: filepath.Join(root, "catalogs.yml"), CatalogDir: filepath.Join(root, "catalog")}
+	if err := os.WriteFile(config.CatalogsFile, []byte("catalogs:\n"+sources), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// templateTree writes a source tree holding the web template under prefix
+func templateTree(t *testing.T, prefix string) string {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, prefix, "web"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, prefix, "web", "docker-compose.yml"), []byte(catalogTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// assertSynced checks that a catalog version holds the web template and a valid lock
+func assertSynced(t *testing.T, config shared.Configuration, catalog, version string) CatalogLock {
+	t.Helper()
+	versionDir, err := catalogVersionDir(config, catalog, version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(filepath.Join(versionDir, "web", "docker-compose.yml"))
+	if err != nil {
+		t.Fatalf("template missing from the synced catalog: %v", err)
+	}
+	if string(content) != catalogTemplate {
+		t.Errorf("synced template = %q, want %q", content, catalogTemplate)
+	}
+	if err := VerifyCatalogVersion(config, catalog, version); err != nil {
+		t.Errorf("VerifyCatalogVersion: %v", err)
+	}
+	lock, err := readCatalogLock(versionDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lock
+}
+
+func TestSyncPathCatalog(t *testing.T) {
+	source := templateTree(t, "templates")
+	config := catalogFixture(t, fmt.Sprintf("  - {name: local, type: path, url: %s, path: templates}\n", source))
+
+	if err := SyncCatalog(config, "local", ""); err != nil {
+		t.Fatal(err)
+	}
+	lock := assertSynced(t, config, "local", "local")
+	if lock.Version != "local" || lock.Tree == "" {
+		t.Errorf("lock = %+v, want version local and a tree checksum", lock)
+	}
+}
+
+func TestSyncGitCatalog(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	work := templateTree(t, "")
+	git := func(dir string, args ...string) string {
+		t.Helper()
+		args = append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "-c", "commit.gpgsign=false"}, args...)
+		output, err := exec.Command("git", args...).CombinedOutput()
+		if err != nil {
+			t.Fatalf("git %s: %v, output: %s", strings.Join(args, " "), err, output)
+		}
+		return strings.TrimSpace(string(output))
+	}
+	git(work, "init", "--quiet")
+	git(work, "add", ".")
+	git(work, "commit", "--quiet", "-m", "web template")
+	git(work, "tag", "v1.0.0")
+	// A branch other than the default one is only a remote branch in the clone
+	git(work, "branch", "release/1.x")
+	commit := git(work, "rev-parse", "HEAD")
+	bare := filepath.Join(t.TempDir(), "catalog.git")
+	git(work, "clone", "--quiet", "--bare", work, bare)
+
+	config := catalogFixture(t, fmt.Sprintf("  - {name: remote, type: git, url: %s}\n", bare))
+	for _, version := range []string{"v1.0.0", "release/1.x", commit} {
+		if err := SyncCatalog(config, "remote", version); err != nil {
+			t.Fatalf("sync of %s: %v", version, err)
+		}
+		lock := assertSynced(t, config, "remote", version)
+		if lock.Commit != commit {
+			t.Errorf("locked commit of %s = %s, want %s", version, lock.Commit, commit)
+		}
+		versionDir, _ := catalogVersionDir(config, "remote", version)
+		if _, err := os.Stat(filepath.Join(versionDir, ".git")); !os.IsNotExist(err) {
+			t.Errorf("git metadata kept in the synced catalog")
+		}
+	}
+	if err := SyncCatalog(config, "remote", "missing"); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("sync of a missing ref: error = %v, want a not found error", err)
+	}
+}
+
+// writeTarball archives a tree as a gzipped tarball with a leading directory
+func writeTarball(t *testing.T, tree, path string) {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gzipWriter := gzip.NewWriter(file)
+	defer gzipWriter.Close()
+	writer := tar.NewWriter(gzipWriter)
+	defer writer.Close()
+
+	err = filepath.Walk(tree, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		relative, _ := filepath.Rel(tree, path)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		header := &tar.Header{Name: "catalog-1.0/" + filepath.ToSlash(relative), Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err = writer.Write(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncTarballCatalog(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "catalog-1.0.tar.gz")
+	writeTarball(t, templateTree(t, ""), archive)
+	checksum, err := fileChecksum(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := strings.Replace(archive, "1.0", "{version}", 1)
+
+	tests := []struct {
+		name     string
+		checksum string
+		wantErr  bool
+	}{
+		{"pinned", "sha256:" + checksum, false},
+		{"unpinned", "", false},
+		{"mismatch", "sha256:" + strings.Repeat("0", 64), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checksums := ""
+			if test.checksum != "" {
+				checksums = fmt.Sprintf(", checksums: {\"1.0\": %q}", test.checksum)
+			}
+			config := catalogFixture(t, fmt.Sprintf("  - {name: tarball, type: tarball, url: %q, strip_components: 1%s}\n", url, checksums))
+
+			err := SyncCatalog(config, "tarball", "1.0")
+			if test.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+					t.Fatalf("SyncCatalog error = %v, want a checksum mismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if lock := assertSynced(t, config, "tarball", "1.0"); lock.Archive != checksum {
+				t.Errorf("locked archive checksum = %s, want %s", lock.Archive, checksum)
+			}
+		})
+	}
+}
+
+func TestVerifyCatalogVersionDetectsChanges(t *testing.T) {
+	source := templateTree(t, "")
+	config := catalogFixture(t, fmt.Sprintf("  - {name: local, type: path, url: %s}\n", source))
+	if err := SyncCatalog(config, "local", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	versionDir, _ := catalogVersionDir(config, "local", "v1")
+	if err := os.WriteFile(filepath.Join(versionDir, "web", "docker-compose.yml"), []byte("services: {}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyCatalogVersion(config, "local", "v1"); err == nil || !strings.Contains(err.Error(), "modified") {
+		t.Errorf("VerifyCatalogVersion error = %v, want a modification error", err)
+	}
+}
+
+func TestCatalogVersionTraversal(t *testing.T) {
+	source := templateTree(t, "")
+	config := catalogFixture(t, fmt.Sprintf("  - {name: local, type: path, url: %s}\n", source))
+	if err := SyncCatalog(config, "local", "v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []string{".", "..", " ", " .. ", ".sync-123", "../..", "-b", "--upload-pack=touch"} {
+		if _, err := catalogVersionDir(config, "local", version); err == nil {
+			t.Errorf("catalogVersionDir accepted version %q", version)
+		}
+		if err := SyncCatalog(config, "local", version); err == nil {
+			t.Errorf("SyncCatalog accepted version %q", version)
+		}
+		if err := VerifyCatalogVersion(config, "local", "v1"); err != nil {
+			t.Fatalf("cached version lost after syncing version %q: %v", version, err)
+		}
+	}
+
+	// Slashes of git refs stay inside the catalog dir
+	dir, err := catalogVersionDir(config, "local", "release/1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(config.CatalogDir, "local", "release_1.0"); dir != want {
+		t.Errorf("version release/1.0 maps to %s, want %s", dir, want)
+	}
+}
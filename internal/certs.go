@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// acmeStoragePattern extracts the resolver and the acme.json path from a Traefik argument
+var acmeStoragePattern = regexp.MustCompile(`certificatesresolvers\.([^.]+)\.acme\.storage=(\S+)`)
+
+// Certificate is a certificate obtained by Traefik, as stored in its acme.json
+type Certificate struct {
+	Resolver string    `json:"resolver"`
+	Domain   string    `json:"domain"`
+	SANs     []string  `json:"sans"`
+	Issuer   string    `json:"issuer"`
+	NotAfter time.Time `json:"not_after"`
+	DaysLeft int       `json:"days_left"`
+	// Modules are the modules routing one of the certificate domains
+	Modules []string `json:"modules"`
+	// Store is the Traefik module holding the certificate
+	Store string `json:"store"`
+}
+
+// CertificateReport lists the certificates of every Traefik module and the problems found
+type CertificateReport struct {
+	Certificates []Certificate `json:"certificates"`
+	Findings     []LintFinding `json:"findings"`
+	// FailedStores are the Traefik modules whose certificates could not be read, so that
+	// their certificates are missing from the report
+	FailedStores []string `json:"failed_stores,omitempty"`
+}
+
+// acmeStore is an acme.json file inside the volume of a Traefik module
+type acmeStore struct {
+	module string
+	volume string
+	file   string
+}
+
+// acmeFile is the part of a Traefik v2 acme.json used here, keyed by resolver
+type acmeFile map[string]struct {
+	Certificates []struct {
+		Domain struct {
+			Main string   `json:"main"`
+			SANs []string `json:"sans"`
+		} `json:"domain"`
+		Certificate string `json:"certificate"`
+	} `json:"Certificates"`
+}
+
+// ListCertificates reads the acme.json of every Traefik module through a helper container,
+// maps the certificates to the modules routing their domains and reports certificates
+// expiring within warnDays days and TLS routes without a certificate
+func ListCertificates(config shared.Configuration, warnDays int) (*CertificateReport, error) {
+	stores, err := acmeStores(config)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := ModuleRoutes(config, "")
+	if err != nil {
+		return nil, err
+	}
+
+	report := &CertificateReport{Certificates: []Certificate{}, Findings: []LintFinding{}}
+	l := &linter{}
+	if len(stores) == 0 {
+		l.report(LintWarning, "no module stores ACME certificates (--certificatesresolvers.*.acme.storage)")
+	}
+
+	for _, store := range stores {
+		certificates, err := readAcmeStore(store)
+		if err != nil {
+			l.report(LintError, "certificates of %s not read: %v", store.module, err)
+			report.FailedStores = append(report.FailedStores, store.module)
+			continue
+		}
+		report.Certificates = append(report.Certificates, certificates...)
+	}
+	sort.SliceStable(report.Certificates, func(i, j int) bool {
+		return report.Certificates[i].Domain < report.Certificates[j].Domain
+	})
+
+	now := time.Now()
+	for i := range report.Certificates {
+		certificate := &report.Certificates[i]
+		certificate.DaysLeft = int(certificate.NotAfter.Sub(now).Hours() / 24)
+		for _, route := range routes.Routes {
+			if certificateCovers(*certificate, route.Hosts) && !containsString(certificate.Modules, route.Module) {
+				certificate.Modules = append(certificate.Modules, route.Module)
+			}
+		}
+
+		switch {
+		case certificate.NotAfter.Before(now):
+			l.report(LintError, "certificate of %s expired on %s", certificate.Domain, certificate.NotAfter.Format("2006-01-02"))
+		case certificate.DaysLeft < warnDays:
+			l.report(LintWarning, "certificate of %s expires in %d days (%s)", certificate.Domain, certificate.DaysLeft, certificate.NotAfter.Format("2006-01-02"))
+		}
+		if len(certificate.Modules) == 0 {
+			l.report(LintInfo, "certificate of %s is not used by any module", certificate.Domain)
+		}
+	}
+
+	for _, route := range routes.Routes {
+		if route.CertResolver == "" {
+			continue
+		}
+		for _, host := range route.Hosts {
+			covered := false
+			for _, certificate := range report.Certificates {
+				covered = covered || certificateCovers(certificate, []string{host})
+			}
+			if !covered && !strings.Contains(host, "<") {
+				l.report(LintWarning, "host %s of %s has no certificate", host, route.Module)
+			}
+		}
+	}
+
+	report.Findings = append(report.Findings, l.findings...)
+	return report, nil
+}
+
+// acmeStores finds the acme.json files declared by the Traefik arguments of the modules and
+// the named volumes holding them
+func acmeStores(config shared.Configuration) ([]acmeStore, error) {
+	modules, err := ListModuleNames(config)
+	if err != nil {
+		return nil, err
+	}
+
+	stores := []acmeStore{}
+	for _, module := range modules {
+		moduleDir := filepath.Join(config.ComposeDir, module)
+		services, err := loadComposeServices(moduleDir)
+		if err != nil {
+			continue
+		}
+		files, err := readModuleFiles(moduleDir)
+		if err != nil {
+			continue
+		}
+		volumes, _ := projectObjects(module, files, "volumes")
+		env := moduleEnv(config, module)
+
+		for _, name := range sortedKeys(services) {
+			service := services[name]
+			for _, argument := range stringList(service["command"]) {
+				match := acmeStoragePattern.FindStringSubmatch(interpolateEnv(argument, env))
+				if match == nil {
+					continue
+				}
+				store, found := mountedFile(match[2], stringList(service["volumes"]), volumes)
+				if !found {
+					continue
+				}
+				store.module = module
+				stores = append(stores, store)
+			}
+		}
+	}
+	return stores, nil
+}
+
+// stringList returns the strings of a compose value given as a list or a single string
+func stringList(value interface{}) []string {
+	switch typed := value.(type) {
+	case string:
+		return strings.Fields(typed)
+	case []interface{}:
+		items := []string{}
+		for _, item := range typed {
+			if text, ok := item.(string); ok {
+				items = append(items, text)
+			}
+		}
+		return items
+	}
+	return nil
+}
+
+// mountedFile finds the named volume mounted over a container file and the file path
+// inside the volume
+func mountedFile(file string, mounts []string, volumes []projectObject) (acmeStore, bool) {
+	for _, mount := range mounts {
+		parts := strings.Split(mount, ":")
+		if len(parts) < 2 {
+			continue
+		}
+		target := strings.TrimSuffix(parts[1], "/")
+		if !strings.HasPrefix(file, target+"/") {
+			continue
+		}
+		for _, volume := range volumes {
+			if volume.key == parts[0] {
+				return acmeStore{volume: volume.name, file: strings.TrimPrefix(file, target+"/")}, true
+			}
+		}
+	}
+	return acmeStore{}, false
+}
+
+// readAcmeStore reads an acme.json through a helper container and decodes its certificates
+func readAcmeStore(store acmeStore) ([]Certificate, error) {
+	output, err := exec.Command("docker", "run", "--rm", "-v", store.volume+":/volume:ro", helperImage,
+		"cat", path.Join("/volume", store.file)).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from volume %s: %v", store.file, store.volume, err)
+	}
+	if len(strings.TrimSpace(string(output))) == 0 {
+		return []Certificate{}, nil
+	}
+
+	var acme acmeFile
+	if err := json.Unmarshal(output, &acme); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", store.file, err)
+	}
+
+	certificates := []Certificate{}
+	for _, resolver := range sortedKeys(acme) {
+		for _, entry := range acme[resolver].Certificates {
+			certificate := Certificate{Resolver: resolver, Domain: entry.Domain.Main, SANs: entry.Domain.SANs, Modules: []string{}, Store: store.module}
+			if certificate.SANs == nil {
+				certificate.SANs = []string{}
+			}
+			parsed, err := parseCertificate(entry.Certificate)
+			if err != nil {
+				return nil, fmt.Errorf("certificate of %s: %v", entry.Domain.Main, err)
+			}
+			certificate.NotAfter = parsed.NotAfter
+			certificate.Issuer = parsed.Issuer.CommonName
+			if len(parsed.Issuer.Organization) > 0 {
+				certificate.Issuer = parsed.Issuer.Organization[0] + " " + parsed.Issuer.CommonName
+			}
+			certificates = append(certificates, certificate)
+		}
+	}
+	return certificates, nil
+}
+
+// parseCertificate decodes the leaf of a base64 encoded PEM chain
+func parseCertificate(encoded string) (*x509.Certificate, error) {
+	chain, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64: %v", err)
+	}
+	block, _ := pem.Decode(chain)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no PEM certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// certificateCovers reports whether a certificate is valid for one of the hosts
+func certificateCovers(certificate Certificate, hosts []string) bool {
+	names := append([]string{certificate.Domain}, certificate.SANs...)
+	for _, host := range hosts {
+		for _, name := range names {
+			name = strings.ToLower(name)
+			if name == host {
+				return true
+			}
+			if strings.HasPrefix(name, "*.") && strings.Count(host, ".") == strings.Count(name, ".") && strings.HasSuffix(host, name[1:]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PrintCertificates prints the certificates followed by the problems found, and returns the
+// number of errors and warnings
+func PrintCertificates(report *CertificateReport) int {
+	if len(report.Certificates) > 0 {
+		fmt.Printf("%-32s %-24s %-12s %6s  %s\n", "DOMAIN", "ISSUER", "EXPIRES", "DAYS", "MODULES")
+		for _, certificate := range report.Certificates {
+			domain := certificate.Domain
+			if len(certificate.SANs) > 0 {
+				domain += fmt.Sprintf(" (+%d)", len(certificate.SANs))
+			}
+			fmt.Printf("%-32s %-24s %-12s %6d  %s\n", domain, certificate.Issuer,
+				certificate.NotAfter.Format("2006-01-02"), certificate.DaysLeft, orDash(strings.Join(certificate.Modules, ",")))
+		}
+		fmt.Println()
+	}
+
+	problems := 0
+	for _, finding := range report.Findings {
+		if finding.Severity != LintInfo {
+			problems++
+		}
+	}
+	PrintLintFindings("certs", report.Findings)
+	return problems
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// traefikCompose stores the certificates of its resolver in a named volume
+const traefikCompose = `services:
+  traefik:
+    image: traefik:v2.11
+    command:
+      - "--certificatesresolvers.letsencrypt.acme.storage=/etc/traefik/acme/acme.json"
+    volumes:
+      - certificates:/etc/traefik/acme
+volumes:
+  certificates:
+`
+
+func TestCertExpiryRuleFailsOnUnreadableStore(t *testing.T) {
+	config := shared.Configuration{ComposeDir: t.TempDir()}
+	dir := filepath.Join(config.ComposeDir, "traefik")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(traefikCompose), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Without docker the helper container reading acme.json cannot run
+	t.Setenv("PATH", t.TempDir())
+
+	report, err := ListCertificates(config, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.FailedStores) != 1 || report.FailedStores[0] != "traefik" {
+		t.Errorf("failed stores = %v, want [traefik]", report.FailedStores)
+	}
+
+	rule := AlertRule{Name: "certs", Type: RuleCertExpiry, Threshold: 14}
+	if _, err := evaluateRule(config, rule); err == nil || !strings.Contains(err.Error(), "certificates of traefik not read") {
+		t.Errorf("evaluateRule error = %v, want the unread store reported", err)
+	}
+}
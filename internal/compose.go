@@ -0,0 +1,234 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// sequenceKeysMergedByName lists the compose keys whose "KEY=VALUE" items are merged by key
+var sequenceKeysMergedByName = map[string]bool{
+	"labels":      true,
+	"environment": true,
+}
+
+// sequenceKeysReplaced lists the compose keys whose sequences are replaced instead of appended
+var sequenceKeysReplaced = map[string]bool{
+	"command":    true,
+	"entrypoint": true,
+	"test":       true,
+}
+
+// parseComposeNode parses a compose document and returns its root mapping node
+func parseComposeNode(content []byte) (*yaml.Node, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, err
+	}
+
+	// An empty document is treated as an empty mapping
+	if document.Kind == 0 || len(document.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+
+	root := document.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("compose document root must be a mapping")
+	}
+	return root, nil
+}
+
+// encodeComposeNode renders a compose mapping node back to YAML
+func encodeComposeNode(node *yaml.Node) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// mappingValue returns the value node stored under key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// mappingKeys returns the keys of a mapping node in document order
+func mappingKeys(node *yaml.Node) []string {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	keys := []string{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keys = append(keys, node.Content[i].Value)
+	}
+	return keys
+}
+
+// mergeComposeNodes deep-merges overlay into base following docker compose merge rules.
+// Mappings are merged recursively, "KEY=VALUE" sequences (labels, environment) are merged
+// by key, also with the mapping form of the other side, command-like sequences are replaced
+// and other sequences are appended.
+// The compose !reset and !override tags remove or replace a value instead of merging it.
+func mergeComposeNodes(base, overlay *yaml.Node) {
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key := overlay.Content[i]
+		value := overlay.Content[i+1]
+
+		index := -1
+		for j := 0; j+1 < len(base.Content); j += 2 {
+			if base.Content[j].Value == key.Value {
+				index = j
+				break
+			}
+		}
+
+		switch {
+		case value.Tag == "!reset":
+			if index >= 0 {
+				base.Content = append(base.Content[:index], base.Content[index+2:]...)
+			}
+		case value.Tag == "!override":
+			value.Tag = ""
+			if index >= 0 {
+				base.Content[index+1] = value
+			} else {
+				base.Content = append(base.Content, key, value)
+			}
+		case index < 0:
+			base.Content = append(base.Content, key, value)
+		default:
+			existing := base.Content[index+1]
+			if sequenceKeysMergedByName[key.Value] && existing.Kind != value.Kind {
+				existing, value = keyValueMapping(existing), keyValueMapping(value)
+				base.Content[index+1] = existing
+			}
+			switch {
+			case existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode:
+				mergeComposeNodes(existing, value)
+			case existing.Kind == yaml.SequenceNode && value.Kind == yaml.SequenceNode:
+				mergeComposeSequences(key.Value, existing, value)
+			default:
+				base.Content[index+1] = value
+			}
+		}
+	}
+}
+
+// mergeComposeSequences merges the overlay sequence into the base sequence stored under key
+func mergeComposeSequences(key string, base, overlay *yaml.Node) {
+	if sequenceKeysReplaced[key] {
+		base.Content = overlay.Content
+		return
+	}
+
+	for _, item := range overlay.Content {
+		replaced := false
+		for j, existing := range base.Content {
+			if item.Kind != yaml.ScalarNode || existing.Kind != yaml.ScalarNode {
+				continue
+			}
+			if sequenceKeysMergedByName[key] {
+				if sequenceItemName(existing.Value) == sequenceItemName(item.Value) {
+					base.Content[j] = item
+					replaced = true
+					break
+				}
+			} else if existing.Value == item.Value {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			base.Content = append(base.Content, item)
+		}
+	}
+}
+
+// keyValueMapping returns a "KEY=VALUE" sequence as the equivalent mapping, a KEY without
+// value becoming a null. Other nodes are returned as they are.
+func keyValueMapping(node *yaml.Node) *yaml.Node {
+	if node.Kind != yaml.SequenceNode {
+		return node
+	}
+	mapping := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	for _, item := range node.Content {
+		if item.Kind != yaml.ScalarNode {
+			continue
+		}
+		name, value, found := strings.Cut(item.Value, "=")
+		valueNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+		if !found {
+			valueNode = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null"}
+		}
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, valueNode)
+	}
+	return mapping
+}
+
+// sequenceItemName returns the KEY part of a "KEY=VALUE" sequence item
+func sequenceItemName(item string) string {
+	return strings.SplitN(item, "=", 2)[0]
+}
+
+// composeService is a service of a module compose file, decoded generically
+type composeService map[string]interface{}
+
+// loadComposeServices reads the services of the docker-compose.yml of a module directory
+func loadComposeServices(moduleDir string) (map[string]composeService, error) {
+	content, err := os.ReadFile(filepath.Join(moduleDir, "docker-compose.yml"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read docker-compose.yml: %v", err)
+	}
+
+	var compose struct {
+		Services map[string]composeService `yaml:"services"`
+	}
+	if err := yaml.Unmarshal(content, &compose); err != nil {
+		return nil, fmt.Errorf("failed to parse docker-compose.yml: %v", err)
+	}
+	return compose.Services, nil
+}
+
+// composeLabels returns the labels of a service, given as a list or a mapping
+func composeLabels(service composeService) map[string]string {
+	labels := make(map[string]string)
+	switch typed := service["labels"].(type) {
+	case []interface{}:
+		for _, item := range typed {
+			if entry, ok := item.(string); ok {
+				parts := strings.SplitN(entry, "=", 2)
+				if len(parts) == 2 {
+					labels[parts[0]] = parts[1]
+				} else {
+					labels[parts[0]] = ""
+				}
+			}
+		}
+	case map[string]interface{}:
+		for key, value := range typed {
+			if value == nil {
+				labels[key] = ""
+			} else {
+				labels[key] = fmt.Sprint(value)
+			}
+		}
+	}
+	return labels
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+// mergeYAML merges two compose documents and returns the result as decoded YAML
+func mergeYAML(t *testing.T, base, overlay string) interface{} {
+	t.Helper()
+	baseNode, err := parseComposeNode([]byte(base))
+	if err != nil {
+		t.Fatal(err)
+	}
+	overlayNode, err := parseComposeNode([]byte(overlay))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergeComposeNodes(baseNode, overlayNode)
+	content, err := encodeComposeNode(baseNode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var merged interface{}
+	if err := yaml.Unmarshal(content, &merged); err != nil {
+		t.Fatalf("merged document is invalid: %v\n%s", err, content)
+	}
+	return merged
+}
+
+// decodeYAML decodes an expected document
+func decodeYAML(t *testing.T, document string) interface{} {
+	t.Helper()
+	var decoded interface{}
+	if err := yaml.Unmarshal([]byte(document), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestMergeComposeNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    string
+		overlay string
+		want    string
+	}{
+		{
+			name:    "mappings merge recursively",
+			base:    "services:\n  web:\n    image: nginx\n    restart: always\n",
+			overlay: "services:\n  web:\n    image: nginx:1.25\n  cache:\n    image: redis\n",
+			want:    "services:\n  web:\n    image: nginx:1.25\n    restart: always\n  cache:\n    image: redis\n",
+		},
+		{
+			name:    "environment lists merge by key",
+			base:    "environment:\n  - A=1\n  - B=2\n",
+			overlay: "environment:\n  - B=3\n  - C=4\n",
+			want:    "environment:\n  - A=1\n  - B=3\n  - C=4\n",
+		},
+		{
+			name:    "labels lists merge by key",
+			base:    "labels:\n  - traefik.enable=true\n",
+			overlay: "labels:\n  - traefik.enable=false\n  - com.example=1\n",
+			want:    "labels:\n  - traefik.enable=false\n  - com.example=1\n",
+		},
+		{
+			name:    "other sequences append without duplicates",
+			base:    "ports:\n  - 80:80\n",
+			overlay: "ports:\n  - 80:80\n  - 443:443\n",
+			want:    "ports:\n  - 80:80\n  - 443:443\n",
+		},
+		{
+			name:    "command sequences are replaced",
+			base:    "command: [nginx, -g, daemon off;]\n",
+			overlay: "command: [sh, -c, true]\n",
+			want:    "command: [sh, -c, true]\n",
+		},
+		{
+			name:    "scalars are replaced",
+			base:    "restart: always\n",
+			overlay: "restart: unless-stopped\n",
+			want:    "restart: unless-stopped\n",
+		},
+		{
+			name:    "reset removes the key",
+			base:    "ports:\n  - 80:80\nrestart: always\n",
+			overlay: "ports: !reset []\n",
+			want:    "restart: always\n",
+		},
+		{
+			name:    "reset of a missing key is ignored",
+			base:    "restart: always\n",
+			overlay: "ports: !reset []\n",
+			want:    "restart: always\n",
+		},
+		{
+			name:    "override replaces instead of merging",
+			base:    "environment:\n  A: 1\n  B: 2\n",
+			overlay: "environment: !override\n  C: 3\n",
+			want:    "environment:\n  C: 3\n",
+		},
+		{
+			name:    "list environment merges with a mapping overlay",
+			base:    "environment:\n  - A=1\n  - B=2\n  - PASSTHROUGH\n",
+			overlay: "environment:\n  B: 3\n  C: \"true\"\n",
+			want:    "environment:\n  A: \"1\"\n  B: 3\n  PASSTHROUGH: null\n  C: \"true\"\n",
+		},
+		{
+			name:    "mapping labels merge with a list overlay",
+			base:    "labels:\n  traefik.enable: \"true\"\n  keep: me\n",
+			overlay: "labels:\n  - traefik.enable=false\n",
+			want:    "labels:\n  traefik.enable: \"false\"\n  keep: me\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := mergeYAML(t, test.base, test.overlay)
+			want := decodeYAML(t, test.want)
+			gotYAML, _ := yaml.Marshal(got)
+			wantYAML, _ := yaml.Marshal(want)
+			if string(gotYAML) != string(wantYAML) {
+				t.Errorf("merged:\n%s\nwant:\n%s", gotYAML, wantYAML)
+			}
+		})
+	}
+}
+
+func TestKeyValueMappingKeepsStrings(t *testing.T) {
+	base, _ := parseComposeNode([]byte("environment:\n  - DEBUG=true\n  - PORT=8080\n"))
+	overlay, _ := parseComposeNode([]byte("environment:\n  EXTRA: x\n"))
+	mergeComposeNodes(base, overlay)
+	content, err := encodeComposeNode(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`DEBUG: "true"`, `PORT: "8080"`, "EXTRA: x"} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("merged document lacks %s:\n%s", want, content)
+		}
+	}
+}
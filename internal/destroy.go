@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// helperImage is the small image used to inspect and archive volumes
+const helperImage = "alpine:3.20"
+
+// DestroyOptions controls how a module is destroyed
+type DestroyOptions struct {
+	// Yes skips the confirmation prompt
+	Yes bool
+	// Force destroys volumes that still contain data
+	Force bool
+	// Backup archives the module files and volumes before removing them
+	Backup bool
+}
+
+// DownContainer removes the containers and networks of a module, keeping its volumes and
+// configuration, and records it as desired stopped
+func DownContainer(config shared.Configuration, containerName string) error {
+	lock, err := LockModule(config, containerName, "down")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	moduleDir, err := serviceModuleDir(config, containerName, nil)
+	if err != nil {
+		return err
+	}
+
+	cmd := composeCommand(moduleDir, containerName, "down")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return err
+	}
+	recordDesiredState(config, containerName, DesiredStopped)
+	return nil
+}
+
+// DestroyContainer removes everything of a module: containers, networks, the volumes it
+// owns and its compose directory. External volumes and networks are left alone.
+func DestroyContainer(config shared.Configuration, containerName string, options DestroyOptions) error {
+	// The checks and the confirmation run before locking, so that an operator reading the
+	// prompt does not block the operations of other modules
+	volumes, err := destroyedVolumes(config, containerName, options)
+	if err != nil {
+		return err
+	}
+	if !options.Yes && !confirmDestroy(containerName, volumes) {
+		return fmt.Errorf("destroy of %s not confirmed", containerName)
+	}
+
+	lock, err := LockModule(config, containerName, "destroy")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	moduleDir, err := serviceModuleDir(config, containerName, nil)
+	if err != nil {
+		return err
+	}
+	module, err := readModuleFiles(moduleDir)
+	if err != nil {
+		return err
+	}
+	if current := ownedVolumes(containerName, module); strings.Join(current, ",") != strings.Join(volumes, ",") {
+		return fmt.Errorf("volumes of %s changed since the confirmation (now %s), run destroy again", containerName, strings.Join(current, ", "))
+	}
+
+	output, err := composeCommand(moduleDir, containerName, "down", "--remove-orphans").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove containers: %v, output: %s", err, output)
+	}
+
+	if options.Backup {
+		backupDir, err := backupModule(config, containerName, volumes)
+		if err != nil {
+			return fmt.Errorf("backup failed, volumes and configuration kept: %v", err)
+		}
+		fmt.Printf("Backup of %s written to %s\n", containerName, backupDir)
+	}
+
+	for _, volume := range volumes {
+		output, err := exec.Command("docker", "volume", "rm", volume).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to remove volume %s: %v, output: %s", volume, err, output)
+		}
+		log.Printf("Removed volume %s", volume)
+	}
+
+	if err := os.RemoveAll(moduleDir); err != nil {
+		return fmt.Errorf("failed to remove module directory: %v", err)
+	}
+	// Shared networks only this module used go with it
+	if removed, err := GCNetworks(config); err != nil {
+		log.Printf("Failed to remove unused shared networks: %v", err)
+	} else if len(removed) > 0 {
+		fmt.Printf("Removed unused shared networks: %s\n", strings.Join(removed, ", "))
+	}
+	log.Printf("Container %s destroyed", containerName)
+	fmt.Printf("Container %s destroyed\n", containerName)
+	return nil
+}
+
+// destroyedVolumes returns the volumes destroying a module removes, failing when some still
+// contain data unless forced
+func destroyedVolumes(config shared.Configuration, containerName string, options DestroyOptions) ([]string, error) {
+	moduleDir, err := serviceModuleDir(config, containerName, nil)
+	if err != nil {
+		return nil, err
+	}
+	module, err := readModuleFiles(moduleDir)
+	if err != nil {
+		return nil, err
+	}
+	volumes := ownedVolumes(containerName, module)
+	if options.Force {
+		return volumes, nil
+	}
+
+	used := []string{}
+	for _, volume := range volumes {
+		empty, err := volumeEmpty(volume)
+		if err != nil {
+			return nil, err
+		}
+		if !empty {
+			used = append(used, volume)
+		}
+	}
+	if len(used) > 0 {
+		return nil, fmt.Errorf("volumes %s contain data, use -force to destroy them (with -backup to archive them first)", strings.Join(used, ", "))
+	}
+	return volumes, nil
+}
+
+// ownedVolumes returns the existing volumes declared by a module that are not external
+func ownedVolumes(project string, module *RenderedModule) []string {
+	declared, _ := projectObjects(project, module, "volumes")
+	volumes := []string{}
+	for _, volume := range declared {
+		if !volume.external && dockerObjectExists("volume", volume.name) {
+			volumes = append(volumes, volume.name)
+		}
+	}
+	return volumes
+}
+
+// volumeEmpty reports whether a volume holds no files
+func volumeEmpty(volume string) (bool, error) {
+	output, err := exec.Command("docker", "run", "--rm", "-v", volume+":/volume:ro", helperImage,
+		"find", "/volume", "-mindepth", "1", "-maxdepth", "1").CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect volume %s: %v, output: %s", volume, err, output)
+	}
+	return strings.TrimSpace(string(output)) == "", nil
+}
+
+// confirmDestroy asks to type the module name before destroying it
+func confirmDestroy(moduleName string, volumes []string) bool {
+	fmt.Printf("This removes the containers, networks and directory of %s", moduleName)
+	if len(volumes) > 0 {
+		fmt.Printf(" and the volumes %s", strings.Join(volumes, ", "))
+	}
+	fmt.Printf(".\nType the module name to confirm: ")
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(answer) == moduleName
+}
+
+// backupModule copies the module files and archives its volumes into a timestamped
+// directory of the backup directory, returning that directory
+func backupModule(config shared.Configuration, moduleName string, volumes []string) (string, error) {
+	backupDir, err := filepath.Abs(filepath.Join(config.BackupDir, moduleName, time.Now().Format("20060102-150405")))
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(backupDir, 0700); err != nil {
+		return "", fmt.Errorf("failed to create backup directory: %v", err)
+	}
+
+	module, err := readModuleFiles(filepath.Join(config.ComposeDir, moduleName))
+	if err != nil {
+		return "", err
+	}
+	if err := writeModuleFiles(backupDir, module); err != nil {
+		return "", err
+	}
+
+	for _, volume := range volumes {
+		output, err := exec.Command("docker", "run", "--rm",
+			"-v", volume+":/volume:ro", "-v", backupDir+":/backup", helperImage,
+			"tar", "czf", "/backup/"+volume+".tar.gz", "-C", "/volume", ".").CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("failed to archive volume %s: %v, output: %s", volume, err, output)
+		}
+		log.Printf("Archived volume %s to %s", volume, backupDir)
+	}
+	return backupDir, nil
+}
@@ -0,0 +1,137 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContextLines is the number of unchanged lines shown around each change
+const diffContextLines = 3
+
+// diffLine is one line of an edit script
+type diffLine struct {
+	kind byte // ' ', '-' or '+'
+	text string
+}
+
+// unifiedDiff returns a unified diff between two texts, or "" when they are equal
+func unifiedDiff(oldName, newName, oldText, newText string) string {
+	if oldText == newText {
+		return ""
+	}
+
+	oldLines := splitLines(oldText)
+	newLines := splitLines(newText)
+	script := diffLines(oldLines, newLines)
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "--- %s\n+++ %s\n", oldName, newName)
+
+	// Group the edit script into hunks with surrounding context
+	for start := 0; start < len(script); {
+		for start < len(script) && script[start].kind == ' ' {
+			start++
+		}
+		if start == len(script) {
+			break
+		}
+
+		hunkStart := start - diffContextLines
+		if hunkStart < 0 {
+			hunkStart = 0
+		}
+		hunkEnd := start
+		unchanged := 0
+		for hunkEnd < len(script) && unchanged <= 2*diffContextLines {
+			if script[hunkEnd].kind == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+			hunkEnd++
+		}
+		hunkEnd -= unchanged
+		if unchanged > diffContextLines {
+			unchanged = diffContextLines
+		}
+		hunkEnd += unchanged
+
+		oldStart, newStart := 1, 1
+		for _, line := range script[:hunkStart] {
+			if line.kind != '+' {
+				oldStart++
+			}
+			if line.kind != '-' {
+				newStart++
+			}
+		}
+		oldCount, newCount := 0, 0
+		for _, line := range script[hunkStart:hunkEnd] {
+			if line.kind != '+' {
+				oldCount++
+			}
+			if line.kind != '-' {
+				newCount++
+			}
+		}
+
+		fmt.Fprintf(&builder, "@@ -%d,%d +%d,%d @@\n", oldStart, oldCount, newStart, newCount)
+		for _, line := range script[hunkStart:hunkEnd] {
+			fmt.Fprintf(&builder, "%c%s\n", line.kind, line.text)
+		}
+		start = hunkEnd
+	}
+	return builder.String()
+}
+
+// diffLines computes a line edit script using the longest common subsequence
+func diffLines(oldLines, newLines []string) []diffLine {
+	// lengths[i][j] is the LCS length of oldLines[i:] and newLines[j:]
+	lengths := make([][]int, len(oldLines)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(newLines)+1)
+	}
+	for i := len(oldLines) - 1; i >= 0; i-- {
+		for j := len(newLines) - 1; j >= 0; j-- {
+			if oldLines[i] == newLines[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	script := []diffLine{}
+	i, j := 0, 0
+	for i < len(oldLines) && j < len(newLines) {
+		switch {
+		case oldLines[i] == newLines[j]:
+			script = append(script, diffLine{' ', oldLines[i]})
+			i++
+			j++
+		case lengths[i+1][j] >= lengths[i][j+1]:
+			script = append(script, diffLine{'-', oldLines[i]})
+			i++
+		default:
+			script = append(script, diffLine{'+', newLines[j]})
+			j++
+		}
+	}
+	for ; i < len(oldLines); i++ {
+		script = append(script, diffLine{'-', oldLines[i]})
+	}
+	for ; j < len(newLines); j++ {
+		script = append(script, diffLine{'+', newLines[j]})
+	}
+	return script
+}
+
+// splitLines splits text into lines without a trailing empty line
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package internal
+
+import "fmt"
+
+// filesystemUsage is not available where statfs is not
+func filesystemUsage(path string) (used, total uint64, err error) {
+	return 0, 0, fmt.Errorf("disk usage is not supported on this platform")
+}
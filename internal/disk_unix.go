@@ -0,0 +1,15 @@
+//go:build unix
+
+package internal
+
+import "syscall"
+
+// filesystemUsage returns the bytes used and the size of the filesystem holding path
+func filesystemUsage(path string) (used, total uint64, err error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, 0, err
+	}
+	total = stat.Blocks * uint64(stat.Bsize)
+	return total - stat.Bfree*uint64(stat.Bsize), total, nil
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Labels set by docker compose on the objects it creates
+const (
+	composeProjectLabel = "com.docker.compose.project"
+	composeServiceLabel = "com.docker.compose.service"
+)
+
+// ComposeContainer describes a container belonging to a compose project
+type ComposeContainer struct {
+	Name    string `json:"name"`
+	Service string `json:"service"`
+	State   string `json:"state"`
+	Status  string `json:"status"`
+	Image   string `json:"image"`
+}
+
+// composeCommand prepares a docker compose command for a module project
+func composeCommand(moduleDir, project string, args ...string) *exec.Cmd {
+	cmd := exec.Command("docker", append([]string{"compose", "-p", project}, args...)...)
+	cmd.Dir = moduleDir
+	return cmd
+}
+
+// ProjectContainers lists the containers of a compose project, including stopped ones
+func ProjectContainers(project string) ([]ComposeContainer, error) {
+	output, err := exec.Command("docker", "ps", "-a",
+		"--filter", "label="+composeProjectLabel+"="+project,
+		"--format", `{{.Names}}\t{{.Label "`+composeServiceLabel+`"}}\t{{.State}}\t{{.Status}}\t{{.Image}}`,
+	).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers of %s: %v", project, err)
+	}
+
+	containers := []ComposeContainer{}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 5 {
+			continue
+		}
+		containers = append(containers, ComposeContainer{
+			Name:    fields[0],
+			Service: fields[1],
+			State:   fields[2],
+			Status:  fields[3],
+			Image:   fields[4],
+		})
+	}
+	return containers, nil
+}
+
+// dockerObjectExists reports whether a docker network, volume or image exists
+func dockerObjectExists(kind, name string) bool {
+	return exec.Command("docker", kind, "inspect", name).Run() == nil
+}
+
+// dockerAvailable reports whether the docker daemon can be reached
+func dockerAvailable() bool {
+	return exec.Command("docker", "version", "--format", "{{.Server.Version}}").Run() == nil
+}
@@ -2,92 +2,95 @@ package internal
 
 import (
 	"fmt"
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
 	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
-	utils "github.com/FrancescoCorbosiero/go-docker-manager/pkg/utils"
+	"time"
 )
 
-// dockContainer creates a new module from a template and runs it
-func DockContainer(config shared.Configuration, containerName, templateName string) error {
+// DockContainer creates a new module from a template and runs it. A new module is rendered
+// into a staging directory and moved into place once validated; when it then fails to start,
+// onFailure decides between rolling it back and keeping it for debugging. The infrastructure
+// its template requires is bootstrapped or checked first, and the modules it depends on started.
+func DockContainer(config shared.Configuration, containerName, templateName string, snippets []shared.SnippetRef, onFailure string) error {
+	if err := EnsureInfrastructure(config, moduleTemplate(config, containerName, templateName)); err != nil {
+		return err
+	}
+	if err := ensureModuleDependencies(config, containerName); err != nil {
+		return err
+	}
+	return dockContainer(config, containerName, templateName, snippets, onFailure)
+}
+
+// dockContainer is DockContainer without the infrastructure check
+func dockContainer(config shared.Configuration, containerName, templateName string, snippets []shared.SnippetRef, onFailure string) error {
+	lock, err := LockModule(config, containerName, "dock")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
 	log.Printf("Docking container %s using template %s", containerName, templateName)
 
 	// Create module directory if it doesn't exist
 	moduleDir := filepath.Join(config.ComposeDir, containerName)
+	created := false
+	var createdVolumes []string
 	if _, err := os.Stat(moduleDir); os.IsNotExist(err) {
 		// Directory doesn't exist, we need to create it and set up the container
 		log.Printf("Creating new configuration for container %s", containerName)
-		
-		// Check if template exists
-		templateDir := filepath.Join(config.TemplatesDir, templateName)
-		if _, err := os.Stat(templateDir); os.IsNotExist(err) {
-			return fmt.Errorf("template %s does not exist", templateName)
-		}
 
-		err = os.MkdirAll(moduleDir, 0755)
+		err = stageModule(config, containerName, templateName, snippets)
 		if err != nil {
-			return fmt.Errorf("failed to create module directory: %v", err)
-		}
-
-		// Copy docker-compose.yml from template to module
-		err := utils.CopyFile(
-			filepath.Join(templateDir, "docker-compose.yml"),
-			filepath.Join(moduleDir, "docker-compose.yml"),
-		)
-		if err != nil {
-			return fmt.Errorf("failed to copy docker-compose.yml: %v", err)
-		}
-
-		// Read template .env file
-		templateEnvPath := filepath.Join(templateDir, ".env.template")
-		templateEnvContent, err := os.ReadFile(templateEnvPath)
-		if err != nil {
-			return fmt.Errorf("failed to read template .env file: %v", err)
-		}
-
-		// Process the .env template with user input for variable values
-		moduleEnvVars := utils.ProcessEnvTemplate(string(templateEnvContent))
-
-		// Create .env file with user-provided values
-		moduleEnvPath := filepath.Join(moduleDir, ".env")
-		moduleEnvFile, err := os.Create(moduleEnvPath)
-		if err != nil {
-			return fmt.Errorf("failed to create module .env file: %v", err)
-		}
-		defer moduleEnvFile.Close()
-
-		for key, value := range moduleEnvVars {
-			_, err := moduleEnvFile.WriteString(fmt.Sprintf("%s=%s\n", key, value))
-			if err != nil {
-				return fmt.Errorf("failed to write to module .env file: %v", err)
-			}
+			return err
 		}
+		created = true
+		createdVolumes = missingVolumes(config, containerName)
 	} else {
 		// Directory exists, check if config files exist
 		dockerComposePath := filepath.Join(moduleDir, "docker-compose.yml")
 		envFilePath := filepath.Join(moduleDir, ".env")
-		
+
 		if _, err := os.Stat(dockerComposePath); os.IsNotExist(err) {
 			return fmt.Errorf("docker-compose.yml not found for container %s", containerName)
 		}
-		
+
 		if _, err := os.Stat(envFilePath); os.IsNotExist(err) {
 			return fmt.Errorf(".env file not found for container %s", containerName)
 		}
-		
+
+		if len(snippets) > 0 {
+			log.Printf("Ignoring snippets for container %s: module is already configured", containerName)
+		}
+		if metadata, err := LoadModuleMetadata(config, containerName); err == nil && metadata.LastDock != nil && metadata.LastDock.Outcome != DockOutcomeDocked {
+			log.Printf("Container %s failed to dock at %s and was kept, retrying with its current files", containerName, metadata.LastDock.Time)
+			fmt.Printf("Container %s failed to dock at %s: %s\nRetrying with its current files\n", containerName, metadata.LastDock.Time, metadata.LastDock.Error)
+		}
 		log.Printf("Using existing configuration for container %s", containerName)
 	}
 
-	// Run the container with docker-compose
-	cmd := exec.Command("docker", "compose", "-p", containerName, "up", "-d")
-	cmd.Dir = moduleDir
-	output, err := cmd.CombinedOutput()
+	// Create the shared networks the module attaches to, then run it with docker-compose
+	err = EnsureModuleNetworks(config, containerName)
+	if err == nil {
+		var output []byte
+		output, err = composeCommand(moduleDir, containerName, "up", "-d").CombinedOutput()
+		if err != nil {
+			err = fmt.Errorf("failed to start container: %v, output: %s", err, output)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("failed to start container: %v, output: %s", err, output)
+		dockErr := err
+		if !created {
+			recordDock(config, containerName, DockOutcomeFailed, dockErr)
+			return dockErr
+		}
+		return handleDockFailure(config, containerName, onFailure, createdVolumes, dockErr)
 	}
 
+	recordDock(config, containerName, DockOutcomeDocked, nil)
+	recordDesiredState(config, containerName, DesiredRunning)
 	log.Printf("Container %s started successfully", containerName)
 	fmt.Printf("Container %s started successfully\n", containerName)
 	return nil
@@ -101,59 +104,132 @@ func ListContainers() error {
 	return cmd.Run()
 }
 
-// showLogs shows logs for a specific container
-func ShowLogs(containerName string) error {
-	// Find the directory for the container
-	moduleDir := filepath.Join("compose", containerName)
-	if _, err := os.Stat(moduleDir); os.IsNotExist(err) {
-		return fmt.Errorf("module directory for %s does not exist", containerName)
+// showLogs follows the logs of a module, or of the given services only
+func ShowLogs(config shared.Configuration, containerName string, services []string) error {
+	moduleDir, err := serviceModuleDir(config, containerName, services)
+	if err != nil {
+		return err
 	}
 
-	cmd := exec.Command("docker", "compose", "-p", containerName, "logs", "-f")
-	cmd.Dir = moduleDir
+	cmd := composeCommand(moduleDir, containerName, append([]string{"logs", "-f"}, services...)...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
 
-// stopContainer stops and removes a container
-func StopContainer(containerName string) error {
-	moduleDir := filepath.Join("compose", containerName)
-	if _, err := os.Stat(moduleDir); os.IsNotExist(err) {
-		return fmt.Errorf("module directory for %s does not exist", containerName)
+// restartContainer restarts the services of a module, all of them when services is empty,
+// using one of the restart strategies
+func RestartContainer(config shared.Configuration, containerName, strategy string, services []string, timeout time.Duration) error {
+	lock, err := LockModule(config, containerName, "restart")
+	if err != nil {
+		return err
 	}
+	defer lock.Unlock()
 
-	cmd := exec.Command("docker", "compose", "-p", containerName, "down")
-	cmd.Dir = moduleDir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	moduleDir, err := serviceModuleDir(config, containerName, services)
+	if err != nil {
+		return err
+	}
+
+	switch strategy {
+	case RestartInPlace:
+		output, err := composeCommand(moduleDir, containerName, append([]string{"restart"}, services...)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to restart container: %v, output: %s", err, output)
+		}
+	case RestartRecreate:
+		output, err := composeCommand(moduleDir, containerName, append([]string{"up", "-d", "--force-recreate"}, services...)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to recreate container: %v, output: %s", err, output)
+		}
+	case RestartRolling:
+		if err := rollingRestart(moduleDir, containerName, services, timeout); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown restart strategy %q", strategy)
+	}
+
+	log.Printf("Container %s restarted successfully (%s)", containerName, strategy)
+	fmt.Printf("Container %s restarted successfully\n", containerName)
+	return nil
 }
 
-// restartContainer restarts a container
-func RestartContainer(containerName string) error {
-	moduleDir := filepath.Join("compose", containerName)
+// UpgradeContainer re-renders a module from the current version of its template,
+// keeping its .env values, then pulls the images and recreates what changed
+func UpgradeContainer(config shared.Configuration, containerName string) error {
+	lock, err := LockModule(config, containerName, "upgrade")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	moduleDir := filepath.Join(config.ComposeDir, containerName)
 	if _, err := os.Stat(moduleDir); os.IsNotExist(err) {
 		return fmt.Errorf("module directory for %s does not exist", containerName)
 	}
 
-	// Stop first
-	stopCmd := exec.Command("docker", "compose", "-p", containerName, "down")
-	stopCmd.Dir = moduleDir
-	_, err := stopCmd.CombinedOutput()
+	rendered, err := renderUpgradedModule(config, containerName, os.Stdin)
+	if err != nil {
+		return err
+	}
+	err = writeModuleFiles(moduleDir, rendered)
 	if err != nil {
-		return fmt.Errorf("failed to stop container: %v", err)
+		return fmt.Errorf("failed to write module files: %v", err)
 	}
 
-	// Then start
-	startCmd := exec.Command("docker", "compose", "-p", containerName, "up", "-d")
-	startCmd.Dir = moduleDir
-	_, err = startCmd.CombinedOutput()
+	output, err := composeCommand(moduleDir, containerName, "pull").CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("failed to start container: %v", err)
+		return fmt.Errorf("failed to pull images: %v, output: %s", err, output)
 	}
 
-	log.Printf("Container %s restarted successfully", containerName)
-	fmt.Printf("Container %s restarted successfully\n", containerName)
+	if err := EnsureModuleNetworks(config, containerName); err != nil {
+		return err
+	}
+	output, err = composeCommand(moduleDir, containerName, "up", "-d").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to start container: %v, output: %s", err, output)
+	}
+
+	log.Printf("Container %s upgraded successfully", containerName)
+	fmt.Printf("Container %s upgraded successfully\n", containerName)
+	return nil
+}
+
+// SetEnv updates variables in the .env file of a module and, when the module is running,
+// recreates the services affected by the change
+func SetEnv(config shared.Configuration, containerName string, changes map[string]string) error {
+	lock, err := LockModule(config, containerName, "set-env")
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	moduleDir := filepath.Join(config.ComposeDir, containerName)
+	envPath := filepath.Join(moduleDir, ".env")
+	content, err := os.ReadFile(envPath)
+	if err != nil {
+		return fmt.Errorf(".env file not found for container %s: %v", containerName, err)
+	}
+
+	err = os.WriteFile(envPath, []byte(setEnvLines(string(content), changes)), 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write module .env file: %v", err)
+	}
+	for _, key := range sortedKeys(changes) {
+		log.Printf("Set %s for container %s", key, containerName)
+	}
+
+	if !ProjectRunning(containerName) {
+		fmt.Printf("Container %s is not running, the change applies on its next start\n", containerName)
+		return nil
+	}
+
+	output, err := composeCommand(moduleDir, containerName, "up", "-d").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to apply environment change: %v, output: %s", err, output)
+	}
+
+	fmt.Printf("Environment of container %s updated\n", containerName)
 	return nil
 }
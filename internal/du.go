@@ -0,0 +1,328 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// duHistoryName is the file of the compose dir holding the disk usage samples, one JSON per line
+const duHistoryName = ".du-history.jsonl"
+
+// duHistoryLimit is the number of samples kept, about six months of hourly samples of ten modules
+const duHistoryLimit = 50000
+
+// duSampleInterval is how often alert evaluations record a disk usage sample
+const duSampleInterval = time.Hour
+
+// duTrendWindow is the period over which the growth of a module is reported
+const duTrendWindow = 7 * 24 * time.Hour
+
+// DiskUsage is the disk used by a module. Volumes and logs count against its quota; images
+// are reported apart since modules share them.
+type DiskUsage struct {
+	Time    time.Time        `json:"time"`
+	Module  string           `json:"module"`
+	Volumes map[string]int64 `json:"volumes"`
+	Images  map[string]int64 `json:"images"`
+	Logs    int64            `json:"logs"`
+	// Total is the size of the volumes and logs
+	Total int64 `json:"total"`
+	Quota int64 `json:"quota,omitempty"`
+	// Growth is the change of Total over the trend window, from the recorded samples
+	Growth int64 `json:"growth"`
+}
+
+// OverQuota reports whether the module uses more than its quota
+func (u DiskUsage) OverQuota() bool {
+	return u.Quota > 0 && u.Total > u.Quota
+}
+
+// CollectDiskUsage measures the disk used by every module, or by the given one
+func CollectDiskUsage(config shared.Configuration, moduleName string) ([]DiskUsage, error) {
+	modules := []string{moduleName}
+	if moduleName == "" {
+		var err error
+		if modules, err = ListModuleNames(config); err != nil {
+			return nil, err
+		}
+	}
+	volumeSizes, imageSizes, err := dockerDiskUsage()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	usages := []DiskUsage{}
+	for _, module := range modules {
+		usage := DiskUsage{Time: now, Module: module, Volumes: map[string]int64{}, Images: map[string]int64{}}
+		if files, err := readModuleFiles(filepath.Join(config.ComposeDir, module)); err == nil {
+			volumes, _ := projectObjects(module, files, "volumes")
+			for _, volume := range volumes {
+				if size, found := volumeSizes[volume.name]; found && !volume.external {
+					usage.Volumes[volume.name] = size
+					usage.Total += size
+				}
+			}
+		}
+
+		containers, err := ProjectContainers(module)
+		if err != nil {
+			return nil, err
+		}
+		for _, container := range containers {
+			image := container.Image
+			if !strings.Contains(image[strings.LastIndex(image, "/")+1:], ":") {
+				image += ":latest"
+			}
+			if size, found := imageSizes[image]; found {
+				usage.Images[image] = size
+			}
+		}
+		usage.Logs = logSizes(containers)
+		usage.Total += usage.Logs
+
+		if quota, err := moduleQuota(config, module); err != nil {
+			log.Printf("Quota of %s ignored: %v", module, err)
+		} else {
+			usage.Quota = quota
+		}
+		usages = append(usages, usage)
+	}
+	return usages, nil
+}
+
+// moduleQuota returns the soft disk quota of a module, 0 without one
+func moduleQuota(config shared.Configuration, module string) (int64, error) {
+	metadata, err := LoadModuleMetadata(config, module)
+	if err != nil || metadata.Quota == "" {
+		return 0, nil
+	}
+	return parseByteSize(metadata.Quota, 1024)
+}
+
+// dockerDiskUsage returns the size of every volume and image, by volume name and repository:tag
+func dockerDiskUsage() (map[string]int64, map[string]int64, error) {
+	output, err := exec.Command("docker", "system", "df", "-v", "--format", "{{json .}}").Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read disk usage: %v", err)
+	}
+	var usage struct {
+		Images []struct {
+			Repository string `json:"Repository"`
+			Tag        string `json:"Tag"`
+			Size       string `json:"Size"`
+		} `json:"Images"`
+		Volumes []struct {
+			Name string `json:"Name"`
+			Size string `json:"Size"`
+		} `json:"Volumes"`
+	}
+	if err := json.Unmarshal(output, &usage); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse disk usage: %v", err)
+	}
+
+	volumes := make(map[string]int64)
+	for _, volume := range usage.Volumes {
+		if size, err := parseByteSize(volume.Size, 1000); err == nil {
+			volumes[volume.Name] = size
+		}
+	}
+	images := make(map[string]int64)
+	for _, image := range usage.Images {
+		if size, err := parseByteSize(image.Size, 1000); err == nil {
+			images[image.Repository+":"+image.Tag] = size
+		}
+	}
+	return volumes, images, nil
+}
+
+// logSizes returns the size of the json-file logs of containers. Logs kept by other drivers,
+// or unreadable without root, count as empty.
+func logSizes(containers []ComposeContainer) int64 {
+	if len(containers) == 0 {
+		return 0
+	}
+	args := []string{"inspect", "--format", "{{.LogPath}}"}
+	for _, container := range containers {
+		args = append(args, container.Name)
+	}
+	output, err := exec.Command("docker", args...).Output()
+	if err != nil {
+		return 0
+	}
+
+	var total int64
+	for _, path := range strings.Fields(string(output)) {
+		if info, err := os.Stat(path); err == nil {
+			total += info.Size()
+		}
+	}
+	return total
+}
+
+// RecordDiskUsage appends disk usage samples to the history
+func RecordDiskUsage(config shared.Configuration, usages []DiskUsage) error {
+	history, err := openJSONLog(filepath.Join(config.ComposeDir, duHistoryName), duHistoryLimit, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open the disk usage history: %v", err)
+	}
+	for _, usage := range usages {
+		if err := history.append(usage); err != nil {
+			return fmt.Errorf("failed to record disk usage: %v", err)
+		}
+	}
+	return nil
+}
+
+// readDiskHistory returns the recorded samples, oldest first
+func readDiskHistory(config shared.Configuration) ([]DiskUsage, error) {
+	samples := []DiskUsage{}
+	err := readJSONLog(filepath.Join(config.ComposeDir, duHistoryName), func(line []byte) {
+		var sample DiskUsage
+		if json.Unmarshal(line, &sample) == nil {
+			samples = append(samples, sample)
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the disk usage history: %v", err)
+	}
+	return samples, nil
+}
+
+// latestDiskUsage returns the last recorded sample of every module
+func latestDiskUsage(config shared.Configuration) (map[string]DiskUsage, error) {
+	samples, err := readDiskHistory(config)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]DiskUsage)
+	for _, sample := range samples {
+		latest[sample.Module] = sample
+	}
+	return latest, nil
+}
+
+// setGrowth sets the growth of every usage since the oldest sample within the trend window
+func setGrowth(usages []DiskUsage, samples []DiskUsage) {
+	for i := range usages {
+		usage := &usages[i]
+		for _, sample := range samples {
+			if sample.Module == usage.Module && usage.Time.Sub(sample.Time) <= duTrendWindow {
+				usage.Growth = usage.Total - sample.Total
+				break
+			}
+		}
+	}
+}
+
+// DiskUsageReport measures the disk usage, computes the trends from the history and records
+// the new samples
+func DiskUsageReport(config shared.Configuration, moduleName string) ([]DiskUsage, error) {
+	usages, err := CollectDiskUsage(config, moduleName)
+	if err != nil {
+		return nil, err
+	}
+	samples, err := readDiskHistory(config)
+	if err != nil {
+		return nil, err
+	}
+	setGrowth(usages, samples)
+	return usages, RecordDiskUsage(config, usages)
+}
+
+// sampleDiskUsage returns the last recorded disk usage of every module, measuring and
+// recording it again when a sample is older than the sample interval, for the alerts
+func sampleDiskUsage(config shared.Configuration) ([]DiskUsage, error) {
+	latest, err := latestDiskUsage(config)
+	if err != nil {
+		return nil, err
+	}
+	modules, err := ListModuleNames(config)
+	if err != nil {
+		return nil, err
+	}
+
+	usages := []DiskUsage{}
+	for _, module := range modules {
+		usage, found := latest[module]
+		if !found || time.Since(usage.Time) >= duSampleInterval {
+			if usages, err = CollectDiskUsage(config, ""); err != nil {
+				return nil, err
+			}
+			return usages, RecordDiskUsage(config, usages)
+		}
+		usages = append(usages, withQuota(config, usage))
+	}
+	return usages, nil
+}
+
+// withQuota sets the current quota of the module on a recorded sample
+func withQuota(config shared.Configuration, usage DiskUsage) DiskUsage {
+	if quota, err := moduleQuota(config, usage.Module); err == nil {
+		usage.Quota = quota
+	}
+	return usage
+}
+
+// quotaWarning describes a module over its quota, empty when it is not
+func quotaWarning(usage DiskUsage) string {
+	if !usage.OverQuota() {
+		return ""
+	}
+	return fmt.Sprintf("%s uses %s, over its quota of %s", usage.Module, formatBytes(usage.Total), formatBytes(usage.Quota))
+}
+
+// PrintQuotaWarnings prints the modules over quota at their last recorded disk usage, as
+// measured by du or the alert evaluations
+func PrintQuotaWarnings(config shared.Configuration) error {
+	latest, err := latestDiskUsage(config)
+	if err != nil {
+		return err
+	}
+	for _, module := range sortedKeys(latest) {
+		usage := withQuota(config, latest[module])
+		if warning := quotaWarning(usage); warning != "" {
+			fmt.Printf("⚠️  %s (measured %s)\n", warning, usage.Time.Local().Format("2006-01-02 15:04"))
+		}
+	}
+	return nil
+}
+
+// PrintDiskUsage prints the disk usage of every module, its growth over the trend window and
+// its quota, followed by its volumes and images
+func PrintDiskUsage(usages []DiskUsage) {
+	fmt.Printf("%-24s %10s %10s %10s %10s %10s %11s\n", "MODULE", "VOLUMES", "LOGS", "TOTAL", "QUOTA", "USED", "GROWTH (7d)")
+	for _, usage := range usages {
+		quota, used := "-", "-"
+		if usage.Quota > 0 {
+			quota = formatBytes(usage.Quota)
+			used = fmt.Sprintf("%.0f%%", float64(usage.Total)*100/float64(usage.Quota))
+		}
+		growth := "+" + formatBytes(usage.Growth)
+		if usage.Growth < 0 {
+			growth = "-" + formatBytes(-usage.Growth)
+		}
+		fmt.Printf("%-24s %10s %10s %10s %10s %10s %11s\n", usage.Module, formatBytes(usage.Total-usage.Logs),
+			formatBytes(usage.Logs), formatBytes(usage.Total), quota, used, growth)
+		for _, volume := range sortedKeys(usage.Volumes) {
+			fmt.Printf("  volume %-40s %10s\n", volume, formatBytes(usage.Volumes[volume]))
+		}
+		for _, image := range sortedKeys(usage.Images) {
+			fmt.Printf("  image  %-40s %10s\n", image, formatBytes(usage.Images[image]))
+		}
+	}
+
+	for _, usage := range usages {
+		if warning := quotaWarning(usage); warning != "" {
+			fmt.Printf("⚠️  %s\n", warning)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+// composeVariablePattern matches $VAR, ${VAR} and ${VAR:-default} style references, and $$ escapes
+var composeVariablePattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)((?::?[-?+])([^}]*))?\}|\$([A-Za-z_][A-Za-z0-9_]*)`)
+
+// ParseEnv parses KEY=VALUE lines, ignoring blank lines and comments
+func ParseEnv(content string) map[string]string {
+	env := make(map[string]string)
+	for _, line := range strings.Split(content, "\n") {
+		key, ok := envLineKey(line)
+		if !ok {
+			continue
+		}
+		env[key] = strings.SplitN(strings.TrimSpace(line), "=", 2)[1]
+	}
+	return env
+}
+
+// ReadEnvFile reads a .env file into a map
+func ReadEnvFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEnv(string(content)), nil
+}
+
+// composeVariables returns the variables referenced in a compose value and whether each has a default
+func composeVariables(value string) map[string]bool {
+	variables := make(map[string]bool)
+	for _, match := range composeVariablePattern.FindAllStringSubmatch(value, -1) {
+		switch {
+		case match[1] != "":
+			hasDefault := strings.HasPrefix(match[2], ":-") || strings.HasPrefix(match[2], "-")
+			variables[match[1]] = variables[match[1]] || hasDefault
+		case match[4] != "":
+			variables[match[4]] = variables[match[4]] || false
+		}
+	}
+	return variables
+}
+
+// interpolateEnv replaces compose variable references in value with their env values,
+// applying ${VAR:-default} fallbacks like docker compose does
+func interpolateEnv(value string, env map[string]string) string {
+	return composeVariablePattern.ReplaceAllStringFunc(value, func(reference string) string {
+		if reference == "$$" {
+			return "$"
+		}
+		match := composeVariablePattern.FindStringSubmatch(reference)
+		name := match[1]
+		if name == "" {
+			name = match[4]
+		}
+
+		current, set := env[name]
+		switch {
+		case strings.HasPrefix(match[2], ":-") && current == "":
+			return match[3]
+		case strings.HasPrefix(match[2], "-") && !set:
+			return match[3]
+		}
+		return current
+	})
+}
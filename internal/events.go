@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// eventLogName is the file of the compose dir holding the recorded events, one JSON per line
+const eventLogName = ".events.jsonl"
+
+// eventLogLimit is the number of events kept in the event log
+const eventLogLimit = 5000
+
+// eventRetryInterval is how long the recorder waits before subscribing again when the
+// docker events stream ends, for instance while the daemon restarts
+const eventRetryInterval = 5 * time.Second
+
+// eventActions are the container events recorded, the others (exec, attach, ...) are noise
+var eventActions = map[string]bool{
+	"create": true, "start": true, "restart": true, "stop": true, "die": true, "kill": true,
+	"oom": true, "destroy": true, "pause": true, "unpause": true, "health_status": true,
+}
+
+// ModuleEvent is a docker container event mapped to the module and service it belongs to
+type ModuleEvent struct {
+	Time      time.Time `json:"time"`
+	Module    string    `json:"module"`
+	Service   string    `json:"service"`
+	Container string    `json:"container"`
+	Action    string    `json:"action"`
+	Message   string    `json:"message"`
+}
+
+// dockerEvent is the part of a `docker events` JSON line used here
+type dockerEvent struct {
+	Type   string `json:"Type"`
+	Action string `json:"Action"`
+	Actor  struct {
+		Attributes map[string]string `json:"Attributes"`
+	} `json:"Actor"`
+	TimeNano int64 `json:"timeNano"`
+}
+
+// parseDockerEvent maps a docker event to a module event, false for events of containers
+// outside compose projects and for uninteresting actions
+func parseDockerEvent(line []byte) (ModuleEvent, bool) {
+	var raw dockerEvent
+	if err := json.Unmarshal(line, &raw); err != nil || raw.Type != "container" {
+		return ModuleEvent{}, false
+	}
+	attributes := raw.Actor.Attributes
+	action, detail, _ := strings.Cut(raw.Action, ": ")
+	if !eventActions[action] || attributes[composeProjectLabel] == "" {
+		return ModuleEvent{}, false
+	}
+
+	event := ModuleEvent{
+		Time:      time.Unix(0, raw.TimeNano),
+		Module:    attributes[composeProjectLabel],
+		Service:   attributes[composeServiceLabel],
+		Container: attributes["name"],
+		Action:    action,
+		Message:   action,
+	}
+	switch action {
+	case "oom":
+		event.Message = "OOM-killed"
+	case "die":
+		event.Message = "exited with code " + attributes["exitCode"]
+	case "kill":
+		event.Message = "killed with signal " + attributes["signal"]
+	case "health_status":
+		event.Message = "health: " + strings.TrimSpace(detail)
+	}
+	return event, true
+}
+
+// readEventLog returns the recorded events, oldest first
+func readEventLog(config shared.Configuration) ([]ModuleEvent, error) {
+	events := []ModuleEvent{}
+	err := readJSONLog(filepath.Join(config.ComposeDir, eventLogName), func(line []byte) {
+		var event ModuleEvent
+		if json.Unmarshal(line, &event) == nil {
+			events = append(events, event)
+		}
+	})
+	return events, err
+}
+
+// ReadEvents returns the last limit recorded events of a module, of every module when
+// moduleName is empty, oldest first
+func ReadEvents(config shared.Configuration, moduleName string, limit int) ([]ModuleEvent, error) {
+	events, err := readEventLog(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the event log: %v", err)
+	}
+	selected := []ModuleEvent{}
+	for _, event := range events {
+		if moduleName == "" || event.Module == moduleName {
+			selected = append(selected, event)
+		}
+	}
+	if limit > 0 && len(selected) > limit {
+		selected = selected[len(selected)-limit:]
+	}
+	return selected, nil
+}
+
+// WatchEvents subscribes to the docker events stream until ctx is done, passing the events
+// of compose containers to handler. The first watcher records them in the event log; while
+// one does, the others only pass them on. The subscription is renewed when the stream ends.
+func WatchEvents(ctx context.Context, config shared.Configuration, handler func(ModuleEvent)) {
+	config.LockTimeout = 0
+	var recorder *jsonLog
+	if lock, err := acquireLock(config, "events", "event log", "record events"); err == nil {
+		defer lock.Unlock()
+		if recorder, err = openJSONLog(filepath.Join(config.ComposeDir, eventLogName), eventLogLimit, 0644); err != nil {
+			log.Printf("Events are not recorded: %v", err)
+		}
+	}
+
+	for {
+		err := streamEvents(ctx, func(event ModuleEvent) {
+			if recorder != nil {
+				if err := recorder.append(event); err != nil {
+					log.Printf("Failed to record event: %v", err)
+				}
+			}
+			if handler != nil {
+				handler(event)
+			}
+		})
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Docker events stream ended: %v, subscribing again in %s", err, eventRetryInterval)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(eventRetryInterval):
+		}
+	}
+}
+
+// streamEvents runs `docker events` for compose containers until it exits or ctx is done
+func streamEvents(ctx context.Context, handler func(ModuleEvent)) error {
+	cmd := exec.CommandContext(ctx, "docker", "events", "--format", "{{json .}}",
+		"--filter", "type=container", "--filter", "label="+composeProjectLabel)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		if event, ok := parseDockerEvent(scanner.Bytes()); ok {
+			handler(event)
+		}
+	}
+	return cmd.Wait()
+}
+
+// PrintEvent prints an event on one line
+func PrintEvent(event ModuleEvent) {
+	fmt.Printf("%s  %-20s %-16s %s\n", event.Time.Local().Format("2006-01-02 15:04:05"), event.Module, orDash(event.Service), event.Message)
+}
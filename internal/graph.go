@@ -0,0 +1,354 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// GraphEdge is a dependency of a module on another one
+type GraphEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Reason is "depends_on" for declared dependencies, or the required infrastructure template
+	Reason string `json:"reason"`
+}
+
+// ModuleGraph is the dependency graph of the docked modules
+type ModuleGraph struct {
+	Modules []string    `json:"modules"`
+	Edges   []GraphEdge `json:"edges"`
+}
+
+// BuildModuleGraph returns the dependencies of every module: those declared under
+// depends_on in module.yml, and the modules docked from the infrastructure templates its
+// template requires
+func BuildModuleGraph(config shared.Configuration) (*ModuleGraph, error) {
+	modules, err := ListModuleNames(config)
+	if err != nil {
+		return nil, err
+	}
+	graph := &ModuleGraph{Modules: modules, Edges: []GraphEdge{}}
+	for _, module := range modules {
+		if err := graph.addModuleEdges(config, module); err != nil {
+			return nil, err
+		}
+	}
+	return graph, nil
+}
+
+// addModuleEdges records the dependencies of one module among the modules of the graph
+func (g *ModuleGraph) addModuleEdges(config shared.Configuration, module string) error {
+	metadata, err := LoadModuleMetadata(config, module)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read metadata of %s: %v", module, err)
+	}
+	for _, dependency := range metadata.DependsOn {
+		if !containsString(g.Modules, dependency) {
+			return fmt.Errorf("module %s depends on unknown module %s", module, dependency)
+		}
+		g.addEdge(module, dependency, "depends_on")
+	}
+
+	if metadata.Template == "" {
+		return nil
+	}
+	resolved, err := ResolveTemplate(config, metadata.Template)
+	if err != nil {
+		log.Printf("Requirements of %s ignored: %v", module, err)
+		return nil
+	}
+	for _, required := range resolved.Requires {
+		providers, err := infrastructureModules(config, required)
+		if err != nil {
+			return err
+		}
+		for _, provider := range providers {
+			if provider != module {
+				g.addEdge(module, provider, "requires "+required)
+			}
+		}
+	}
+	return nil
+}
+
+// buildDependencyGraph returns the graph of a module and of the modules it depends on,
+// directly or not, so that problems elsewhere in the tree do not concern it
+func buildDependencyGraph(config shared.Configuration, module string) (*ModuleGraph, error) {
+	modules, err := ListModuleNames(config)
+	if err != nil {
+		return nil, err
+	}
+	graph := &ModuleGraph{Modules: modules, Edges: []GraphEdge{}}
+	visited := map[string]bool{module: true}
+	for pending := []string{module}; len(pending) > 0; pending = pending[1:] {
+		if err := graph.addModuleEdges(config, pending[0]); err != nil {
+			return nil, err
+		}
+		for _, dependency := range graph.dependencies(pending[0]) {
+			if !visited[dependency] {
+				visited[dependency] = true
+				pending = append(pending, dependency)
+			}
+		}
+	}
+	return graph, nil
+}
+
+// addEdge records a dependency once
+func (g *ModuleGraph) addEdge(from, to, reason string) {
+	for _, edge := range g.Edges {
+		if edge.From == from && edge.To == to {
+			return
+		}
+	}
+	g.Edges = append(g.Edges, GraphEdge{From: from, To: to, Reason: reason})
+}
+
+// dependencies returns the modules a module depends on, sorted
+func (g *ModuleGraph) dependencies(module string) []string {
+	dependencies := []string{}
+	for _, edge := range g.Edges {
+		if edge.From == module {
+			dependencies = append(dependencies, edge.To)
+		}
+	}
+	sort.Strings(dependencies)
+	return dependencies
+}
+
+// dependents returns the modules depending on a module, sorted
+func (g *ModuleGraph) dependents(module string) []string {
+	dependents := []string{}
+	for _, edge := range g.Edges {
+		if edge.To == module {
+			dependents = append(dependents, edge.From)
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// Order returns the modules with every dependency before the modules depending on it, or an
+// error naming a dependency cycle
+func (g *ModuleGraph) Order() ([]string, error) {
+	return g.orderFrom(g.Modules)
+}
+
+// orderFrom returns the given modules and those they depend on, directly or not, with every
+// dependency first, or an error naming a dependency cycle reachable from them
+func (g *ModuleGraph) orderFrom(roots []string) ([]string, error) {
+	order := []string{}
+	state := make(map[string]int) // 1 while visiting, 2 once ordered
+	var visit func(module string, path []string) error
+	visit = func(module string, path []string) error {
+		switch state[module] {
+		case 1:
+			start := 0
+			for i, name := range path {
+				if name == module {
+					start = i
+				}
+			}
+			return fmt.Errorf("dependency cycle: %s", strings.Join(append(path[start:], module), " -> "))
+		case 2:
+			return nil
+		}
+
+		state[module] = 1
+		for _, dependency := range g.dependencies(module) {
+			if err := visit(dependency, append(path, module)); err != nil {
+				return err
+			}
+		}
+		state[module] = 2
+		order = append(order, module)
+		return nil
+	}
+
+	for _, module := range roots {
+		if err := visit(module, nil); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
+// PrintGraph prints the graph as text, each module followed by its dependencies, as DOT or
+// as JSON
+func PrintGraph(graph *ModuleGraph, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(graph); err != nil {
+			return err
+		}
+		_, err := graph.Order()
+		return err
+	}
+	if format == "dot" {
+		fmt.Println("digraph modules {")
+		fmt.Println("  rankdir=LR;")
+		for _, module := range graph.Modules {
+			fmt.Printf("  %q;\n", module)
+		}
+		for _, edge := range graph.Edges {
+			style := ""
+			if edge.Reason != "depends_on" {
+				style = ", style=dashed"
+			}
+			fmt.Printf("  %q -> %q [label=%q%s];\n", edge.From, edge.To, edge.Reason, style)
+		}
+		fmt.Println("}")
+		_, err := graph.Order()
+		return err
+	}
+
+	order, err := graph.Order()
+	if err != nil {
+		return err
+	}
+	if len(order) == 0 {
+		fmt.Println("No module is docked")
+		return nil
+	}
+	for _, module := range order {
+		fmt.Println(module)
+		for _, edge := range graph.Edges {
+			if edge.From == module {
+				fmt.Printf("  -> %s (%s)\n", edge.To, edge.Reason)
+			}
+		}
+	}
+	return nil
+}
+
+// UpAll starts every module in dependency order, waiting for modules others depend on to be
+// healthy before starting their dependents. The dependents of a module that fails are skipped,
+// and so are the modules desired stopped and their dependents.
+func UpAll(config shared.Configuration, timeout time.Duration, logLines int) ([]BulkResult, error) {
+	graph, err := BuildModuleGraph(config)
+	if err != nil {
+		return nil, err
+	}
+	order, err := graph.Order()
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make(map[string]bool)
+	stopped := make(map[string]bool)
+	results := []BulkResult{}
+	for i, module := range order {
+		start := time.Now()
+		if reason := stoppedReason(config, graph, module, stopped); reason != "" {
+			stopped[module] = true
+			results = append(results, BulkResult{Module: module, Skipped: reason})
+			printBulkProgress(i+1, len(order), "up", results[len(results)-1])
+			continue
+		}
+		err := dependencyFailure(graph, module, failed)
+		if err == nil {
+			err = Audited(config, AuditEntry{User: CurrentUser(), Source: AuditCLI, Operation: "up-all", Module: module}, func() error {
+				if err := dockContainer(config, module, "", nil, DockFailureKeep); err != nil {
+					return err
+				}
+				if len(graph.dependents(module)) > 0 {
+					return WaitHealthy(module, timeout, logLines)
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			failed[module] = true
+		}
+		results = append(results, BulkResult{Module: module, Err: err, Duration: time.Since(start)})
+		printBulkProgress(i+1, len(order), "up", results[len(results)-1])
+	}
+	return results, nil
+}
+
+// DownAll stops every module in reverse dependency order, dependents first
+func DownAll(config shared.Configuration) ([]BulkResult, error) {
+	graph, err := BuildModuleGraph(config)
+	if err != nil {
+		return nil, err
+	}
+	order, err := graph.Order()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []BulkResult{}
+	for i := len(order) - 1; i >= 0; i-- {
+		start := time.Now()
+		err := Audited(config, AuditEntry{User: CurrentUser(), Source: AuditCLI, Operation: "down-all", Module: order[i]}, func() error {
+			return DownContainer(config, order[i])
+		})
+		results = append(results, BulkResult{Module: order[i], Err: err, Duration: time.Since(start)})
+		printBulkProgress(len(results), len(order), "down", results[len(results)-1])
+	}
+	return results, nil
+}
+
+// stoppedReason returns why up-all leaves a module stopped: it is desired stopped, or one of
+// its dependencies was left stopped. It is empty when the module is to be started.
+func stoppedReason(config shared.Configuration, graph *ModuleGraph, module string, stopped map[string]bool) string {
+	if metadata, _ := LoadModuleMetadata(config, module); desiredState(metadata) == DesiredStopped {
+		return "desired stopped"
+	}
+	for _, dependency := range graph.dependencies(module) {
+		if stopped[dependency] {
+			return fmt.Sprintf("dependency %s is left stopped", dependency)
+		}
+	}
+	return ""
+}
+
+// dependencyFailure returns an error when a dependency of a module failed to start
+func dependencyFailure(graph *ModuleGraph, module string, failed map[string]bool) error {
+	for _, dependency := range graph.dependencies(module) {
+		if failed[dependency] {
+			return fmt.Errorf("skipped, dependency %s failed", dependency)
+		}
+	}
+	return nil
+}
+
+// ensureModuleDependencies starts the modules a module depends on, directly or not, that
+// are not running, in dependency order. Only the dependencies of the module are checked, and
+// a dependency desired stopped is not started behind the operator's back.
+func ensureModuleDependencies(config shared.Configuration, module string) error {
+	graph, err := buildDependencyGraph(config, module)
+	if err != nil {
+		return err
+	}
+	order, err := graph.orderFrom([]string{module})
+	if err != nil {
+		return err
+	}
+
+	for _, dependency := range order {
+		if dependency == module || ProjectRunning(dependency) {
+			continue
+		}
+		if metadata, _ := LoadModuleMetadata(config, dependency); desiredState(metadata) == DesiredStopped {
+			return fmt.Errorf("dependency %s of %s is desired stopped, start it first", dependency, module)
+		}
+		log.Printf("Starting %s, a dependency of %s", dependency, module)
+		fmt.Printf("Starting %s, a dependency of %s\n", dependency, module)
+		if err := dockContainer(config, dependency, "", nil, DockFailureKeep); err != nil {
+			return fmt.Errorf("failed to start dependency %s: %v", dependency, err)
+		}
+	}
+	return nil
+}
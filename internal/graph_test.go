@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// graphFixture creates a compose dir with a module per entry of dependsOn, depending on the
+// modules listed
+func graphFixture(t *testing.T, dependsOn map[string][]string) shared.Configuration {
+	t.Helper()
+	config := shared.Configuration{ComposeDir: t.TempDir(), TemplatesDir: t.TempDir()}
+	for module, dependencies := range dependsOn {
+		dir := filepath.Join(config.ComposeDir, module)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte("services: {}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		metadata := "depends_on: [" + strings.Join(dependencies, ", ") + "]\n"
+		if err := os.WriteFile(filepath.Join(dir, ModuleMetadataFile), []byte(metadata), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return config
+}
+
+// assertBefore checks that every module of order comes after its dependencies
+func assertBefore(t *testing.T, order []string, dependsOn map[string][]string) {
+	t.Helper()
+	position := make(map[string]int)
+	for i, module := range order {
+		position[module] = i
+	}
+	for module, dependencies := range dependsOn {
+		for _, dependency := range dependencies {
+			if position[dependency] > position[module] {
+				t.Errorf("%s ordered before its dependency %s in %v", module, dependency, order)
+			}
+		}
+	}
+}
+
+func TestModuleGraphOrder(t *testing.T) {
+	tests := []struct {
+		name      string
+		dependsOn map[string][]string
+		wantCycle string
+	}{
+		{"independent", map[string][]string{"a": nil, "b": nil}, ""},
+		{"chain", map[string][]string{"site": {"db"}, "db": {"proxy"}, "proxy": nil}, ""},
+		{"diamond", map[string][]string{"site": {"db", "cache"}, "db": {"proxy"}, "cache": {"proxy"}, "proxy": nil}, ""},
+		{"self", map[string][]string{"a": {"a"}}, "a -> a"},
+		{"cycle", map[string][]string{"a": {"b"}, "b": {"c"}, "c": {"a"}}, "dependency cycle"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			graph, err := BuildModuleGraph(graphFixture(t, test.dependsOn))
+			if err != nil {
+				t.Fatal(err)
+			}
+			order, err := graph.Order()
+			if test.wantCycle != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantCycle) {
+					t.Fatalf("Order error = %v, want %q", err, test.wantCycle)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(order) != len(test.dependsOn) {
+				t.Fatalf("Order = %v, want every module of %v", order, test.dependsOn)
+			}
+			assertBefore(t, order, test.dependsOn)
+		})
+	}
+}
+
+func TestBuildModuleGraphUnknownDependency(t *testing.T) {
+	config := graphFixture(t, map[string][]string{"site": {"missing"}})
+	if _, err := BuildModuleGraph(config); err == nil || !strings.Contains(err.Error(), "unknown module missing") {
+		t.Errorf("BuildModuleGraph error = %v, want an unknown module error", err)
+	}
+}
+
+func TestDependencyGraphIgnoresUnrelatedModules(t *testing.T) {
+	dependsOn := map[string][]string{
+		"site": {"db"}, "db": nil,
+		// Broken modules the site does not depend on
+		"loop1": {"loop2"}, "loop2": {"loop1"}, "orphan": {"missing"},
+	}
+	config := graphFixture(t, dependsOn)
+
+	tests := []struct {
+		module  string
+		want    []string
+		wantErr string
+	}{
+		{"site", []string{"db", "site"}, ""},
+		{"new", []string{"new"}, ""},
+		{"loop1", nil, "dependency cycle"},
+		{"orphan", nil, "unknown module missing"},
+	}
+	for _, test := range tests {
+		graph, err := buildDependencyGraph(config, test.module)
+		var order []string
+		if err == nil {
+			order, err = graph.orderFrom([]string{test.module})
+		}
+		if test.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("dependencies of %s: error = %v, want %q", test.module, err, test.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("dependencies of %s: %v", test.module, err)
+			continue
+		}
+		if strings.Join(order, ",") != strings.Join(test.want, ",") {
+			t.Errorf("dependencies of %s = %v, want %v", test.module, order, test.want)
+		}
+	}
+}
+
+func TestStoppedReason(t *testing.T) {
+	dependsOn := map[string][]string{"site": {"db"}, "db": nil, "worker": {"site"}, "proxy": nil}
+	config := graphFixture(t, dependsOn)
+	recordDesiredState(config, "db", DesiredStopped)
+	graph, err := BuildModuleGraph(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := graph.Order()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"db": "desired stopped", "site": "dependency db is left stopped", "worker": "dependency site is left stopped", "proxy": ""}
+	stopped := make(map[string]bool)
+	for _, module := range order {
+		reason := stoppedReason(config, graph, module, stopped)
+		if reason != "" {
+			stopped[module] = true
+		}
+		if reason != want[module] {
+			t.Errorf("stoppedReason(%s) = %q, want %q", module, reason, want[module])
+		}
+	}
+}
+
+func TestEnsureModuleDependenciesKeepsStoppedDependency(t *testing.T) {
+	config := graphFixture(t, map[string][]string{"site": {"db"}, "db": nil})
+	recordDesiredState(config, "db", DesiredStopped)
+	if err := ensureModuleDependencies(config, "site"); err == nil || !strings.Contains(err.Error(), "dependency db of site is desired stopped") {
+		t.Errorf("ensureModuleDependencies error = %v, want the stopped dependency named", err)
+	}
+	if metadata, _ := LoadModuleMetadata(config, "db"); metadata.DesiredState != DesiredStopped {
+		t.Errorf("desired state of db = %q, want it kept stopped", metadata.DesiredState)
+	}
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// healthPollInterval is how often container states are checked while waiting
+const healthPollInterval = 2 * time.Second
+
+// Container health as derived from its state and healthcheck
+const (
+	HealthHealthy   = "healthy"
+	HealthStarting  = "starting"
+	HealthUnhealthy = "unhealthy"
+	HealthRunning   = "running"
+	HealthStopped   = "stopped"
+	HealthCompleted = "completed"
+)
+
+// containerHealth derives the health of a container from `docker ps`. Containers
+// without a healthcheck count as ready once running.
+func containerHealth(container ComposeContainer) string {
+	if container.State == "exited" && strings.HasPrefix(container.Status, "Exited (0)") {
+		// One-shot services such as init or migration jobs
+		return HealthCompleted
+	}
+	if container.State != "running" {
+		return HealthStopped
+	}
+	switch {
+	case strings.Contains(container.Status, "(healthy)"):
+		return HealthHealthy
+	case strings.Contains(container.Status, "(unhealthy)"):
+		return HealthUnhealthy
+	case strings.Contains(container.Status, "(health: starting)"):
+		return HealthStarting
+	default:
+		return HealthRunning
+	}
+}
+
+// healthReady reports whether a health state is the final good one
+func healthReady(health string) bool {
+	return health == HealthHealthy || health == HealthRunning || health == HealthCompleted
+}
+
+// WaitHealthy waits until every container of a module is healthy, or running when it has
+// no healthcheck. Progress is printed per service as states change. When a container turns
+// unhealthy or stops, or the timeout expires, the last logLines lines of the failing
+// containers are printed and an error is returned.
+func WaitHealthy(project string, timeout time.Duration, logLines int) error {
+	fmt.Printf("Waiting up to %s for %s to become healthy\n", timeout, project)
+	if err := waitContainersHealthy(project, nil, timeout, logLines); err != nil {
+		return err
+	}
+	fmt.Printf("Container %s is healthy\n", project)
+	return nil
+}
+
+// waitContainersHealthy is WaitHealthy restricted to the named containers, or to every
+// container of the project when names is nil
+func waitContainersHealthy(project string, names map[string]bool, timeout time.Duration, logLines int) error {
+	start := time.Now()
+	deadline := start.Add(timeout)
+	reported := make(map[string]string)
+
+	for {
+		containers, err := ProjectContainers(project)
+		if err != nil {
+			return err
+		}
+		if names != nil {
+			selected := []ComposeContainer{}
+			for _, container := range containers {
+				if names[container.Name] {
+					selected = append(selected, container)
+				}
+			}
+			containers = selected
+		}
+		if len(containers) == 0 {
+			return fmt.Errorf("no containers found for %s", project)
+		}
+
+		failing := []ComposeContainer{}
+		pending := []ComposeContainer{}
+		for _, container := range containers {
+			health := containerHealth(container)
+			if reported[container.Name] != health {
+				reported[container.Name] = health
+				fmt.Printf("  [%3ds] %-20s %-10s %s\n", int(time.Since(start).Seconds()), container.Service, health, container.Status)
+			}
+
+			switch {
+			case health == HealthUnhealthy || health == HealthStopped:
+				failing = append(failing, container)
+			case !healthReady(health):
+				pending = append(pending, container)
+			}
+		}
+
+		if len(failing) > 0 {
+			printContainerLogs(failing, logLines)
+			return fmt.Errorf("services of %s failed: %s", project, containerServices(failing))
+		}
+		if len(pending) == 0 {
+			log.Printf("Containers of %s are healthy after %s", project, time.Since(start).Round(time.Second))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			printContainerLogs(pending, logLines)
+			return fmt.Errorf("timed out after %s waiting for %s: %s", timeout, project, containerServices(pending))
+		}
+		time.Sleep(healthPollInterval)
+	}
+}
+
+// printContainerLogs prints the last lines of the logs of each container
+func printContainerLogs(containers []ComposeContainer, lines int) {
+	if lines <= 0 {
+		return
+	}
+	for _, container := range containers {
+		fmt.Printf("\n--- last %d log lines of %s (%s) ---\n", lines, container.Service, container.Name)
+		output, err := exec.Command("docker", "logs", "--tail", fmt.Sprint(lines), container.Name).CombinedOutput()
+		if err != nil {
+			fmt.Printf("failed to read logs: %v\n", err)
+			continue
+		}
+		fmt.Print(string(output))
+	}
+}
+
+// containerServices returns the sorted service names of containers, for messages
+func containerServices(containers []ComposeContainer) string {
+	services := []string{}
+	for _, container := range containers {
+		if !containsString(services, container.Service) {
+			services = append(services, container.Service)
+		}
+	}
+	sort.Strings(services)
+	return strings.Join(services, ", ")
+}
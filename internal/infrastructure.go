@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// infrastructureTimeout bounds the wait for an infrastructure module that is starting
+const infrastructureTimeout = 2 * time.Minute
+
+// infrastructureLogLines is the number of log lines shown for unhealthy infrastructure
+const infrastructureLogLines = 20
+
+// requiredInfrastructure returns the infrastructure templates a template requires, directly or
+// through other infrastructure, dependencies first
+func requiredInfrastructure(config shared.Configuration, templateName string) ([]string, error) {
+	order := []string{}
+	visiting := make(map[string]bool)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		resolved, err := ResolveTemplate(config, name)
+		if err != nil {
+			return err
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+
+		for _, required := range resolved.Requires {
+			if visiting[required] {
+				return fmt.Errorf("infrastructure requirement cycle: %s", strings.Join(append(path, name, required), " -> "))
+			}
+			if containsString(order, required) {
+				continue
+			}
+			dependency, err := ResolveTemplate(config, required)
+			if err != nil {
+				return fmt.Errorf("template %s requires %s: %v", name, required, err)
+			}
+			if !dependency.Infrastructure {
+				return fmt.Errorf("template %s requires %s which is not an infrastructure template", name, required)
+			}
+			if err := visit(required, append(path, name)); err != nil {
+				return err
+			}
+			order = append(order, required)
+		}
+		return nil
+	}
+
+	if err := visit(templateName, nil); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// infrastructureModules returns the docked modules created from a template
+func infrastructureModules(config shared.Configuration, templateName string) ([]string, error) {
+	names, err := ListModuleNames(config)
+	if err != nil {
+		return nil, err
+	}
+	modules := []string{}
+	for _, name := range names {
+		if metadata, err := LoadModuleMetadata(config, name); err == nil && metadata.Template == templateName {
+			modules = append(modules, name)
+		}
+	}
+	return modules, nil
+}
+
+// bootstrapModuleName names the module created for an infrastructure template
+func bootstrapModuleName(templateName string) string {
+	name := templateName[strings.LastIndex(templateName, "/")+1:]
+	if at := strings.Index(name, "@"); at >= 0 {
+		name = name[:at]
+	}
+	return name
+}
+
+// infrastructureState returns the containers of an infrastructure module that are not ready
+// yet and those that failed, without waiting
+func infrastructureState(module string) (pending, failing []ComposeContainer, err error) {
+	containers, err := ProjectContainers(module)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(containers) == 0 {
+		return nil, nil, fmt.Errorf("%s has no containers, start it with -command=dock -container=%s", module, module)
+	}
+	for _, container := range containers {
+		switch health := containerHealth(container); {
+		case health == HealthUnhealthy || health == HealthStopped:
+			failing = append(failing, container)
+		case !healthReady(health):
+			pending = append(pending, container)
+		}
+	}
+	return pending, failing, nil
+}
+
+// checkInfrastructureModule waits for an infrastructure module that is starting and returns
+// an error, after printing its last logs, when it is stopped or unhealthy
+func checkInfrastructureModule(module string) error {
+	pending, failing, err := infrastructureState(module)
+	if err != nil {
+		return err
+	}
+	if len(failing) > 0 {
+		printContainerLogs(failing, infrastructureLogLines)
+		return fmt.Errorf("services of %s are not healthy: %s", module, containerServices(failing))
+	}
+	if len(pending) > 0 {
+		return WaitHealthy(module, infrastructureTimeout, infrastructureLogLines)
+	}
+	return nil
+}
+
+// EnsureInfrastructure makes sure the infrastructure a template requires is docked and
+// healthy. Missing infrastructure is bootstrapped as a module named after its template;
+// infrastructure that exists but is unhealthy makes docking the dependent module fail.
+func EnsureInfrastructure(config shared.Configuration, templateName string) error {
+	if templateName == "" {
+		return nil
+	}
+	required, err := requiredInfrastructure(config, templateName)
+	if err != nil {
+		return err
+	}
+
+	for _, infrastructure := range required {
+		modules, err := infrastructureModules(config, infrastructure)
+		if err != nil {
+			return err
+		}
+
+		if len(modules) == 0 {
+			name := bootstrapModuleName(infrastructure)
+			if _, err := os.Stat(filepath.Join(config.ComposeDir, name)); err == nil {
+				return fmt.Errorf("infrastructure %s is required but module %s exists and was not docked from it", infrastructure, name)
+			}
+			log.Printf("Bootstrapping infrastructure %s as module %s", infrastructure, name)
+			fmt.Printf("Template %s requires %s, bootstrapping it as module %s\n", templateName, infrastructure, name)
+			if err := dockContainer(config, name, infrastructure, nil, DockFailureRollback); err != nil {
+				return fmt.Errorf("failed to bootstrap infrastructure %s: %v", infrastructure, err)
+			}
+			if err := WaitHealthy(name, infrastructureTimeout, infrastructureLogLines); err != nil {
+				return fmt.Errorf("infrastructure %s did not become healthy: %v", infrastructure, err)
+			}
+			continue
+		}
+
+		problems := []string{}
+		healthy := false
+		for _, module := range modules {
+			if err := checkInfrastructureModule(module); err != nil {
+				problems = append(problems, err.Error())
+				continue
+			}
+			healthy = true
+			break
+		}
+		if !healthy {
+			return fmt.Errorf("required infrastructure %s is unhealthy, refusing to dock: %s", infrastructure, strings.Join(problems, "; "))
+		}
+		log.Printf("Required infrastructure %s is healthy", infrastructure)
+	}
+	return nil
+}
+
+// planInfrastructure records the infrastructure a dock would bootstrap and warns about
+// required infrastructure that would make it fail
+func (p *Plan) planInfrastructure(config shared.Configuration, templateName string) {
+	if templateName == "" {
+		return
+	}
+	required, err := requiredInfrastructure(config, templateName)
+	if err != nil {
+		p.warn("infrastructure requirements: %v", err)
+		return
+	}
+
+	for _, infrastructure := range required {
+		modules, err := infrastructureModules(config, infrastructure)
+		if err != nil {
+			p.warn("infrastructure requirements: %v", err)
+			return
+		}
+		if len(modules) == 0 {
+			p.action("bootstrap-module", bootstrapModuleName(infrastructure), "infrastructure template "+infrastructure)
+			continue
+		}
+
+		problems := []string{}
+		for _, module := range modules {
+			_, failing, err := infrastructureState(module)
+			if err == nil && len(failing) == 0 {
+				problems = nil
+				break
+			}
+			if err == nil {
+				err = fmt.Errorf("services of %s are not healthy: %s", module, containerServices(failing))
+			}
+			problems = append(problems, err.Error())
+		}
+		if len(problems) > 0 {
+			p.warn("required infrastructure %s is unhealthy, dock would be refused: %s", infrastructure, strings.Join(problems, "; "))
+		}
+	}
+}
+
+// moduleTemplate returns the template of a docked module, or templateName for a new one
+func moduleTemplate(config shared.Configuration, moduleName, templateName string) string {
+	if metadata, err := LoadModuleMetadata(config, moduleName); err == nil && metadata.Template != "" {
+		return metadata.Template
+	}
+	return templateName
+}
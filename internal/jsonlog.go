@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"strings"
+)
+
+// jsonLog appends values to a file, one JSON per line. A log with a limit keeps only its
+// last limit lines; it is rewritten once it grows a tenth over the limit.
+type jsonLog struct {
+	path  string
+	limit int
+	mode  os.FileMode
+	count int
+}
+
+// openJSONLog counts the lines already in a log, 0 for a missing file. A missing log is
+// created with the given mode. An unbounded log is not read, since its count is never used.
+func openJSONLog(path string, limit int, mode os.FileMode) (*jsonLog, error) {
+	if limit == 0 {
+		return &jsonLog{path: path, mode: mode}, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return &jsonLog{path: path, limit: limit, mode: mode, count: strings.Count(string(content), "\n")}, nil
+}
+
+// append writes a value at the end of the log
+func (l *jsonLog) append(value interface{}) error {
+	line, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, l.mode)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	l.count++
+	if l.limit == 0 || l.count <= l.limit+l.limit/10 {
+		return nil
+	}
+	content, err := os.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) > l.limit {
+		lines = lines[len(lines)-l.limit:]
+	}
+	if err := os.WriteFile(l.path+".tmp", []byte(strings.Join(lines, "")+"\n"), l.mode); err != nil {
+		return err
+	}
+	if err := os.Rename(l.path+".tmp", l.path); err != nil {
+		return err
+	}
+	l.count = len(lines)
+	return nil
+}
+
+// readJSONLog passes every line of a log to decode, oldest first. A missing log is empty.
+func readJSONLog(path string, decode func(line []byte)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		decode(scanner.Bytes())
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+// readJSONLogValues returns the values of a log
+func readJSONLogValues(t *testing.T, path string) []int {
+	t.Helper()
+	values := []int{}
+	err := readJSONLog(path, func(line []byte) {
+		var value int
+		if err := json.Unmarshal(line, &value); err == nil {
+			values = append(values, value)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return values
+}
+
+func TestJSONLogLimit(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit int
+		want  int
+	}{
+		{"bounded", 10, 10},
+		{"unbounded", 0, 50},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "log.jsonl")
+			// Reopened for every value, like the audit log of separate operations
+			for i := 0; i < 50; i++ {
+				log, err := openJSONLog(path, test.limit, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := log.append(i); err != nil {
+					t.Fatal(err)
+				}
+			}
+			values := readJSONLogValues(t, path)
+			if len(values) < test.want || len(values) > test.want+test.want/10 {
+				t.Fatalf("log holds %d values, want %d to %d", len(values), test.want, test.want+test.want/10)
+			}
+			if values[len(values)-1] != 49 {
+				t.Errorf("last value = %d, want 49", values[len(values)-1])
+			}
+		})
+	}
+}
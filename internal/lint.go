@@ -0,0 +1,446 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+	"gopkg.in/yaml.v3"
+)
+
+// Lint finding severities
+const (
+	LintError   = "error"
+	LintWarning = "warning"
+	LintInfo    = "info"
+)
+
+// knownComposeKeys lists the top-level keys accepted by the compose specification
+var knownComposeKeys = map[string]bool{
+	"version":  true,
+	"name":     true,
+	"services": true,
+	"networks": true,
+	"volumes":  true,
+	"configs":  true,
+	"secrets":  true,
+	"include":  true,
+}
+
+// composeBuiltinVariables are provided by docker compose and never need to be declared
+var composeBuiltinVariables = map[string]bool{
+	"COMPOSE_PROJECT_NAME": true,
+	"PWD":                  true,
+}
+
+// traefikNamePattern extracts the kind and name of routers, middlewares and services from a label key
+var traefikNamePattern = regexp.MustCompile(`^traefik\.(http|tcp|udp)\.(routers|middlewares|services)\.([^.]+)\.`)
+
+// LintFinding is a single problem reported by the template linter
+type LintFinding struct {
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// linter collects findings for one template
+type linter struct {
+	findings []LintFinding
+}
+
+func (l *linter) report(severity, format string, args ...interface{}) {
+	l.findings = append(l.findings, LintFinding{Severity: severity, Message: fmt.Sprintf(format, args...)})
+}
+
+// LintTemplate checks a template for consistency between its compose file and .env.template,
+// compose structure, image tags, healthchecks, restart policies and Traefik name collisions
+func LintTemplate(config shared.Configuration, templateName string) ([]LintFinding, error) {
+	resolved, err := ResolveTemplate(config, templateName)
+	if err != nil {
+		return nil, err
+	}
+	if err := ApplySnippets(config, resolved, "lint", resolved.Includes); err != nil {
+		return nil, err
+	}
+
+	var compose map[string]interface{}
+	if err := yaml.Unmarshal(resolved.Compose, &compose); err != nil {
+		return nil, fmt.Errorf("failed to parse docker-compose.yml of template %s: %v", templateName, err)
+	}
+
+	l := &linter{}
+	l.lintRouting(resolved, compose)
+	// Decoded again to lint the generated labels as well
+	compose = nil
+	if err := yaml.Unmarshal(resolved.Compose, &compose); err != nil {
+		return nil, fmt.Errorf("failed to parse docker-compose.yml of template %s: %v", templateName, err)
+	}
+	env := ParseEnv(resolved.EnvTemplate)
+
+	l.lintVariables(resolved, env)
+	l.lintPlaceholders(resolved.EnvTemplate)
+	services := l.lintStructure(compose)
+	for _, name := range sortedKeys(services) {
+		service, _ := services[name].(map[string]interface{})
+		l.lintService(name, service, services, env)
+	}
+	l.lintTraefikNames(config, services)
+
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		return severityRank(l.findings[i].Severity) < severityRank(l.findings[j].Severity)
+	})
+	return l.findings, nil
+}
+
+// lintRouting checks the routing declared by the manifests and, when it is valid, generates its
+// labels into the resolved compose file so they are linted with the others. Generated names
+// use the project name, as they are named after each module.
+func (l *linter) lintRouting(resolved *ResolvedTemplate, compose map[string]interface{}) {
+	services, _ := compose["services"].(map[string]interface{})
+	known := make(map[string]bool)
+	for name := range services {
+		known[name] = true
+	}
+
+	problems := validateRoutingSpecs(resolved.Routing, known)
+	for _, problem := range problems {
+		l.report(LintError, "%s", problem)
+	}
+	if len(problems) == 0 {
+		if err := ApplyRouting(resolved, "${COMPOSE_PROJECT_NAME}", resolved.Routing); err != nil {
+			l.report(LintError, "%v", err)
+		}
+	}
+}
+
+// lintVariables checks that every ${VAR} is declared and every declared variable is used
+func (l *linter) lintVariables(resolved *ResolvedTemplate, env map[string]string) {
+	used := composeVariables(string(resolved.Compose))
+	for _, name := range sortedKeys(used) {
+		if _, declared := env[name]; declared || composeBuiltinVariables[name] {
+			continue
+		}
+		if used[name] {
+			l.report(LintInfo, "variable %s is not declared in .env.template, its inline default is used", name)
+		} else {
+			l.report(LintError, "variable %s is used in docker-compose.yml but not declared in .env.template", name)
+		}
+	}
+
+	for _, name := range sortedKeys(env) {
+		if _, ok := used[name]; !ok {
+			l.report(LintWarning, "variable %s is declared in .env.template but never used", name)
+		}
+	}
+}
+
+// lintPlaceholders reports <PLACEHOLDER> values shared by several variables
+func (l *linter) lintPlaceholders(envTemplate string) {
+	users := make(map[string][]string)
+	for _, line := range strings.Split(envTemplate, "\n") {
+		key, ok := envLineKey(line)
+		if !ok {
+			continue
+		}
+		value := strings.TrimSpace(strings.SplitN(line, "=", 2)[1])
+		if strings.HasPrefix(value, "<") && strings.HasSuffix(value, ">") {
+			users[value] = append(users[value], key)
+		}
+	}
+
+	for _, placeholder := range sortedKeys(users) {
+		if len(users[placeholder]) > 1 {
+			l.report(LintInfo, "placeholder %s fills several variables: %s", placeholder, strings.Join(users[placeholder], ", "))
+		}
+	}
+}
+
+// lintStructure validates the top-level layout and returns the services mapping
+func (l *linter) lintStructure(compose map[string]interface{}) map[string]interface{} {
+	for _, key := range sortedKeys(compose) {
+		if !knownComposeKeys[key] && !strings.HasPrefix(key, "x-") {
+			l.report(LintError, "unknown top-level key %q", key)
+		}
+	}
+	if _, ok := compose["version"]; ok {
+		l.report(LintInfo, "top-level version is obsolete and ignored by docker compose")
+	}
+
+	services, ok := compose["services"].(map[string]interface{})
+	if !ok || len(services) == 0 {
+		l.report(LintError, "docker-compose.yml defines no services")
+		return map[string]interface{}{}
+	}
+
+	networks, _ := compose["networks"].(map[string]interface{})
+	volumes, _ := compose["volumes"].(map[string]interface{})
+	for _, name := range sortedKeys(services) {
+		service, ok := services[name].(map[string]interface{})
+		if !ok {
+			l.report(LintError, "service %s is not a mapping", name)
+			continue
+		}
+
+		for _, network := range namesOf(service["networks"]) {
+			if _, declared := networks[network]; !declared && network != "default" {
+				l.report(LintError, "service %s uses network %s which is not declared under networks", name, network)
+			}
+		}
+		for _, volume := range namedVolumes(service["volumes"]) {
+			if _, declared := volumes[volume]; !declared {
+				l.report(LintError, "service %s mounts volume %s which is not declared under volumes", name, volume)
+			}
+		}
+		for _, dependency := range namesOf(service["depends_on"]) {
+			if _, exists := services[dependency]; !exists {
+				l.report(LintError, "service %s depends on unknown service %s", name, dependency)
+			}
+		}
+	}
+	return services
+}
+
+// lintService checks image tags, healthchecks, restart policies and misplaced environment
+func (l *linter) lintService(name string, service map[string]interface{}, services map[string]interface{}, env map[string]string) {
+	image, _ := service["image"].(string)
+	_, hasBuild := service["build"]
+	switch {
+	case image == "" && !hasBuild:
+		l.report(LintError, "service %s has neither image nor build", name)
+	case image != "":
+		resolvedImage := interpolateEnv(image, env)
+		switch {
+		case strings.Contains(resolvedImage, "<"):
+			// The tag is only known once the placeholder is filled in
+		case imageTag(resolvedImage) == "latest":
+			l.report(LintWarning, "service %s uses the latest tag (%s)", name, resolvedImage)
+		case imageTag(resolvedImage) == "":
+			l.report(LintWarning, "service %s has no image tag and implicitly uses latest (%s)", name, resolvedImage)
+		}
+	}
+
+	if healthcheck, ok := service["healthcheck"].(map[string]interface{}); !ok {
+		l.report(LintWarning, "service %s has no healthcheck", name)
+	} else if disabled, _ := healthcheck["disable"].(bool); disabled {
+		l.report(LintInfo, "service %s disables its healthcheck", name)
+	}
+
+	if _, ok := service["restart"]; !ok {
+		l.report(LintWarning, "service %s has no restart policy", name)
+	}
+
+	// Environment prefixed with another service's name most likely belongs to that service
+	for _, key := range environmentKeys(service["environment"]) {
+		for _, other := range sortedKeys(services) {
+			prefix := strings.ToUpper(strings.ReplaceAll(other, "-", "_")) + "_"
+			if other != name && strings.HasPrefix(key, prefix) {
+				l.report(LintWarning, "service %s sets %s which looks like it belongs to service %s", name, key, other)
+			}
+		}
+	}
+}
+
+// lintTraefikNames warns about router and middleware names that collide within the template,
+// between instances of the template or with modules that are already docked
+func (l *linter) lintTraefikNames(config shared.Configuration, services map[string]interface{}) {
+	owners := make(map[string]string)
+	for _, name := range sortedKeys(services) {
+		service, _ := services[name].(map[string]interface{})
+		for _, label := range labelKeys(service["labels"]) {
+			match := traefikNamePattern.FindStringSubmatch(label)
+			if match == nil || match[2] == "services" {
+				continue
+			}
+			key := match[1] + " " + strings.TrimSuffix(match[2], "s") + " " + match[3]
+			if owner, seen := owners[key]; seen && owner != name {
+				l.report(LintError, "%s is defined by both services %s and %s", key, owner, name)
+			}
+			owners[key] = name
+		}
+	}
+
+	docked := dockedTraefikNames(config)
+	for _, key := range sortedKeys(owners) {
+		name := key[strings.LastIndex(key, " ")+1:]
+		if strings.Contains(name, "$") {
+			continue
+		}
+
+		severity := LintWarning
+		if strings.Contains(key, " middleware ") {
+			// Identical middleware definitions are accepted by Traefik
+			severity = LintInfo
+		}
+		l.report(severity, "%s has a fixed name, every module docked from this template defines it", key)
+		if modules := docked[key]; len(modules) > 0 {
+			l.report(severity, "%s is already defined by docked modules: %s", key, strings.Join(modules, ", "))
+		}
+	}
+}
+
+// dockedTraefikNames maps Traefik router and middleware keys to the docked modules defining them
+func dockedTraefikNames(config shared.Configuration) map[string][]string {
+	names := make(map[string][]string)
+	entries, err := os.ReadDir(config.ComposeDir)
+	if err != nil {
+		return names
+	}
+
+	for _, entry := range entries {
+		moduleDir := filepath.Join(config.ComposeDir, entry.Name())
+		content, err := os.ReadFile(filepath.Join(moduleDir, "docker-compose.yml"))
+		if !entry.IsDir() || err != nil {
+			continue
+		}
+		env, _ := ReadEnvFile(filepath.Join(moduleDir, ".env"))
+
+		var compose map[string]interface{}
+		if yaml.Unmarshal(content, &compose) != nil {
+			continue
+		}
+		services, _ := compose["services"].(map[string]interface{})
+		for _, service := range services {
+			serviceMap, _ := service.(map[string]interface{})
+			for _, label := range labelKeys(serviceMap["labels"]) {
+				match := traefikNamePattern.FindStringSubmatch(interpolateEnv(label, env))
+				if match == nil || match[2] == "services" {
+					continue
+				}
+				key := match[1] + " " + strings.TrimSuffix(match[2], "s") + " " + match[3]
+				if !containsString(names[key], entry.Name()) {
+					names[key] = append(names[key], entry.Name())
+				}
+			}
+		}
+	}
+	return names
+}
+
+// PrintLintFindings prints lint findings and returns the number of errors
+func PrintLintFindings(templateName string, findings []LintFinding) int {
+	errors := 0
+	if len(findings) == 0 {
+		fmt.Printf("✅ %s: no problems found\n", templateName)
+		return 0
+	}
+
+	fmt.Printf("%s:\n", templateName)
+	for _, finding := range findings {
+		if finding.Severity == LintError {
+			errors++
+		}
+		fmt.Printf("  %-7s %s\n", strings.ToUpper(finding.Severity), finding.Message)
+	}
+	return errors
+}
+
+// severityRank orders findings from most to least severe
+func severityRank(severity string) int {
+	switch severity {
+	case LintError:
+		return 0
+	case LintWarning:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// imageTag returns the tag of an image reference, or "" when it has none
+func imageTag(image string) string {
+	if strings.Contains(image, "@") {
+		return "digest"
+	}
+	name := image[strings.LastIndex(image, "/")+1:]
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// namesOf returns the names used in a list or mapping form compose attribute
+func namesOf(value interface{}) []string {
+	names := []string{}
+	switch typed := value.(type) {
+	case []interface{}:
+		for _, item := range typed {
+			if name, ok := item.(string); ok {
+				names = append(names, name)
+			}
+		}
+	case map[string]interface{}:
+		names = append(names, sortedKeys(typed)...)
+	}
+	return names
+}
+
+// namedVolumes returns the named volumes (not bind mounts) mounted by a service
+func namedVolumes(value interface{}) []string {
+	volumes := []string{}
+	items, _ := value.([]interface{})
+	for _, item := range items {
+		source := ""
+		switch typed := item.(type) {
+		case string:
+			source = strings.SplitN(typed, ":", 2)[0]
+			if !strings.Contains(typed, ":") {
+				// Anonymous volume
+				continue
+			}
+		case map[string]interface{}:
+			if kind, _ := typed["type"].(string); kind != "volume" {
+				continue
+			}
+			source, _ = typed["source"].(string)
+		}
+		if source == "" || strings.HasPrefix(source, ".") || strings.HasPrefix(source, "/") || strings.HasPrefix(source, "~") || strings.Contains(source, "$") {
+			continue
+		}
+		volumes = append(volumes, source)
+	}
+	return volumes
+}
+
+// environmentKeys returns the variable names set by a list or mapping form environment
+func environmentKeys(value interface{}) []string {
+	keys := []string{}
+	switch typed := value.(type) {
+	case []interface{}:
+		for _, item := range typed {
+			if entry, ok := item.(string); ok {
+				keys = append(keys, sequenceItemName(entry))
+			}
+		}
+	case map[string]interface{}:
+		keys = append(keys, sortedKeys(typed)...)
+	}
+	return keys
+}
+
+// labelKeys returns the keys of a list or mapping form labels attribute
+func labelKeys(value interface{}) []string {
+	return environmentKeys(value)
+}
+
+// sortedKeys returns the keys of a map in sorted order
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, item := range values {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// lintFixture writes a template named test with the given compose file and .env.template
+// and returns a configuration holding it
+func lintFixture(t *testing.T, compose, envTemplate string) shared.Configuration {
+	t.Helper()
+	config := shared.Configuration{TemplatesDir: t.TempDir(), ComposeDir: t.TempDir()}
+	dir := filepath.Join(config.TemplatesDir, "test")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(compose), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".env.template"), []byte(envTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+// cleanService is a service the linter has nothing to say about
+const cleanService = `    image: nginx:1.25
+    restart: unless-stopped
+    healthcheck:
+      test: ["CMD", "true"]
+`
+
+func TestLintTemplate(t *testing.T) {
+	tests := []struct {
+		name        string
+		compose     string
+		envTemplate string
+		docked      string
+		want        []LintFinding
+	}{
+		{
+			name:    "clean",
+			compose: "services:\n  web:\n" + cleanService,
+		},
+		{
+			name:        "undeclared variable",
+			compose:     "services:\n  web:\n" + cleanService + "    environment:\n      - HOST=${DOMAIN}\n",
+			envTemplate: "",
+			want:        []LintFinding{{LintError, "variable DOMAIN is used in docker-compose.yml but not declared in .env.template"}},
+		},
+		{
+			name:        "inline default",
+			compose:     "services:\n  web:\n" + cleanService + "    environment:\n      - HOST=${DOMAIN:-localhost}\n",
+			envTemplate: "",
+			want:        []LintFinding{{LintInfo, "variable DOMAIN is not declared in .env.template, its inline default is used"}},
+		},
+		{
+			name:        "unused variable",
+			compose:     "services:\n  web:\n" + cleanService,
+			envTemplate: "UNUSED=1\n",
+			want:        []LintFinding{{LintWarning, "variable UNUSED is declared in .env.template but never used"}},
+		},
+		{
+			name:    "latest tag",
+			compose: "services:\n  web:\n" + strings.Replace(cleanService, "nginx:1.25", "nginx:latest", 1),
+			want:    []LintFinding{{LintWarning, "service web uses the latest tag (nginx:latest)"}},
+		},
+		{
+			name:    "implicit latest tag",
+			compose: "services:\n  web:\n" + strings.Replace(cleanService, "nginx:1.25", "nginx", 1),
+			want:    []LintFinding{{LintWarning, "service web has no image tag and implicitly uses latest (nginx)"}},
+		},
+		{
+			name:    "missing healthcheck",
+			compose: "services:\n  web:\n    image: nginx:1.25\n    restart: unless-stopped\n",
+			want:    []LintFinding{{LintWarning, "service web has no healthcheck"}},
+		},
+		{
+			name: "router collision between services",
+			compose: "services:\n  web:\n" + cleanService + "    labels:\n      - traefik.http.routers.${PROJECT_NAME}.rule=Host(`a.com`)\n" +
+				"  api:\n" + cleanService + "    labels:\n      - traefik.http.routers.${PROJECT_NAME}.rule=Host(`b.com`)\n",
+			envTemplate: "PROJECT_NAME=<NAME>\n",
+			want:        []LintFinding{{LintError, "http router ${PROJECT_NAME} is defined by both services api and web"}},
+		},
+		{
+			name:    "fixed router name",
+			compose: "services:\n  web:\n" + cleanService + "    labels:\n      - traefik.http.routers.dashboard.rule=Host(`a.com`)\n",
+			docked:  "services:\n  proxy:\n    image: traefik:v2.11\n    labels:\n      - traefik.http.routers.dashboard.rule=Host(`b.com`)\n",
+			want: []LintFinding{
+				{LintWarning, "http router dashboard has a fixed name, every module docked from this template defines it"},
+				{LintWarning, "http router dashboard is already defined by docked modules: proxy"},
+			},
+		},
+		{
+			name:    "undeclared volume",
+			compose: "services:\n  web:\n" + cleanService + "    volumes:\n      - data:/data\n",
+			want:    []LintFinding{{LintError, "service web mounts volume data which is not declared under volumes"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := lintFixture(t, test.compose, test.envTemplate)
+			if test.docked != "" {
+				dir := filepath.Join(config.ComposeDir, "proxy")
+				if err := os.MkdirAll(dir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, "docker-compose.yml"), []byte(test.docked), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			findings, err := LintTemplate(config, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(findings) != len(test.want) {
+				t.Fatalf("findings = %v, want %v", findings, test.want)
+			}
+			for i, want := range test.want {
+				if findings[i] != want {
+					t.Errorf("finding %d = %v, want %v", i, findings[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestShippedTemplatesLintWithoutErrors(t *testing.T) {
+	config := shared.Configuration{TemplatesDir: filepath.Join("..", "templates"), SnippetsDir: filepath.Join("..", "snippets"), ComposeDir: t.TempDir()}
+	entries, err := os.ReadDir(config.TemplatesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	linted := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		findings, err := LintTemplate(config, entry.Name())
+		if err != nil {
+			t.Errorf("template %s: %v", entry.Name(), err)
+			continue
+		}
+		for _, finding := range findings {
+			if finding.Severity == LintError {
+				t.Errorf("template %s: %s", entry.Name(), finding.Message)
+			}
+		}
+		linted++
+	}
+	if linted == 0 {
+		t.Errorf("no template found in %s", config.TemplatesDir)
+	}
+}
@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// lockDirName is the directory of the compose dir holding the lock files
+const lockDirName = ".locks"
+
+// globalLockName guards changes shared by every module: networks and Traefik
+const globalLockName = "global"
+
+// lockPollInterval is how often a held lock is tried again while waiting
+const lockPollInterval = 250 * time.Millisecond
+
+// LockInfo describes the holder of a lock, as written in the lock file
+type LockInfo struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	User      string    `json:"user"`
+	Operation string    `json:"operation"`
+	Since     time.Time `json:"since"`
+}
+
+func (info LockInfo) String() string {
+	return fmt.Sprintf("%s by %s@%s (pid %d) since %s", info.Operation, info.User, info.Host, info.PID, info.Since.Format(time.RFC3339))
+}
+
+// LockError is returned when a lock is still held after the lock timeout
+type LockError struct {
+	Name   string
+	Holder *LockInfo
+}
+
+func (e *LockError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("%s is locked", e.Name)
+	}
+	return fmt.Sprintf("%s is locked: %s", e.Name, e.Holder)
+}
+
+// Lock is an advisory lock held on a lock file. It is released by Unlock, or by the
+// system when the process exits, so crashed holders never leave a lock behind.
+type Lock struct {
+	name string
+	file *os.File
+}
+
+// LockModule takes the lock of a module for a mutating operation, waiting up to the
+// configured lock timeout while another operation holds it
+func LockModule(config shared.Configuration, moduleName, operation string) (*Lock, error) {
+	return acquireLock(config, "module-"+moduleName, "module "+moduleName, operation)
+}
+
+// LockGlobal takes the lock guarding networks and Traefik, shared by every module. It is
+// always taken after module locks, never before, so that operations cannot deadlock.
+func LockGlobal(config shared.Configuration, operation string) (*Lock, error) {
+	return acquireLock(config, globalLockName, "networks and Traefik", operation)
+}
+
+// acquireLock tries a lock until it is free or the timeout expires
+func acquireLock(config shared.Configuration, fileName, name, operation string) (*Lock, error) {
+	lockDir := filepath.Join(config.ComposeDir, lockDirName)
+	if err := os.MkdirAll(lockDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create lock directory: %v", err)
+	}
+	path := filepath.Join(lockDir, fileName+".lock")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+
+	deadline := time.Now().Add(config.LockTimeout)
+	waiting := false
+	for {
+		locked, err := tryLockFile(file)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to lock %s: %v", name, err)
+		}
+		if locked {
+			break
+		}
+
+		holder := readLockInfo(path)
+		if time.Now().After(deadline) {
+			file.Close()
+			return nil, &LockError{Name: name, Holder: holder}
+		}
+		if !waiting {
+			waiting = true
+			message := fmt.Sprintf("Waiting up to %s for %s", config.LockTimeout, name)
+			if holder != nil {
+				message += ", held for " + holder.String()
+			}
+			log.Print(message)
+		}
+		time.Sleep(lockPollInterval)
+	}
+
+	// Holder info left by a process that exited without unlocking
+	if previous := readLockInfo(path); previous != nil {
+		log.Printf("Taking over stale lock of %s left by %s", name, previous)
+	}
+	if err := writeLockInfo(file, operation); err != nil {
+		unlockFile(file)
+		file.Close()
+		return nil, err
+	}
+	return &Lock{name: name, file: file}, nil
+}
+
+// Unlock clears the holder info and releases the lock
+func (l *Lock) Unlock() {
+	if l == nil || l.file == nil {
+		return
+	}
+	l.file.Truncate(0)
+	unlockFile(l.file)
+	l.file.Close()
+	l.file = nil
+}
+
+// writeLockInfo records the current process as holder of a locked file
+func writeLockInfo(file *os.File, operation string) error {
+	host, _ := os.Hostname()
+	username := "unknown"
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+	content, err := json.Marshal(LockInfo{PID: os.Getpid(), Host: host, User: username, Operation: operation, Since: time.Now()})
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to write lock holder: %v", err)
+	}
+	if _, err := file.WriteAt(content, 0); err != nil {
+		return fmt.Errorf("failed to write lock holder: %v", err)
+	}
+	return nil
+}
+
+// readLockInfo returns the holder recorded in a lock file, nil when there is none
+func readLockInfo(path string) *LockInfo {
+	content, err := os.ReadFile(path)
+	if err != nil || len(strings.TrimSpace(string(content))) == 0 {
+		return nil
+	}
+	var info LockInfo
+	if json.Unmarshal(content, &info) != nil {
+		return nil
+	}
+	return &info
+}
+
+// HeldLock is a lock currently held, for the locks command
+type HeldLock struct {
+	Name   string
+	Holder *LockInfo
+}
+
+// ListLocks returns the locks currently held and their holders
+func ListLocks(config shared.Configuration) ([]HeldLock, error) {
+	entries, err := os.ReadDir(filepath.Join(config.ComposeDir, lockDirName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	held := []HeldLock{}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".lock") {
+			continue
+		}
+		path := filepath.Join(config.ComposeDir, lockDirName, entry.Name())
+		file, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			continue
+		}
+		free, err := tryLockFile(file)
+		if free {
+			unlockFile(file)
+		}
+		file.Close()
+		if err != nil || free {
+			continue
+		}
+		held = append(held, HeldLock{Name: strings.TrimSuffix(entry.Name(), ".lock"), Holder: readLockInfo(path)})
+	}
+	return held, nil
+}
+
+// PrintLocks prints the locks currently held
+func PrintLocks(config shared.Configuration) error {
+	held, err := ListLocks(config)
+	if err != nil {
+		return err
+	}
+	if len(held) == 0 {
+		fmt.Println("No lock is held")
+		return nil
+	}
+	for _, lock := range held {
+		holder := "unknown holder"
+		if lock.Holder != nil {
+			holder = lock.Holder.String()
+		}
+		fmt.Printf("%-30s %s\n", lock.Name, holder)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !unix
+
+package internal
+
+import "os"
+
+// tryLockFile always succeeds where flock is not available: locking is advisory only
+func tryLockFile(file *os.File) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(file *os.File) {}
@@ -0,0 +1,246 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	utils "github.com/FrancescoCorbosiero/go-docker-manager/pkg/utils"
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+	"gopkg.in/yaml.v3"
+)
+
+// moduleFileNames lists the files managed in a module directory, in write order
+var moduleFileNames = []string{"docker-compose.yml", ".env", ModuleMetadataFile}
+
+// RenderedModule holds the content of every managed file of a module
+type RenderedModule struct {
+	Name  string
+	Files map[string]string
+}
+
+// renderNewModule renders the files of a module docked from a template. Placeholder values
+// are read from input, a nil input keeps the placeholders as they are.
+func renderNewModule(config shared.Configuration, moduleName, templateName string, snippets []shared.SnippetRef, input io.Reader) (*RenderedModule, error) {
+	resolved, err := ResolveTemplate(config, templateName)
+	if err != nil {
+		return nil, err
+	}
+	if len(resolved.Chain) > 1 {
+		log.Printf("Template %s resolved through %s", templateName, strings.Join(resolved.Chain, " -> "))
+	}
+
+	// Render the snippets included by the template and requested for this module
+	if err := ApplySnippets(config, resolved, moduleName, mergeSnippetRefs(resolved.Includes, snippets)); err != nil {
+		return nil, err
+	}
+	if err := ApplyRouting(resolved, moduleName, resolved.Routing); err != nil {
+		return nil, err
+	}
+
+	values := utils.ProcessEnvTemplateFrom(resolved.EnvTemplate, input)
+	metadata, err := yaml.Marshal(shared.ModuleMetadata{Template: templateName, Snippets: snippets})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode module metadata: %v", err)
+	}
+
+	module := &RenderedModule{
+		Name: moduleName,
+		Files: map[string]string{
+			"docker-compose.yml": string(resolved.Compose),
+			".env":               renderEnvFile(resolved.EnvTemplate, values),
+			ModuleMetadataFile:   string(metadata),
+		},
+	}
+	if err := checkRenderedRoutes(config, module, values); err != nil {
+		return nil, err
+	}
+	return module, nil
+}
+
+// renderUpgradedModule re-renders a module from the current version of its template,
+// keeping the values of its .env and asking only for newly introduced placeholders
+func renderUpgradedModule(config shared.Configuration, moduleName string, input io.Reader) (*RenderedModule, error) {
+	moduleDir := filepath.Join(config.ComposeDir, moduleName)
+	metadata, err := LoadModuleMetadata(config, moduleName)
+	if err != nil {
+		return nil, fmt.Errorf("module %s has no readable %s, it cannot be upgraded: %v", moduleName, ModuleMetadataFile, err)
+	}
+
+	current, err := readModuleFiles(moduleDir)
+	if err != nil {
+		return nil, err
+	}
+	currentEnv := ParseEnv(current.Files[".env"])
+
+	resolved, err := ResolveTemplate(config, metadata.Template)
+	if err != nil {
+		return nil, err
+	}
+	if err := ApplySnippets(config, resolved, moduleName, mergeSnippetRefs(resolved.Includes, metadata.Snippets)); err != nil {
+		return nil, err
+	}
+	if err := ApplyRouting(resolved, moduleName, mergeRoutingSpecs(resolved.Routing, metadata.Routing)); err != nil {
+		return nil, err
+	}
+
+	// Only the variables the module does not define yet go through the template defaults
+	newLines := []string{}
+	for _, line := range strings.Split(resolved.EnvTemplate, "\n") {
+		if key, ok := envLineKey(line); ok {
+			if _, exists := currentEnv[key]; !exists {
+				newLines = append(newLines, line)
+			}
+		}
+	}
+	values := utils.ProcessEnvTemplateFrom(strings.Join(newLines, "\n"), input)
+	for key, value := range currentEnv {
+		values[key] = value
+	}
+
+	module := &RenderedModule{
+		Name: moduleName,
+		Files: map[string]string{
+			"docker-compose.yml": string(resolved.Compose),
+			".env":               renderEnvFile(resolved.EnvTemplate, values),
+			ModuleMetadataFile:   current.Files[ModuleMetadataFile],
+		},
+	}
+	if err := checkRenderedRoutes(config, module, values); err != nil {
+		return nil, err
+	}
+	return module, nil
+}
+
+// renderEnvFile writes values into the layout of an env template, keeping its order and
+// comments. Values for keys the template does not declare are appended at the end.
+func renderEnvFile(envTemplate string, values map[string]string) string {
+	lines := []string{}
+	written := make(map[string]bool)
+	for _, line := range splitLines(envTemplate) {
+		if key, ok := envLineKey(line); ok {
+			if value, exists := values[key]; exists {
+				line = key + "=" + value
+			}
+			written[key] = true
+		}
+		lines = append(lines, line)
+	}
+
+	extra := []string{}
+	for key := range values {
+		if !written[key] {
+			extra = append(extra, key)
+		}
+	}
+	sort.Strings(extra)
+	for _, key := range extra {
+		lines = append(lines, key+"="+values[key])
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// setEnvLines updates or appends KEY=VALUE lines in env content, keeping everything else
+func setEnvLines(content string, changes map[string]string) string {
+	lines := splitLines(content)
+	applied := make(map[string]bool)
+	for i, line := range lines {
+		if key, ok := envLineKey(line); ok {
+			if value, exists := changes[key]; exists {
+				lines[i] = key + "=" + value
+				applied[key] = true
+			}
+		}
+	}
+
+	keys := []string{}
+	for key := range changes {
+		if !applied[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, key+"="+changes[key])
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// readModuleFiles reads the managed files present in a module directory
+func readModuleFiles(moduleDir string) (*RenderedModule, error) {
+	module := &RenderedModule{Name: filepath.Base(moduleDir), Files: map[string]string{}}
+	for _, name := range moduleFileNames {
+		content, err := os.ReadFile(filepath.Join(moduleDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		module.Files[name] = string(content)
+	}
+	return module, nil
+}
+
+// writeModuleFiles writes the rendered files into a module directory
+func writeModuleFiles(moduleDir string, module *RenderedModule) error {
+	for _, name := range moduleFileNames {
+		content, exists := module.Files[name]
+		if !exists {
+			continue
+		}
+
+		// The .env file holds credentials
+		mode := os.FileMode(0644)
+		if name == ".env" {
+			mode = 0600
+		}
+		if err := os.WriteFile(filepath.Join(moduleDir, name), []byte(content), mode); err != nil {
+			return fmt.Errorf("failed to write %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// ListModuleNames returns the names of the modules of the compose directory, in order
+func ListModuleNames(config shared.Configuration) ([]string, error) {
+	entries, err := os.ReadDir(config.ComposeDir)
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read compose directory: %v", err)
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		// Hidden directories hold staged modules
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(config.ComposeDir, entry.Name(), "docker-compose.yml")); err != nil {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+// ParseEnvAssignments parses KEY=VALUE arguments into a map
+func ParseEnvAssignments(assignments []string) (map[string]string, error) {
+	changes := make(map[string]string)
+	for _, assignment := range assignments {
+		parts := strings.SplitN(assignment, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid assignment %q, expected KEY=VALUE", assignment)
+		}
+		changes[strings.TrimSpace(parts[0])] = parts[1]
+	}
+	return changes, nil
+}
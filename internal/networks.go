@@ -0,0 +1,369 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+	"gopkg.in/yaml.v3"
+)
+
+// managedNetworkLabel marks the networks created by the tool, the only ones it removes
+const managedNetworkLabel = "go-docker-manager.managed"
+
+// NetworkInfo describes a shared network, its declaration and its users
+type NetworkInfo struct {
+	Name       string   `json:"name"`
+	Declared   bool     `json:"declared"`
+	Exists     bool     `json:"exists"`
+	Managed    bool     `json:"managed"`
+	Driver     string   `json:"driver,omitempty"`
+	Subnet     string   `json:"subnet,omitempty"`
+	Internal   bool     `json:"internal"`
+	Modules    []string `json:"modules"`
+	Containers []string `json:"containers"`
+}
+
+// LoadNetworkSpecs reads the shared networks declared in the networks file
+func LoadNetworkSpecs(config shared.Configuration) ([]shared.NetworkSpec, error) {
+	if config.NetworksFile == "" {
+		return nil, nil
+	}
+	content, err := os.ReadFile(config.NetworksFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read networks file: %v", err)
+	}
+
+	var file struct {
+		Networks []shared.NetworkSpec `yaml:"networks"`
+	}
+	if err := yaml.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse networks file: %v", err)
+	}
+	for i, spec := range file.Networks {
+		if spec.Name == "" {
+			return nil, fmt.Errorf("network #%d of the networks file has no name", i+1)
+		}
+	}
+	return file.Networks, nil
+}
+
+// mergeNetworkSpecs adds the specs of overlay to base, overlay winning for the same name
+func mergeNetworkSpecs(base, overlay []shared.NetworkSpec) []shared.NetworkSpec {
+	merged := append([]shared.NetworkSpec{}, base...)
+	for _, spec := range overlay {
+		replaced := false
+		for i := range merged {
+			if merged[i].Name == spec.Name {
+				merged[i], replaced = spec, true
+			}
+		}
+		if !replaced {
+			merged = append(merged, spec)
+		}
+	}
+	return merged
+}
+
+// moduleNetworkSpecs returns the network declarations visible to a module: those of its
+// template chain, overridden by the networks file
+func moduleNetworkSpecs(config shared.Configuration, moduleName string) ([]shared.NetworkSpec, error) {
+	templateName := ""
+	if metadata, err := LoadModuleMetadata(config, moduleName); err == nil {
+		templateName = metadata.Template
+	}
+	return templateNetworkSpecs(config, templateName)
+}
+
+// templateNetworkSpecs returns the network declarations of a template chain, overridden by
+// the networks file
+func templateNetworkSpecs(config shared.Configuration, templateName string) ([]shared.NetworkSpec, error) {
+	specs := []shared.NetworkSpec{}
+	if templateName != "" {
+		if resolved, err := ResolveTemplate(config, templateName); err == nil {
+			specs = resolved.Networks
+		} else {
+			log.Printf("Network declarations of template %s ignored: %v", templateName, err)
+		}
+	}
+
+	configured, err := LoadNetworkSpecs(config)
+	if err != nil {
+		return nil, err
+	}
+	return mergeNetworkSpecs(specs, configured), nil
+}
+
+// moduleSharedNetworks returns the external networks a module attaches to
+func moduleSharedNetworks(config shared.Configuration, moduleName string) ([]string, error) {
+	module, err := readModuleFiles(filepath.Join(config.ComposeDir, moduleName))
+	if err != nil {
+		return nil, err
+	}
+	networks, err := projectObjects(moduleName, module, "networks")
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse docker-compose.yml of %s: %v", moduleName, err)
+	}
+
+	names := []string{}
+	for _, network := range networks {
+		if network.external {
+			names = append(names, network.name)
+		}
+	}
+	return names, nil
+}
+
+// EnsureModuleNetworks creates the missing shared networks of a module before it starts.
+// Networks that are neither existing nor declared are an error.
+func EnsureModuleNetworks(config shared.Configuration, moduleName string) error {
+	names, err := moduleSharedNetworks(config, moduleName)
+	if err != nil {
+		return err
+	}
+	missing := []string{}
+	for _, name := range names {
+		if !dockerObjectExists("network", name) {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	specs, err := moduleNetworkSpecs(config, moduleName)
+	if err != nil {
+		return err
+	}
+	global, err := LockGlobal(config, "create networks for "+moduleName)
+	if err != nil {
+		return err
+	}
+	defer global.Unlock()
+
+	for _, name := range missing {
+		spec, declared := findNetworkSpec(specs, name)
+		if !declared {
+			return fmt.Errorf("network %s used by %s does not exist and is not declared in %s or the template manifest", name, moduleName, config.NetworksFile)
+		}
+		// Another operation may have created it while waiting for the lock
+		if dockerObjectExists("network", name) {
+			continue
+		}
+		if err := createNetwork(spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findNetworkSpec returns the declaration of a network
+func findNetworkSpec(specs []shared.NetworkSpec, name string) (shared.NetworkSpec, bool) {
+	for _, spec := range specs {
+		if spec.Name == name {
+			return spec, true
+		}
+	}
+	return shared.NetworkSpec{}, false
+}
+
+// createNetwork creates a shared network labelled as managed
+func createNetwork(spec shared.NetworkSpec) error {
+	args := []string{"network", "create", "--label", managedNetworkLabel + "=true"}
+	if spec.Driver != "" {
+		args = append(args, "--driver", spec.Driver)
+	}
+	if spec.Subnet != "" {
+		args = append(args, "--subnet", spec.Subnet)
+	}
+	if spec.Internal {
+		args = append(args, "--internal")
+	}
+	for _, key := range sortedKeys(spec.Labels) {
+		args = append(args, "--label", key+"="+spec.Labels[key])
+	}
+
+	output, err := exec.Command("docker", append(args, spec.Name)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to create network %s: %v, output: %s", spec.Name, err, output)
+	}
+	log.Printf("Created shared network %s", spec.Name)
+	fmt.Printf("Created shared network %s\n", spec.Name)
+	return nil
+}
+
+// ListNetworks returns the declared networks and the shared networks used by modules,
+// with the modules referencing them and the containers attached
+func ListNetworks(config shared.Configuration) ([]NetworkInfo, error) {
+	networks := make(map[string]*NetworkInfo)
+	network := func(name string) *NetworkInfo {
+		if networks[name] == nil {
+			networks[name] = &NetworkInfo{Name: name, Modules: []string{}, Containers: []string{}}
+		}
+		return networks[name]
+	}
+
+	// Declarations of the networks file and of every template manifest
+	specs, err := LoadNetworkSpecs(config)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := ListTemplates(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, template := range templates {
+		manifest, err := LoadTemplateManifest(config, template.Name)
+		if err != nil {
+			return nil, err
+		}
+		specs = mergeNetworkSpecs(manifest.Networks, specs)
+	}
+	for _, spec := range specs {
+		info := network(spec.Name)
+		info.Declared, info.Driver, info.Subnet, info.Internal = true, spec.Driver, spec.Subnet, spec.Internal
+	}
+
+	modules, err := ListModuleNames(config)
+	if err != nil {
+		return nil, err
+	}
+	for _, module := range modules {
+		names, err := moduleSharedNetworks(config, module)
+		if err != nil {
+			log.Printf("Skipping networks of %s: %v", module, err)
+			continue
+		}
+		for _, name := range names {
+			info := network(name)
+			info.Modules = append(info.Modules, module)
+		}
+	}
+
+	managed, _ := managedNetworks()
+	for _, name := range managed {
+		network(name)
+	}
+
+	infos := []NetworkInfo{}
+	for _, name := range sortedKeys(networks) {
+		info := networks[name]
+		inspectNetwork(info)
+		infos = append(infos, *info)
+	}
+	return infos, nil
+}
+
+// inspectNetwork fills the docker state of a network
+func inspectNetwork(info *NetworkInfo) {
+	output, err := exec.Command("docker", "network", "inspect", "--format",
+		`{{.Driver}}	{{range .IPAM.Config}}{{.Subnet}} {{end}}	{{.Internal}}	{{index .Labels "`+managedNetworkLabel+`"}}	{{range .Containers}}{{.Name}} {{end}}`,
+		info.Name).Output()
+	if err != nil {
+		return
+	}
+	fields := strings.Split(strings.TrimSpace(string(output)), "\t")
+	for len(fields) < 5 {
+		fields = append(fields, "")
+	}
+	info.Exists = true
+	info.Driver = fields[0]
+	info.Subnet = strings.TrimSpace(fields[1])
+	info.Internal = fields[2] == "true"
+	info.Managed = fields[3] == "true"
+	info.Containers = strings.Fields(fields[4])
+	sort.Strings(info.Containers)
+}
+
+// managedNetworks lists the networks created by the tool
+func managedNetworks() ([]string, error) {
+	output, err := exec.Command("docker", "network", "ls", "--filter", "label="+managedNetworkLabel+"=true", "--format", "{{.Name}}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %v", err)
+	}
+	return strings.Fields(string(output)), nil
+}
+
+// PrintNetworks prints the shared networks, their state and the modules attached
+func PrintNetworks(config shared.Configuration) error {
+	networks, err := ListNetworks(config)
+	if err != nil {
+		return err
+	}
+	if len(networks) == 0 {
+		fmt.Println("No shared network is declared or used")
+		return nil
+	}
+
+	for _, network := range networks {
+		state := "missing"
+		switch {
+		case network.Managed:
+			state = "managed"
+		case network.Exists:
+			state = "unmanaged"
+		}
+		details := []string{state}
+		if network.Driver != "" {
+			details = append(details, network.Driver)
+		}
+		if network.Subnet != "" {
+			details = append(details, network.Subnet)
+		}
+		if network.Internal {
+			details = append(details, "internal")
+		}
+		if !network.Declared {
+			details = append(details, "undeclared")
+		}
+
+		fmt.Printf("%s (%s)\n", network.Name, strings.Join(details, ", "))
+		modules := "none"
+		if len(network.Modules) > 0 {
+			modules = strings.Join(network.Modules, ", ")
+		}
+		fmt.Printf("  modules:    %s\n", modules)
+		fmt.Printf("  containers: %d\n", len(network.Containers))
+	}
+	return nil
+}
+
+// GCNetworks removes the managed networks that no module uses and no container is attached to
+func GCNetworks(config shared.Configuration) ([]string, error) {
+	global, err := LockGlobal(config, "network gc")
+	if err != nil {
+		return nil, err
+	}
+	defer global.Unlock()
+	return gcNetworks(config)
+}
+
+// gcNetworks is GCNetworks for callers already holding the global lock
+func gcNetworks(config shared.Configuration) ([]string, error) {
+	networks, err := ListNetworks(config)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for _, network := range networks {
+		if !network.Managed || len(network.Modules) > 0 || len(network.Containers) > 0 {
+			continue
+		}
+		output, err := exec.Command("docker", "network", "rm", network.Name).CombinedOutput()
+		if err != nil {
+			return removed, fmt.Errorf("failed to remove network %s: %v, output: %s", network.Name, err, output)
+		}
+		log.Printf("Removed unused shared network %s", network.Name)
+		removed = append(removed, network.Name)
+	}
+	return removed, nil
+}
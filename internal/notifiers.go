@@ -0,0 +1,297 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Notifier types
+const (
+	NotifierSMTP     = "smtp"
+	NotifierWebhook  = "webhook"
+	NotifierSlack    = "slack"
+	NotifierTelegram = "telegram"
+)
+
+// telegramAPI is the base URL of the Telegram bot API
+const telegramAPI = "https://api.telegram.org"
+
+// notifyTimeout bounds the delivery of a notification
+const notifyTimeout = 15 * time.Second
+
+// NotifierSpec declares where alerts are sent. The fields used depend on the type.
+type NotifierSpec struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"`
+	// URL of the webhook and slack notifiers
+	URL string `yaml:"url,omitempty"`
+	// SMTP server, sender and recipients
+	Host     string   `yaml:"host,omitempty"`
+	Port     int      `yaml:"port,omitempty"`
+	Username string   `yaml:"username,omitempty"`
+	Password string   `yaml:"password,omitempty"`
+	From     string   `yaml:"from,omitempty"`
+	To       []string `yaml:"to,omitempty"`
+	// Telegram bot token and chat
+	Token  string `yaml:"token,omitempty"`
+	ChatID string `yaml:"chat_id,omitempty"`
+}
+
+// Notification tells that an alert started firing, or resolved
+type Notification struct {
+	Status string    `json:"status"`
+	Alert  Alert     `json:"alert"`
+	Since  time.Time `json:"since"`
+	Time   time.Time `json:"time"`
+}
+
+// Text returns the notification as one line of text
+func (n Notification) Text() string {
+	text := fmt.Sprintf("[%s] %s: %s", strings.ToUpper(n.Status), n.Alert.Rule, n.Alert.Summary)
+	if n.Status == AlertResolved {
+		return text + fmt.Sprintf(" (after %s)", n.Time.Sub(n.Since).Round(time.Second))
+	}
+	return text + fmt.Sprintf(" (since %s)", n.Since.Local().Format("2006-01-02 15:04"))
+}
+
+// Notifier delivers notifications
+type Notifier interface {
+	Notify(notification Notification) error
+}
+
+// newNotifier returns the notifier of a spec, or an error naming what it lacks
+func newNotifier(spec NotifierSpec) (Notifier, error) {
+	missing := func(field string) error {
+		return fmt.Errorf("notifier %s of type %s needs %s", spec.Name, spec.Type, field)
+	}
+	switch spec.Type {
+	case NotifierWebhook, NotifierSlack:
+		if spec.URL == "" {
+			return nil, missing("a url")
+		}
+		return &webhookNotifier{url: spec.URL, slack: spec.Type == NotifierSlack}, nil
+	case NotifierTelegram:
+		if spec.Token == "" || spec.ChatID == "" {
+			return nil, missing("a token and a chat_id")
+		}
+		return &telegramNotifier{api: telegramAPI, token: spec.Token, chatID: spec.ChatID}, nil
+	case NotifierSMTP:
+		if spec.Host == "" || spec.From == "" || len(spec.To) == 0 {
+			return nil, missing("a host, from and to")
+		}
+		if spec.Port == 0 {
+			spec.Port = 587
+		}
+		return &smtpNotifier{spec: spec}, nil
+	}
+	return nil, fmt.Errorf("notifier %s has unknown type %q, expected %s, %s, %s or %s",
+		spec.Name, spec.Type, NotifierSMTP, NotifierWebhook, NotifierSlack, NotifierTelegram)
+}
+
+// webhookNotifier posts the notification as JSON, or as a Slack message
+type webhookNotifier struct {
+	url   string
+	slack bool
+}
+
+func (n *webhookNotifier) Notify(notification Notification) error {
+	var payload interface{} = notification
+	if n.slack {
+		payload = map[string]string{"text": notification.Text()}
+	}
+	return postJSON(n.url, payload)
+}
+
+// telegramNotifier sends the notification as a message of a Telegram bot
+type telegramNotifier struct {
+	api    string
+	token  string
+	chatID string
+}
+
+func (n *telegramNotifier) Notify(notification Notification) error {
+	return postJSON(n.api+"/bot"+n.token+"/sendMessage", map[string]string{"chat_id": n.chatID, "text": notification.Text()})
+}
+
+// smtpNotifier mails the notification, using STARTTLS when the server offers it
+type smtpNotifier struct {
+	spec NotifierSpec
+	// timeout bounds the whole SMTP session, notifyTimeout when zero
+	timeout time.Duration
+}
+
+// Notify drives the SMTP session by hand rather than with smtp.SendMail, which has no
+// deadline, so that a hung server cannot block the alerts evaluation
+func (n *smtpNotifier) Notify(notification Notification) error {
+	timeout := n.timeout
+	if timeout == 0 {
+		timeout = notifyTimeout
+	}
+	address := net.JoinHostPort(n.spec.Host, fmt.Sprint(n.spec.Port))
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, n.spec.Host)
+	if err != nil {
+		return fmt.Errorf("%s: %v", address, err)
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: n.spec.Host}); err != nil {
+			return fmt.Errorf("%s: STARTTLS failed: %v", address, err)
+		}
+	}
+	if n.spec.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return fmt.Errorf("%s does not support authentication", address)
+		}
+		if err := client.Auth(smtp.PlainAuth("", n.spec.Username, n.spec.Password, n.spec.Host)); err != nil {
+			return fmt.Errorf("%s: authentication failed: %v", address, err)
+		}
+	}
+
+	if err := client.Mail(n.spec.From); err != nil {
+		return err
+	}
+	for _, recipient := range n.spec.To {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(n.message(notification)); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// message renders the mail of a notification
+func (n *smtpNotifier) message(notification Notification) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", n.spec.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(n.spec.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", notification.Text())
+	fmt.Fprintf(&message, "Date: %s\r\n", notification.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&message, "%s\r\n\r\nRule: %s\r\nModule: %s\r\nSince: %s\r\n", notification.Alert.Summary,
+		notification.Alert.Rule, orDash(notification.Alert.Module), notification.Since.Local().Format(time.RFC3339))
+	return message.Bytes()
+}
+
+// postJSON posts a JSON payload and fails on non-2xx answers. Errors name the server only,
+// since the URL path of bots and incoming webhooks holds their token.
+func postJSON(target string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: notifyTimeout}
+	response, err := client.Post(target, "application/json", bytes.NewReader(body))
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("%s: %v", redactURL(target), err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		answer, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+		return fmt.Errorf("%s answered %s: %s", redactURL(target), response.Status, strings.TrimSpace(string(answer)))
+	}
+	return nil
+}
+
+// redactURL returns the scheme and host of a URL, eliding its path, query and credentials
+func redactURL(target string) string {
+	parsed, err := url.Parse(target)
+	if err != nil || parsed.Host == "" {
+		return "notifier URL"
+	}
+	if parsed.Path == "" && parsed.RawQuery == "" {
+		return parsed.Scheme + "://" + parsed.Host
+	}
+	return parsed.Scheme + "://" + parsed.Host + "/..."
+}
+
+// TestNotifiers sends a test alert, firing then resolved, through every notifier redirected
+// to a local webhook stand-in that prints what it receives, so that rules and payloads can
+// be checked without reaching anyone. Mails are posted to the stand-in as their raw text.
+func TestNotifiers(alerts *AlertsConfig, output io.Writer) error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to start the webhook stand-in: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(output, "%s %s\n%s\n\n", r.Method, r.URL.Path, strings.TrimSpace(string(body)))
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+	standIn := "http://" + listener.Addr().String()
+	fmt.Fprintf(output, "Webhook stand-in listening on %s\n\n", standIn)
+
+	since := time.Now().Add(-5 * time.Minute)
+	test := Alert{Key: "test/example", Rule: "test", Module: "example", Summary: "test alert from go-docker-manager"}
+	failures := 0
+	for _, spec := range alerts.Notifiers {
+		notifier, err := newNotifier(spec)
+		if err != nil {
+			return err
+		}
+		switch typed := notifier.(type) {
+		case *webhookNotifier:
+			typed.url = standIn + "/" + spec.Name
+		case *telegramNotifier:
+			typed.api, typed.token = standIn+"/"+spec.Name, "TOKEN"
+		case *smtpNotifier:
+			notifier = &mailStandIn{smtp: typed, url: standIn + "/" + spec.Name}
+		}
+
+		for _, status := range []string{AlertFiring, AlertResolved} {
+			if err := notifier.Notify(Notification{Status: status, Alert: test, Since: since, Time: time.Now()}); err != nil {
+				fmt.Fprintf(output, "Notifier %s failed: %v\n", spec.Name, err)
+				failures++
+			}
+		}
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d test notifications failed", failures)
+	}
+	return nil
+}
+
+// mailStandIn posts the mail an SMTP notifier would send to the webhook stand-in
+type mailStandIn struct {
+	smtp *smtpNotifier
+	url  string
+}
+
+func (n *mailStandIn) Notify(notification Notification) error {
+	client := &http.Client{Timeout: notifyTimeout}
+	response, err := client.Post(n.url, "message/rfc822", bytes.NewReader(n.smtp.message(notification)))
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
@@ -0,0 +1,458 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+	"gopkg.in/yaml.v3"
+)
+
+// Plan describes what a lifecycle command would change, without changing anything
+type Plan struct {
+	Command  string          `json:"command"`
+	Module   string          `json:"module"`
+	Files    []PlannedFile   `json:"files"`
+	Actions  []PlannedAction `json:"actions"`
+	Warnings []string        `json:"warnings,omitempty"`
+}
+
+// PlannedFile is a module file that would be written
+type PlannedFile struct {
+	Path   string `json:"path"`
+	Action string `json:"action"`
+	// Content is the full file for created files, Diff the unified diff for updated ones, both
+	// with the values of credentials redacted
+	Content string `json:"content,omitempty"`
+	Diff    string `json:"diff,omitempty"`
+}
+
+// PlannedAction is a Docker action that would be performed
+type PlannedAction struct {
+	Action string `json:"action"`
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func (p *Plan) action(action, target, detail string) {
+	p.Actions = append(p.Actions, PlannedAction{Action: action, Target: target, Detail: detail})
+}
+
+func (p *Plan) warn(format string, args ...interface{}) {
+	p.Warnings = append(p.Warnings, fmt.Sprintf(format, args...))
+}
+
+// PlanDock plans the dock command: the files a new module would get and the actions of up
+func PlanDock(config shared.Configuration, moduleName, templateName string, snippets []shared.SnippetRef) (*Plan, error) {
+	plan := &Plan{Command: "dock", Module: moduleName}
+	moduleDir := filepath.Join(config.ComposeDir, moduleName)
+
+	current, err := readModuleFiles(moduleDir)
+	if err != nil {
+		return nil, err
+	}
+
+	target := current
+	specs, err := moduleNetworkSpecs(config, moduleName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(moduleDir); os.IsNotExist(err) {
+		target, err = renderNewModule(config, moduleName, templateName, snippets, nil)
+		if err != nil {
+			return nil, err
+		}
+		if specs, err = templateNetworkSpecs(config, templateName); err != nil {
+			return nil, err
+		}
+		if strings.Contains(target.Files[".env"], "=<") {
+			plan.warn("placeholders shown as <NAME> will be prompted for when docking")
+		}
+	} else {
+		plan.warn("module %s already exists, its configuration is used as is", moduleName)
+		if len(snippets) > 0 {
+			plan.warn("snippets are ignored because the module is already configured")
+		}
+	}
+
+	plan.planFiles(moduleDir, current, target)
+	plan.planInfrastructure(config, moduleTemplate(config, moduleName, templateName))
+	plan.planUp(moduleName, current, target, specs, false)
+	return plan, nil
+}
+
+// PlanUpgrade plans the upgrade command: re-rendering the module from its template
+func PlanUpgrade(config shared.Configuration, moduleName string) (*Plan, error) {
+	plan := &Plan{Command: "upgrade", Module: moduleName}
+	moduleDir := filepath.Join(config.ComposeDir, moduleName)
+	if _, err := os.Stat(moduleDir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("module directory for %s does not exist", moduleName)
+	}
+
+	current, err := readModuleFiles(moduleDir)
+	if err != nil {
+		return nil, err
+	}
+	target, err := renderUpgradedModule(config, moduleName, nil)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(target.Files[".env"], "=<") {
+		plan.warn("placeholders shown as <NAME> will be prompted for when upgrading")
+	}
+
+	specs, err := moduleNetworkSpecs(config, moduleName)
+	if err != nil {
+		return nil, err
+	}
+
+	plan.planFiles(moduleDir, current, target)
+	plan.planUp(moduleName, current, target, specs, true)
+	return plan, nil
+}
+
+// PlanSetEnv plans the set-env command: the .env change and the services it recreates
+func PlanSetEnv(config shared.Configuration, moduleName string, changes map[string]string) (*Plan, error) {
+	plan := &Plan{Command: "set-env", Module: moduleName}
+	moduleDir := filepath.Join(config.ComposeDir, moduleName)
+	if _, err := os.Stat(moduleDir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("module directory for %s does not exist", moduleName)
+	}
+
+	current, err := readModuleFiles(moduleDir)
+	if err != nil {
+		return nil, err
+	}
+	target := &RenderedModule{Name: moduleName, Files: map[string]string{}}
+	for name, content := range current.Files {
+		target.Files[name] = content
+	}
+	target.Files[".env"] = setEnvLines(current.Files[".env"], changes)
+
+	plan.planFiles(moduleDir, current, target)
+	if !ProjectRunning(moduleName) {
+		plan.warn("module %s is not running, the change applies on its next start", moduleName)
+		return plan, nil
+	}
+	specs, err := moduleNetworkSpecs(config, moduleName)
+	if err != nil {
+		return nil, err
+	}
+	plan.planUp(moduleName, current, target, specs, false)
+	return plan, nil
+}
+
+// PlanDown plans the down command: containers and project networks that would be removed
+func PlanDown(config shared.Configuration, moduleName string) (*Plan, error) {
+	plan := &Plan{Command: "down", Module: moduleName}
+	moduleDir := filepath.Join(config.ComposeDir, moduleName)
+	if _, err := os.Stat(moduleDir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("module directory for %s does not exist", moduleName)
+	}
+	current, err := readModuleFiles(moduleDir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dockerAvailable() {
+		plan.warn("docker is not reachable, containers cannot be listed")
+	} else {
+		containers, err := ProjectContainers(moduleName)
+		if err != nil {
+			plan.warn("%v", err)
+		}
+		for _, container := range containers {
+			if container.State == "running" {
+				plan.action("stop-container", container.Name, "service "+container.Service)
+			}
+			plan.action("remove-container", container.Name, "service "+container.Service)
+		}
+
+		networks, _ := projectObjects(moduleName, current, "networks")
+		for _, network := range networks {
+			if !network.external && dockerObjectExists("network", network.name) {
+				plan.action("remove-network", network.name, "")
+			}
+		}
+	}
+	plan.action("run", "docker compose -p "+moduleName+" down", "volumes and configuration are kept")
+	return plan, nil
+}
+
+// PlanDestroy plans the destroy command: everything down removes plus volumes and files
+func PlanDestroy(config shared.Configuration, moduleName string) (*Plan, error) {
+	plan, err := PlanDown(config, moduleName)
+	if err != nil {
+		return nil, err
+	}
+	plan.Command = "destroy"
+	plan.Actions = plan.Actions[:len(plan.Actions)-1]
+
+	moduleDir := filepath.Join(config.ComposeDir, moduleName)
+	current, err := readModuleFiles(moduleDir)
+	if err != nil {
+		return nil, err
+	}
+	if dockerAvailable() {
+		for _, volume := range ownedVolumes(moduleName, current) {
+			detail := "empty"
+			if empty, err := volumeEmpty(volume); err != nil {
+				detail = "content unknown"
+			} else if !empty {
+				detail = "contains data, requires -force"
+			}
+			plan.action("remove-volume", volume, detail)
+		}
+	}
+	for _, name := range moduleFileNames {
+		if _, exists := current.Files[name]; exists {
+			plan.Files = append(plan.Files, PlannedFile{Path: filepath.Join(moduleDir, name), Action: "delete"})
+		}
+	}
+	plan.action("remove-directory", moduleDir, "")
+	return plan, nil
+}
+
+// planFiles records the file changes between the current and target module
+func (p *Plan) planFiles(moduleDir string, current, target *RenderedModule) {
+	for _, name := range moduleFileNames {
+		content, exists := target.Files[name]
+		if !exists {
+			continue
+		}
+		path := filepath.Join(moduleDir, name)
+		previous, existed := current.Files[name]
+		// Plans end up in terminals and CI logs, so credentials are redacted
+		switch {
+		case !existed:
+			p.Files = append(p.Files, PlannedFile{Path: path, Action: "create", Content: redactText(content, "")})
+		case previous == content:
+			p.Files = append(p.Files, PlannedFile{Path: path, Action: "unchanged"})
+		default:
+			p.Files = append(p.Files, PlannedFile{Path: path, Action: "update",
+				Diff: unifiedDiff("a/"+name, "b/"+name, redactText(previous, ""), redactText(content, previous))})
+		}
+	}
+}
+
+// planUp records the Docker actions `docker compose up -d` would perform for the target module.
+// Missing external networks declared in specs are created as shared networks.
+func (p *Plan) planUp(project string, current, target *RenderedModule, specs []shared.NetworkSpec, pull bool) {
+	targetEnv := ParseEnv(target.Files[".env"])
+	targetServices, err := interpolatedServices(target.Files["docker-compose.yml"], targetEnv)
+	if err != nil {
+		p.warn("failed to parse docker-compose.yml: %v", err)
+		return
+	}
+	currentServices, _ := interpolatedServices(current.Files["docker-compose.yml"], ParseEnv(current.Files[".env"]))
+
+	if !dockerAvailable() {
+		p.warn("docker is not reachable, actions assume nothing exists yet")
+	}
+
+	networks, _ := projectObjects(project, target, "networks")
+	for _, network := range networks {
+		switch {
+		case dockerObjectExists("network", network.name):
+		case network.external:
+			if _, declared := findNetworkSpec(specs, network.name); declared {
+				p.action("create-network", network.name, "shared network")
+				continue
+			}
+			p.action("missing-network", network.name, "external network must exist before up")
+		default:
+			p.action("create-network", network.name, "")
+		}
+	}
+	volumes, _ := projectObjects(project, target, "volumes")
+	for _, volume := range volumes {
+		if !dockerObjectExists("volume", volume.name) {
+			p.action("create-volume", volume.name, "")
+		}
+	}
+
+	containers, _ := ProjectContainers(project)
+	byService := make(map[string]ComposeContainer)
+	for _, container := range containers {
+		byService[container.Service] = container
+	}
+
+	if pull {
+		p.action("run", "docker compose -p "+project+" pull", "")
+	}
+	for _, name := range sortedKeys(targetServices) {
+		service := targetServices[name]
+		if service.image != "" && (pull || !dockerObjectExists("image", service.image)) {
+			p.action("pull-image", service.image, "service "+name)
+		}
+
+		container, exists := byService[name]
+		switch {
+		case !exists:
+			p.action("create-container", name, "")
+		case currentServices[name].rendered != service.rendered:
+			p.action("recreate-container", container.Name, "service "+name+" configuration changed")
+		case pull:
+			p.action("recreate-container", container.Name, "service "+name+" if its image changed")
+		case container.State != "running":
+			p.action("start-container", container.Name, "service "+name)
+		default:
+			p.action("keep-container", container.Name, "service "+name+" is up to date")
+		}
+	}
+	for _, container := range containers {
+		if _, exists := targetServices[container.Service]; !exists {
+			p.action("orphan-container", container.Name, "service "+container.Service+" is no longer defined and is left running")
+		}
+	}
+
+	p.action("run", "docker compose -p "+project+" up -d", "")
+}
+
+// plannedService is a service of a compose file after env interpolation
+type plannedService struct {
+	image    string
+	rendered string
+}
+
+// interpolatedServices returns every service of a compose file rendered with env
+func interpolatedServices(compose string, env map[string]string) (map[string]plannedService, error) {
+	services := make(map[string]plannedService)
+	if compose == "" {
+		return services, nil
+	}
+
+	root, err := parseComposeNode([]byte(compose))
+	if err != nil {
+		return nil, err
+	}
+	servicesNode := mappingValue(root, "services")
+	for _, name := range mappingKeys(servicesNode) {
+		content, err := encodeComposeNode(mappingValue(servicesNode, name))
+		if err != nil {
+			return nil, err
+		}
+		image := ""
+		if imageNode := mappingValue(mappingValue(servicesNode, name), "image"); imageNode != nil {
+			image = interpolateEnv(imageNode.Value, env)
+		}
+		services[name] = plannedService{image: image, rendered: interpolateEnv(string(content), env)}
+	}
+	return services, nil
+}
+
+// projectObject is a network or volume declared by a compose project
+type projectObject struct {
+	key      string
+	name     string
+	external bool
+}
+
+// projectObjects returns the docker names of the networks or volumes declared in a module
+func projectObjects(project string, module *RenderedModule, kind string) ([]projectObject, error) {
+	root, err := parseComposeNode([]byte(module.Files["docker-compose.yml"]))
+	if err != nil {
+		return nil, err
+	}
+	env := ParseEnv(module.Files[".env"])
+
+	objects := []projectObject{}
+	declared := mappingValue(root, kind)
+	for _, key := range mappingKeys(declared) {
+		var definition struct {
+			Name     string      `yaml:"name"`
+			External interface{} `yaml:"external"`
+		}
+		if node := mappingValue(declared, key); node != nil && node.Kind == yaml.MappingNode {
+			node.Decode(&definition)
+		}
+
+		external := false
+		switch value := definition.External.(type) {
+		case bool:
+			external = value
+		case map[string]interface{}:
+			external = true
+			if name, ok := value["name"].(string); ok {
+				definition.Name = name
+			}
+		}
+
+		name := interpolateEnv(definition.Name, env)
+		switch {
+		case name != "":
+		case external:
+			name = key
+		default:
+			name = project + "_" + key
+		}
+		objects = append(objects, projectObject{key: key, name: name, external: external})
+	}
+	return objects, nil
+}
+
+// ProjectRunning reports whether any container of a module project is running
+func ProjectRunning(project string) bool {
+	containers, err := ProjectContainers(project)
+	if err != nil {
+		return false
+	}
+	for _, container := range containers {
+		if container.State == "running" {
+			return true
+		}
+	}
+	return false
+}
+
+// PrintPlan writes a plan as readable text or, with format "json", as JSON
+func PrintPlan(out io.Writer, plan *Plan, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	fmt.Fprintf(out, "Plan for %s of module %s\n", plan.Command, plan.Module)
+
+	fmt.Fprintln(out, "\nFiles:")
+	if len(plan.Files) == 0 {
+		fmt.Fprintln(out, "  no file changes")
+	}
+	for _, file := range plan.Files {
+		fmt.Fprintf(out, "  %-9s %s\n", file.Action, file.Path)
+		text := file.Content
+		if file.Diff != "" {
+			text = file.Diff
+		}
+		for _, line := range splitLines(text) {
+			fmt.Fprintf(out, "      %s\n", line)
+		}
+	}
+
+	fmt.Fprintln(out, "\nDocker actions:")
+	if len(plan.Actions) == 0 {
+		fmt.Fprintln(out, "  none")
+	}
+	for _, action := range plan.Actions {
+		line := fmt.Sprintf("  %-18s %s", action.Action, action.Target)
+		if action.Detail != "" {
+			line += " (" + action.Detail + ")"
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	if len(plan.Warnings) > 0 {
+		fmt.Fprintln(out, "\nWarnings:")
+		for _, warning := range plan.Warnings {
+			fmt.Fprintf(out, "  ⚠️ %s\n", warning)
+		}
+	}
+
+	fmt.Fprintln(out, "\nDry run: nothing was changed.")
+	return nil
+}
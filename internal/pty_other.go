@@ -0,0 +1,20 @@
+//go:build !linux
+
+package internal
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// openPTY is only implemented on Linux, terminals fall back to plain pipes elsewhere
+func openPTY() (*os.File, *os.File, error) {
+	return nil, nil, errors.New("pseudo terminals are not supported on this platform")
+}
+
+func resizePTY(master *os.File, cols, rows uint16) error {
+	return nil
+}
+
+func attachTerminal(cmd *exec.Cmd) {}
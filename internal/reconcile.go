@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// Desired states of a module, recorded in its module.yml
+const (
+	DesiredRunning = "running"
+	DesiredStopped = "stopped"
+)
+
+// Reconcile actions
+const (
+	ReconcileStart    = "start"
+	ReconcileStop     = "stop"
+	ReconcileRecreate = "recreate"
+)
+
+// ReconcileAction is a change needed to bring a module to its desired state
+type ReconcileAction struct {
+	Module   string   `json:"module"`
+	Action   string   `json:"action"`
+	Services []string `json:"services,omitempty"`
+	Reason   string   `json:"reason"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// desiredState returns the desired state of a module, running unless recorded otherwise
+func desiredState(metadata shared.ModuleMetadata) string {
+	if metadata.DesiredState == DesiredStopped {
+		return DesiredStopped
+	}
+	return DesiredRunning
+}
+
+// recordDesiredState writes the desired state of a module into its metadata
+func recordDesiredState(config shared.Configuration, moduleName, state string) {
+	metadata, err := LoadModuleMetadata(config, moduleName)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to record desired state of %s: %v", moduleName, err)
+		return
+	}
+	if metadata.DesiredState == state {
+		return
+	}
+
+	metadata.DesiredState = state
+	if err := SaveModuleMetadata(config, moduleName, metadata); err != nil {
+		log.Printf("Failed to record desired state of %s: %v", moduleName, err)
+	}
+}
+
+// PlanReconcile compares the desired state of every module with its containers and returns
+// the actions that would converge them, in dependency order
+func PlanReconcile(config shared.Configuration) ([]ReconcileAction, error) {
+	modules, err := ListModuleNames(config)
+	if err != nil {
+		return nil, err
+	}
+	if graph, err := BuildModuleGraph(config); err == nil {
+		if order, err := graph.Order(); err == nil {
+			modules = order
+		}
+	} else {
+		log.Printf("Reconciling without dependency order: %v", err)
+	}
+
+	actions := []ReconcileAction{}
+	for _, module := range modules {
+		metadata, err := LoadModuleMetadata(config, module)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read metadata of %s: %v", module, err)
+		}
+		containers, err := ProjectContainers(module)
+		if err != nil {
+			return nil, err
+		}
+
+		running, stopped, unhealthy := []string{}, []string{}, []string{}
+		for _, container := range containers {
+			switch containerHealth(container) {
+			case HealthStopped:
+				stopped = append(stopped, container.Service)
+			case HealthUnhealthy:
+				unhealthy = append(unhealthy, container.Service)
+				running = append(running, container.Service)
+			case HealthCompleted:
+			default:
+				running = append(running, container.Service)
+			}
+		}
+
+		if desiredState(metadata) == DesiredStopped {
+			if len(running) > 0 {
+				actions = append(actions, ReconcileAction{Module: module, Action: ReconcileStop, Reason: "desired stopped, running: " + strings.Join(running, ", ")})
+			}
+			continue
+		}
+		// Services stopped while others run are taken as stopped on purpose with -service, as the
+		// desired state only covers whole modules
+		if len(stopped) > 0 && len(running) > 0 {
+			log.Printf("Reconcile: %s has stopped services left as they are: %s", module, strings.Join(stopped, ", "))
+		}
+		switch {
+		case len(containers) == 0:
+			actions = append(actions, ReconcileAction{Module: module, Action: ReconcileStart, Reason: "desired running, no containers"})
+		case len(stopped) > 0 && len(running) == 0:
+			actions = append(actions, ReconcileAction{Module: module, Action: ReconcileStart, Reason: "desired running, stopped: " + strings.Join(stopped, ", ")})
+		case len(unhealthy) > 0:
+			actions = append(actions, ReconcileAction{Module: module, Action: ReconcileRecreate, Services: unhealthy, Reason: "unhealthy: " + strings.Join(unhealthy, ", ")})
+		}
+	}
+	return actions, nil
+}
+
+// Reconcile performs the actions converging every module to its desired state and returns
+// them with their outcome. A failing module does not stop the others.
+func Reconcile(config shared.Configuration, timeout time.Duration) ([]ReconcileAction, error) {
+	actions, err := PlanReconcile(config)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range actions {
+		action := &actions[i]
+		log.Printf("Reconcile: %s %s (%s)", action.Action, action.Module, action.Reason)
+
+		entry := AuditEntry{User: CurrentUser(), Source: AuditReconcile, Operation: "reconcile", Module: action.Module,
+			Args: append([]string{action.Action}, action.Services...)}
+		err := Audited(config, entry, func() error {
+			switch action.Action {
+			case ReconcileStart:
+				return dockContainer(config, action.Module, "", nil, DockFailureKeep)
+			case ReconcileStop:
+				return runServices(config, action.Module, "stop", nil)
+			case ReconcileRecreate:
+				return RestartContainer(config, action.Module, RestartRecreate, action.Services, timeout)
+			}
+			return nil
+		})
+		if err != nil {
+			action.Error = err.Error()
+			log.Printf("Reconcile: %s %s failed: %v", action.Action, action.Module, err)
+		}
+	}
+	return actions, nil
+}
+
+// PrintReconcileActions prints reconcile actions, planned ones or performed ones with their
+// outcome, and returns the number that failed
+func PrintReconcileActions(actions []ReconcileAction, planned bool) int {
+	if len(actions) == 0 {
+		fmt.Println("Every module is in its desired state")
+		return 0
+	}
+
+	failures := 0
+	for _, action := range actions {
+		status := "✅"
+		if planned {
+			status = "•"
+		} else if action.Error != "" {
+			status = "❌"
+			failures++
+		}
+		fmt.Printf("%s %-8s %-20s %s\n", status, action.Action, action.Module, action.Reason)
+		if action.Error != "" {
+			fmt.Printf("   %s\n", strings.SplitN(action.Error, "\n", 2)[0])
+		}
+	}
+	return failures
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Restart strategies of RestartContainer
+const (
+	// RestartInPlace restarts the existing containers
+	RestartInPlace = "restart"
+	// RestartRecreate recreates the containers from the current configuration
+	RestartRecreate = "recreate"
+	// RestartRolling starts healthy replacements before removing the old containers
+	RestartRolling = "rolling"
+)
+
+// ValidRestartStrategy reports whether strategy is a known restart strategy
+func ValidRestartStrategy(strategy string) bool {
+	return strategy == RestartInPlace || strategy == RestartRecreate || strategy == RestartRolling
+}
+
+// rollingRestart replaces the containers of services routed by Traefik one service at a
+// time: replacements join the same networks with the same labels, so Traefik balances
+// over old and new containers until the old ones are removed once the new are healthy
+func rollingRestart(moduleDir, project string, services []string, timeout time.Duration) error {
+	defined, err := loadComposeServices(moduleDir)
+	if err != nil {
+		return err
+	}
+
+	if len(services) == 0 {
+		for _, name := range sortedKeys(defined) {
+			if composeLabels(defined[name])["traefik.enable"] == "true" {
+				services = append(services, name)
+			} else {
+				log.Printf("Rolling restart of %s skips service %s, it is not routed by Traefik", project, name)
+			}
+		}
+		if len(services) == 0 {
+			return fmt.Errorf("no service of %s is routed by Traefik, use the recreate strategy", project)
+		}
+	}
+
+	for _, service := range services {
+		if err := rollingReplaceable(service, defined[service]); err != nil {
+			return err
+		}
+	}
+	for _, service := range services {
+		if err := rollService(moduleDir, project, service, timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollingReplaceable checks that a second container of a service can run next to the first
+func rollingReplaceable(name string, service composeService) error {
+	if composeLabels(service)["traefik.enable"] != "true" {
+		return fmt.Errorf("service %s is not routed by Traefik, rolling restarts would not keep it reachable, use the recreate strategy", name)
+	}
+	if _, ok := service["container_name"]; ok {
+		return fmt.Errorf("service %s sets container_name, a replacement cannot run next to it", name)
+	}
+	if ports, ok := service["ports"].([]interface{}); ok {
+		for _, port := range ports {
+			if entry, ok := port.(string); !ok || strings.Contains(entry, ":") {
+				return fmt.Errorf("service %s publishes host ports, a replacement cannot run next to it", name)
+			}
+		}
+	}
+	return nil
+}
+
+// rollService starts replacements for the containers of one service, waits for them to be
+// healthy and removes the old containers. Failing replacements are removed instead.
+func rollService(moduleDir, project, service string, timeout time.Duration) error {
+	old, err := serviceContainers(project, service)
+	if err != nil {
+		return err
+	}
+	if len(old) == 0 {
+		output, err := composeCommand(moduleDir, project, "up", "-d", "--no-deps", service).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to start service %s: %v, output: %s", service, err, output)
+		}
+		return nil
+	}
+
+	fmt.Printf("Starting %d replacement container(s) for %s\n", len(old), service)
+	scale := fmt.Sprintf("%s=%d", service, 2*len(old))
+	output, err := composeCommand(moduleDir, project, "up", "-d", "--no-deps", "--no-recreate", "--scale", scale, service).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to start replacements for %s: %v, output: %s", service, err, output)
+	}
+
+	current, err := serviceContainers(project, service)
+	if err != nil {
+		return err
+	}
+	replacements := make(map[string]bool)
+	for _, name := range current {
+		if !containsString(old, name) {
+			replacements[name] = true
+		}
+	}
+
+	if err := waitContainersHealthy(project, replacements, timeout, 20); err != nil {
+		removeContainers(sortedKeys(replacements))
+		return fmt.Errorf("replacements for %s did not become healthy, old containers kept: %v", service, err)
+	}
+
+	fmt.Printf("Removing %d old container(s) of %s\n", len(old), service)
+	if err := removeContainers(old); err != nil {
+		return err
+	}
+	log.Printf("Rolled service %s of %s", service, project)
+	return nil
+}
+
+// serviceContainers returns the names of the containers of a service
+func serviceContainers(project, service string) ([]string, error) {
+	containers, err := ProjectContainers(project)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, container := range containers {
+		if container.Service == service {
+			names = append(names, container.Name)
+		}
+	}
+	return names, nil
+}
+
+// removeContainers gracefully stops and removes containers
+func removeContainers(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	output, err := exec.Command("docker", append([]string{"stop"}, names...)...).CombinedOutput()
+	if err == nil {
+		output, err = exec.Command("docker", append([]string{"rm"}, names...)...).CombinedOutput()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove containers %s: %v, output: %s", strings.Join(names, ", "), err, output)
+	}
+	return nil
+}
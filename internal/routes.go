@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// traefikAPITimeout bounds the queries to the Traefik API
+const traefikAPITimeout = 5 * time.Second
+
+// hostRulePattern extracts the arguments of the Host() matchers of a router rule
+var hostRulePattern = regexp.MustCompile("Host\\(([^)]*)\\)")
+
+// hostArgumentPattern extracts the quoted hostnames of a Host() matcher
+var hostArgumentPattern = regexp.MustCompile("[`\"]([^`\"]+)[`\"]")
+
+// Route is an HTTP router declared by the labels of a module service
+type Route struct {
+	Module       string   `json:"module"`
+	Service      string   `json:"service"`
+	Router       string   `json:"router"`
+	Rule         string   `json:"rule"`
+	Hosts        []string `json:"hosts"`
+	EntryPoints  []string `json:"entrypoints"`
+	Middlewares  []string `json:"middlewares"`
+	TLS          bool     `json:"tls"`
+	CertResolver string   `json:"certresolver,omitempty"`
+	// Status is the state reported by the Traefik API, empty when it was not queried
+	Status string `json:"status,omitempty"`
+}
+
+// RouteMiddleware is an HTTP middleware defined by the labels of a module service
+type RouteMiddleware struct {
+	Module     string            `json:"module"`
+	Service    string            `json:"service"`
+	Name       string            `json:"name"`
+	Definition map[string]string `json:"definition"`
+}
+
+// RouteReport holds the routers and middlewares of every module and the problems found
+type RouteReport struct {
+	Routes      []Route           `json:"routes"`
+	Middlewares []RouteMiddleware `json:"middlewares"`
+	Findings    []LintFinding     `json:"findings"`
+}
+
+// traefikRouter is a router as returned by the Traefik API
+type traefikRouter struct {
+	Name     string   `json:"name"`
+	Provider string   `json:"provider"`
+	Rule     string   `json:"rule"`
+	Status   string   `json:"status"`
+	Errors   []string `json:"error"`
+}
+
+// ModuleRoutes extracts the HTTP routers and middlewares declared by the Traefik labels of
+// every module, checks them for conflicts and, when traefikAPI is set, compares them with
+// the routers Traefik actually serves
+func ModuleRoutes(config shared.Configuration, traefikAPI string) (*RouteReport, error) {
+	report := &RouteReport{Routes: []Route{}, Middlewares: []RouteMiddleware{}, Findings: []LintFinding{}}
+	modules, err := ListModuleNames(config)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &linter{}
+	for _, module := range modules {
+		routes, middlewares, err := moduleRoutes(config, module)
+		if err != nil {
+			l.report(LintWarning, "routes of %s skipped: %v", module, err)
+			continue
+		}
+		report.Routes = append(report.Routes, routes...)
+		report.Middlewares = append(report.Middlewares, middlewares...)
+	}
+
+	l.lintRoutes(report)
+	if traefikAPI != "" {
+		l.compareActiveRoutes(report, traefikAPI)
+	}
+	report.Findings = append(report.Findings, l.findings...)
+	return report, nil
+}
+
+// moduleRoutes reads the routers and middlewares of one module, with its .env interpolated
+func moduleRoutes(config shared.Configuration, module string) ([]Route, []RouteMiddleware, error) {
+	services, err := loadComposeServices(filepath.Join(config.ComposeDir, module))
+	if err != nil {
+		return nil, nil, err
+	}
+	routes, middlewares := servicesRoutes(module, services, moduleEnv(config, module))
+	return routes, middlewares, nil
+}
+
+// servicesRoutes extracts the routers and middlewares of the services of a module
+func servicesRoutes(module string, services map[string]composeService, env map[string]string) ([]Route, []RouteMiddleware) {
+	if _, set := env["COMPOSE_PROJECT_NAME"]; !set {
+		env["COMPOSE_PROJECT_NAME"] = module
+	}
+
+	routes := []Route{}
+	middlewares := []RouteMiddleware{}
+	for _, service := range sortedKeys(services) {
+		labels := make(map[string]string)
+		for key, value := range composeLabels(services[service]) {
+			labels[interpolateEnv(key, env)] = interpolateEnv(value, env)
+		}
+		// Traefik only reads the labels of enabled containers
+		if labels["traefik.enable"] != "true" {
+			continue
+		}
+
+		routers := make(map[string]*Route)
+		definitions := make(map[string]map[string]string)
+		for _, key := range sortedKeys(labels) {
+			match := traefikNamePattern.FindStringSubmatch(key)
+			if match == nil || match[1] != "http" {
+				continue
+			}
+			option := strings.TrimPrefix(key, match[0])
+			value := labels[key]
+
+			switch match[2] {
+			case "routers":
+				route := routers[match[3]]
+				if route == nil {
+					route = &Route{Module: module, Service: service, Router: match[3], Hosts: []string{}, EntryPoints: []string{}, Middlewares: []string{}}
+					routers[match[3]] = route
+				}
+				switch option {
+				case "rule":
+					route.Rule = value
+					route.Hosts = ruleHosts(value)
+				case "entrypoints":
+					route.EntryPoints = splitList(value)
+				case "middlewares":
+					route.Middlewares = splitList(value)
+				case "tls":
+					route.TLS = value == "true"
+				case "tls.certresolver":
+					route.TLS = true
+					route.CertResolver = value
+				}
+			case "middlewares":
+				if definitions[match[3]] == nil {
+					definitions[match[3]] = make(map[string]string)
+				}
+				definitions[match[3]][option] = value
+			}
+		}
+
+		for _, name := range sortedKeys(routers) {
+			routes = append(routes, *routers[name])
+		}
+		for _, name := range sortedKeys(definitions) {
+			middlewares = append(middlewares, RouteMiddleware{Module: module, Service: service, Name: name, Definition: definitions[name]})
+		}
+	}
+	return routes, middlewares
+}
+
+// ruleHosts returns the hostnames matched by the Host() matchers of a rule
+func ruleHosts(rule string) []string {
+	hosts := []string{}
+	for _, matcher := range hostRulePattern.FindAllStringSubmatch(rule, -1) {
+		for _, host := range hostArgumentPattern.FindAllStringSubmatch(matcher[1], -1) {
+			hosts = append(hosts, strings.ToLower(host[1]))
+		}
+	}
+	return hosts
+}
+
+// splitList splits a comma-separated label value
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// lintRoutes reports duplicate router names, middlewares defined by several modules,
+// undefined middlewares and hostnames served by more than one module
+func (l *linter) lintRoutes(report *RouteReport) {
+	routers := make(map[string][]string)
+	hosts := make(map[string][]string)
+	for _, route := range report.Routes {
+		owner := route.Module + "/" + route.Service
+		if !containsString(routers[route.Router], owner) {
+			routers[route.Router] = append(routers[route.Router], owner)
+		}
+		for _, host := range route.Hosts {
+			if !containsString(hosts[host], route.Module) {
+				hosts[host] = append(hosts[host], route.Module)
+			}
+		}
+	}
+	for _, name := range sortedKeys(routers) {
+		if owners := routers[name]; len(owners) > 1 {
+			l.report(LintError, "router %s is defined by %s, Traefik keeps only one of them", name, strings.Join(owners, ", "))
+		}
+	}
+	for _, host := range sortedKeys(hosts) {
+		if modules := hosts[host]; len(modules) > 1 {
+			l.report(LintError, "host %s is routed by several modules: %s", host, strings.Join(modules, ", "))
+		}
+	}
+
+	definitions := make(map[string][]RouteMiddleware)
+	for _, middleware := range report.Middlewares {
+		definitions[middleware.Name] = append(definitions[middleware.Name], middleware)
+	}
+	for _, name := range sortedKeys(definitions) {
+		defined := definitions[name]
+		if len(defined) < 2 {
+			continue
+		}
+		modules := []string{}
+		identical := true
+		for _, middleware := range defined {
+			if !containsString(modules, middleware.Module) {
+				modules = append(modules, middleware.Module)
+			}
+			identical = identical && sameDefinition(middleware.Definition, defined[0].Definition)
+		}
+		if identical {
+			l.report(LintInfo, "middleware %s is defined identically by %s", name, strings.Join(modules, ", "))
+		} else {
+			l.report(LintError, "middleware %s is defined differently by %s, Traefik disables it", name, strings.Join(modules, ", "))
+		}
+	}
+
+	for _, route := range report.Routes {
+		if route.Rule == "" {
+			l.report(LintError, "router %s of %s has no rule", route.Router, route.Module)
+		}
+		for _, middleware := range route.Middlewares {
+			name, provider, scoped := strings.Cut(middleware, "@")
+			if scoped && provider != "docker" {
+				continue
+			}
+			if len(definitions[name]) == 0 {
+				l.report(LintError, "router %s of %s uses middleware %s which no module defines", route.Router, route.Module, name)
+			}
+		}
+	}
+}
+
+// sameDefinition reports whether two middleware definitions set the same options
+func sameDefinition(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if other, set := b[key]; !set || other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// compareActiveRoutes fills the status of the routes from the Traefik API and reports
+// configured routers that are not active and active routers no module declares
+func (l *linter) compareActiveRoutes(report *RouteReport, traefikAPI string) {
+	active, err := traefikRouters(traefikAPI)
+	if err != nil {
+		l.report(LintWarning, "active routers not compared: %v", err)
+		return
+	}
+
+	byName := make(map[string]traefikRouter)
+	for _, router := range active {
+		if router.Provider == "docker" {
+			byName[strings.TrimSuffix(router.Name, "@docker")] = router
+		}
+	}
+	for i := range report.Routes {
+		route := &report.Routes[i]
+		router, found := byName[route.Router]
+		if !found {
+			route.Status = "missing"
+			l.report(LintWarning, "router %s of %s is not served by Traefik, check that the module is running and attached to the Traefik network", route.Router, route.Module)
+			continue
+		}
+		route.Status = router.Status
+		if router.Status != "enabled" {
+			l.report(LintError, "router %s of %s is %s in Traefik: %s", route.Router, route.Module, router.Status, strings.Join(router.Errors, "; "))
+		}
+		if router.Rule != route.Rule {
+			l.report(LintWarning, "router %s of %s is served with rule %s instead of %s, recreate the module to apply its labels", route.Router, route.Module, router.Rule, route.Rule)
+		}
+	}
+
+	for _, name := range sortedKeys(byName) {
+		declared := false
+		for _, route := range report.Routes {
+			declared = declared || route.Router == name
+		}
+		if !declared {
+			l.report(LintInfo, "router %s is served by Traefik but declared by no module", name)
+		}
+	}
+}
+
+// traefikRouters returns the HTTP routers active in Traefik, read from its API
+func traefikRouters(traefikAPI string) ([]traefikRouter, error) {
+	client := &http.Client{Timeout: traefikAPITimeout}
+	response, err := client.Get(strings.TrimSuffix(traefikAPI, "/") + "/api/http/routers?per_page=1000")
+	if err != nil {
+		return nil, fmt.Errorf("Traefik API unreachable: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Traefik API answered %s", response.Status)
+	}
+
+	routers := []traefikRouter{}
+	if err := json.NewDecoder(response.Body).Decode(&routers); err != nil {
+		return nil, fmt.Errorf("failed to decode Traefik routers: %v", err)
+	}
+	return routers, nil
+}
+
+// PrintRoutes prints the routes of every module followed by the problems found, and returns
+// the number of errors
+func PrintRoutes(report *RouteReport) int {
+	if len(report.Routes) == 0 {
+		fmt.Println("No module declares a Traefik router")
+	} else {
+		fmt.Printf("%-20s %-20s %-36s %-14s %-22s %s\n", "MODULE", "ROUTER", "HOSTS", "ENTRYPOINTS", "MIDDLEWARES", "TLS")
+		for _, route := range report.Routes {
+			tls := "-"
+			if route.TLS {
+				tls = "yes"
+				if route.CertResolver != "" {
+					tls = route.CertResolver
+				}
+			}
+			hosts := strings.Join(route.Hosts, ",")
+			if hosts == "" {
+				hosts = route.Rule
+			}
+			line := fmt.Sprintf("%-20s %-20s %-36s %-14s %-22s %s", route.Module, route.Router, hosts,
+				orDash(strings.Join(route.EntryPoints, ",")), orDash(strings.Join(route.Middlewares, ",")), tls)
+			if route.Status != "" {
+				line += " (" + route.Status + ")"
+			}
+			fmt.Println(line)
+		}
+		fmt.Println()
+	}
+	return PrintLintFindings("routes", report.Findings)
+}
+
+// orDash returns value, or "-" when it is empty, for table cells
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
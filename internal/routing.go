@@ -0,0 +1,345 @@
+package internal
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultEntryPoints are used by routing specs that declare none
+var defaultEntryPoints = []string{"websecure"}
+
+// hostnamePattern matches a hostname once its ${VAR} references are replaced
+var hostnamePattern = regexp.MustCompile(`^(\*\.)?([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// bodySizePattern matches sizes such as 512M or 1048576
+var bodySizePattern = regexp.MustCompile(`^(\d+)([KMG]?)B?$`)
+
+// mergeRoutingSpecs overlays the specs of overlay onto base, per service: the fields an
+// overlay spec sets replace those of the base spec
+func mergeRoutingSpecs(base, overlay []shared.RoutingSpec) []shared.RoutingSpec {
+	merged := append([]shared.RoutingSpec{}, base...)
+	for _, spec := range overlay {
+		index := -1
+		for i := range merged {
+			if merged[i].Service == spec.Service {
+				index = i
+			}
+		}
+		if index < 0 {
+			merged = append(merged, spec)
+			continue
+		}
+
+		target := &merged[index]
+		if len(spec.Hosts) > 0 {
+			target.Hosts = spec.Hosts
+		}
+		target.WWW = target.WWW || spec.WWW
+		if spec.Port != 0 {
+			target.Port = spec.Port
+		}
+		if len(spec.EntryPoints) > 0 {
+			target.EntryPoints = spec.EntryPoints
+		}
+		target.TLS = target.TLS || spec.TLS
+		if spec.CertResolver != "" {
+			target.CertResolver = spec.CertResolver
+		}
+		if spec.Network != "" {
+			target.Network = spec.Network
+		}
+		if spec.BasicAuth != "" {
+			target.BasicAuth = spec.BasicAuth
+		}
+		target.Compress = target.Compress || spec.Compress
+		if spec.MaxBodySize != "" {
+			target.MaxBodySize = spec.MaxBodySize
+		}
+		if len(spec.Redirects) > 0 {
+			target.Redirects = spec.Redirects
+		}
+	}
+	return merged
+}
+
+// validateRoutingSpecs returns the problems of routing specs for the services of a compose file
+func validateRoutingSpecs(specs []shared.RoutingSpec, services map[string]bool) []string {
+	problems := []string{}
+	seen := make(map[string]bool)
+	for i, spec := range specs {
+		name := spec.Service
+		if name == "" {
+			problems = append(problems, fmt.Sprintf("routing #%d has no service", i+1))
+			continue
+		}
+		if seen[name] {
+			problems = append(problems, fmt.Sprintf("routing of service %s is declared twice", name))
+		}
+		seen[name] = true
+		if !services[name] {
+			problems = append(problems, fmt.Sprintf("routing targets service %s which the compose file does not define", name))
+		}
+
+		if len(spec.Hosts) == 0 {
+			problems = append(problems, fmt.Sprintf("routing of %s has no hosts", name))
+		}
+		for _, host := range spec.Hosts {
+			literal := strings.ToLower(composeVariablePattern.ReplaceAllString(host, "x"))
+			if !hostnamePattern.MatchString(literal) {
+				problems = append(problems, fmt.Sprintf("routing of %s has invalid host %q", name, host))
+			}
+		}
+		if spec.Port < 1 || spec.Port > 65535 {
+			problems = append(problems, fmt.Sprintf("routing of %s needs a port between 1 and 65535", name))
+		}
+		for _, entryPoint := range spec.EntryPoints {
+			if strings.TrimSpace(entryPoint) == "" || strings.Contains(entryPoint, ",") {
+				problems = append(problems, fmt.Sprintf("routing of %s has invalid entrypoint %q", name, entryPoint))
+			}
+		}
+
+		if spec.BasicAuth != "" && !strings.HasPrefix(spec.BasicAuth, "${") {
+			for _, user := range strings.Split(spec.BasicAuth, ",") {
+				if !strings.Contains(user, ":") {
+					problems = append(problems, fmt.Sprintf("basic auth of %s expects user:hash entries", name))
+				}
+			}
+			if strings.Count(spec.BasicAuth, "$") != 2*strings.Count(spec.BasicAuth, "$$") {
+				problems = append(problems, fmt.Sprintf("basic auth of %s must escape $ as $$ or come from a ${VARIABLE}", name))
+			}
+		}
+		if spec.MaxBodySize != "" {
+			if _, err := parseBodySize(spec.MaxBodySize); err != nil {
+				problems = append(problems, fmt.Sprintf("routing of %s: %v", name, err))
+			}
+		}
+		for _, redirect := range spec.Redirects {
+			if redirect.From == "" || redirect.To == "" {
+				problems = append(problems, fmt.Sprintf("redirect of %s needs from and to", name))
+				continue
+			}
+			if strings.Contains(redirect.From, "${") {
+				continue
+			}
+			if _, err := regexp.Compile(redirect.From); err != nil {
+				problems = append(problems, fmt.Sprintf("redirect of %s has invalid regex %q: %v", name, redirect.From, err))
+			}
+		}
+	}
+	return problems
+}
+
+// parseBodySize converts a size such as 512M into bytes
+func parseBodySize(size string) (int64, error) {
+	match := bodySizePattern.FindStringSubmatch(strings.ToUpper(strings.TrimSpace(size)))
+	if match == nil {
+		return 0, fmt.Errorf("invalid body size %q, expected a number of bytes with an optional K, M or G suffix", size)
+	}
+	value, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid body size %q: %v", size, err)
+	}
+	switch match[2] {
+	case "K":
+		value <<= 10
+	case "M":
+		value <<= 20
+	case "G":
+		value <<= 30
+	}
+	return value, nil
+}
+
+// routingLabels returns the traefik labels implementing a routing spec, in a stable order.
+// Routers, services and middlewares are named after the router so modules never share them.
+func routingLabels(router string, spec shared.RoutingSpec) []string {
+	hosts := []string{}
+	for _, host := range spec.Hosts {
+		hosts = append(hosts, "`"+host+"`")
+		if spec.WWW && !strings.HasPrefix(host, "www.") {
+			hosts = append(hosts, "`www."+host+"`")
+		}
+	}
+	entryPoints := spec.EntryPoints
+	if len(entryPoints) == 0 {
+		entryPoints = defaultEntryPoints
+	}
+
+	prefix := "traefik.http.routers." + router
+	labels := []string{
+		"traefik.enable=true",
+		prefix + ".rule=Host(" + strings.Join(hosts, ", ") + ")",
+		prefix + ".entrypoints=" + strings.Join(entryPoints, ","),
+		prefix + ".service=" + router,
+		"traefik.http.services." + router + ".loadbalancer.server.port=" + strconv.Itoa(spec.Port),
+	}
+	if spec.TLS || spec.CertResolver != "" {
+		labels = append(labels, prefix+".tls=true")
+	}
+	if spec.CertResolver != "" {
+		labels = append(labels, prefix+".tls.certresolver="+spec.CertResolver)
+	}
+
+	middlewares := []string{}
+	middleware := func(name string, options ...string) {
+		middlewares = append(middlewares, name)
+		for _, option := range options {
+			labels = append(labels, "traefik.http.middlewares."+name+"."+option)
+		}
+	}
+	for i, redirect := range spec.Redirects {
+		middleware(fmt.Sprintf("%s-redirect%d", router, i+1),
+			"redirectregex.regex="+redirect.From,
+			"redirectregex.replacement="+redirect.To,
+			"redirectregex.permanent="+strconv.FormatBool(redirect.Permanent))
+	}
+	if spec.BasicAuth != "" {
+		middleware(router+"-auth", "basicauth.users="+spec.BasicAuth)
+	}
+	if spec.MaxBodySize != "" {
+		size, _ := parseBodySize(spec.MaxBodySize)
+		middleware(router+"-body-size", "buffering.maxRequestBodyBytes="+strconv.FormatInt(size, 10))
+	}
+	if spec.Compress {
+		middleware(router+"-compress", "compress=true")
+	}
+	if len(middlewares) > 0 {
+		labels = append(labels, prefix+".middlewares="+strings.Join(middlewares, ","))
+	}
+	if spec.Network != "" {
+		labels = append(labels, "traefik.docker.network="+spec.Network)
+	}
+	return labels
+}
+
+// routerName names the router of a routing spec: the module itself, or the module and the
+// service when the module routes to several services
+func routerName(moduleName string, specs []shared.RoutingSpec, spec shared.RoutingSpec) string {
+	if len(specs) == 1 {
+		return moduleName
+	}
+	return moduleName + "-" + spec.Service
+}
+
+// ApplyRouting validates routing specs and merges the traefik labels they generate into the
+// services of the resolved compose file
+func ApplyRouting(resolved *ResolvedTemplate, moduleName string, specs []shared.RoutingSpec) error {
+	if len(specs) == 0 {
+		return nil
+	}
+
+	compose, err := parseComposeNode(resolved.Compose)
+	if err != nil {
+		return fmt.Errorf("failed to parse docker-compose.yml of template %s: %v", resolved.Name, err)
+	}
+	servicesNode := mappingValue(compose, "services")
+	services := make(map[string]bool)
+	for _, name := range mappingKeys(servicesNode) {
+		services[name] = true
+	}
+	if problems := validateRoutingSpecs(specs, services); len(problems) > 0 {
+		return fmt.Errorf("invalid routing: %s", strings.Join(problems, "; "))
+	}
+
+	for _, spec := range specs {
+		labels := routingLabels(routerName(moduleName, specs, spec), spec)
+
+		// Follow the style of the existing labels so they merge key by key
+		labelsNode := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if existing := mappingValue(mappingValue(servicesNode, spec.Service), "labels"); existing != nil && existing.Kind == yaml.MappingNode {
+			labelsNode = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		for _, label := range labels {
+			key, value, _ := strings.Cut(label, "=")
+			if labelsNode.Kind == yaml.MappingNode {
+				labelsNode.Content = append(labelsNode.Content, scalarNode(key), scalarNode(value))
+			} else {
+				labelsNode.Content = append(labelsNode.Content, scalarNode(label))
+			}
+		}
+
+		fragment := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+			scalarNode("services"),
+			{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+				scalarNode(spec.Service),
+				{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{scalarNode("labels"), labelsNode}},
+			}},
+		}}
+		mergeComposeNodes(compose, fragment)
+		log.Printf("Generated traefik labels for service %s", spec.Service)
+	}
+
+	resolved.Compose, err = encodeComposeNode(compose)
+	if err != nil {
+		return fmt.Errorf("failed to render docker-compose.yml of template %s: %v", resolved.Name, err)
+	}
+	return nil
+}
+
+// scalarNode returns a string scalar node
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// checkRenderedRoutes checks the routes of a rendered module against the other docked
+// modules: a router name or hostname they already use is an error
+func checkRenderedRoutes(config shared.Configuration, module *RenderedModule, env map[string]string) error {
+	var compose struct {
+		Services map[string]composeService `yaml:"services"`
+	}
+	if err := yaml.Unmarshal([]byte(module.Files["docker-compose.yml"]), &compose); err != nil {
+		return fmt.Errorf("failed to parse rendered docker-compose.yml: %v", err)
+	}
+	routes, _ := servicesRoutes(module.Name, compose.Services, env)
+
+	others, err := ListModuleNames(config)
+	if err != nil {
+		return err
+	}
+	problems := []string{}
+	for _, other := range others {
+		if other == module.Name {
+			continue
+		}
+		otherRoutes, _, err := moduleRoutes(config, other)
+		if err != nil {
+			continue
+		}
+		for _, route := range routes {
+			for _, existing := range otherRoutes {
+				if route.Router == existing.Router {
+					problems = append(problems, fmt.Sprintf("router %s is already defined by %s", route.Router, other))
+				}
+				for _, host := range route.Hosts {
+					// Placeholders not filled yet, as in dry runs, match nothing
+					if strings.Contains(host, "<") {
+						continue
+					}
+					if containsString(existing.Hosts, host) {
+						problems = append(problems, fmt.Sprintf("host %s is already routed by %s", host, other))
+					}
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("routing of %s conflicts with docked modules: %s", module.Name, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// moduleEnv reads the .env of a module directory, for interpolating its labels
+func moduleEnv(config shared.Configuration, module string) map[string]string {
+	env, _ := ReadEnvFile(filepath.Join(config.ComposeDir, module, ".env"))
+	if env == nil {
+		env = map[string]string{}
+	}
+	return env
+}
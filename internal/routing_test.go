@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+func TestRoutingLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		router string
+		spec   shared.RoutingSpec
+		want   []string
+	}{
+		{
+			name:   "minimal",
+			router: "site1",
+			spec:   shared.RoutingSpec{Service: "web", Hosts: []string{"example.com"}, Port: 80},
+			want: []string{
+				"traefik.enable=true",
+				"traefik.http.routers.site1.rule=Host(`example.com`)",
+				"traefik.http.routers.site1.entrypoints=websecure",
+				"traefik.http.routers.site1.service=site1",
+				"traefik.http.services.site1.loadbalancer.server.port=80",
+			},
+		},
+		{
+			name:   "www aliases, tls and network",
+			router: "site1",
+			spec: shared.RoutingSpec{Service: "web", Hosts: []string{"example.com", "www.example.org"}, WWW: true, Port: 8080,
+				EntryPoints: []string{"web", "websecure"}, CertResolver: "letsencrypt", Network: "proxy"},
+			want: []string{
+				"traefik.enable=true",
+				"traefik.http.routers.site1.rule=Host(`example.com`, `www.example.com`, `www.example.org`)",
+				"traefik.http.routers.site1.entrypoints=web,websecure",
+				"traefik.http.routers.site1.service=site1",
+				"traefik.http.services.site1.loadbalancer.server.port=8080",
+				"traefik.http.routers.site1.tls=true",
+				"traefik.http.routers.site1.tls.certresolver=letsencrypt",
+				"traefik.docker.network=proxy",
+			},
+		},
+		{
+			name:   "middlewares in order",
+			router: "shop-api",
+			spec: shared.RoutingSpec{Service: "api", Hosts: []string{"${API_HOST}"}, Port: 3000, TLS: true,
+				BasicAuth: "admin:$$apr1$$x", Compress: true, MaxBodySize: "2M",
+				Redirects: []shared.RedirectSpec{{From: "^/old/(.*)", To: "/new/$${1}", Permanent: true}}},
+			want: []string{
+				"traefik.enable=true",
+				"traefik.http.routers.shop-api.rule=Host(`${API_HOST}`)",
+				"traefik.http.routers.shop-api.entrypoints=websecure",
+				"traefik.http.routers.shop-api.service=shop-api",
+				"traefik.http.services.shop-api.loadbalancer.server.port=3000",
+				"traefik.http.routers.shop-api.tls=true",
+				"traefik.http.middlewares.shop-api-redirect1.redirectregex.regex=^/old/(.*)",
+				"traefik.http.middlewares.shop-api-redirect1.redirectregex.replacement=/new/$${1}",
+				"traefik.http.middlewares.shop-api-redirect1.redirectregex.permanent=true",
+				"traefik.http.middlewares.shop-api-auth.basicauth.users=admin:$$apr1$$x",
+				"traefik.http.middlewares.shop-api-body-size.buffering.maxRequestBodyBytes=2097152",
+				"traefik.http.middlewares.shop-api-compress.compress=true",
+				"traefik.http.routers.shop-api.middlewares=shop-api-redirect1,shop-api-auth,shop-api-body-size,shop-api-compress",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := routingLabels(test.router, test.spec)
+			if strings.Join(got, "\n") != strings.Join(test.want, "\n") {
+				t.Errorf("labels:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(test.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestRouterName(t *testing.T) {
+	web := shared.RoutingSpec{Service: "web"}
+	api := shared.RoutingSpec{Service: "api"}
+	if got := routerName("site1", []shared.RoutingSpec{web}, web); got != "site1" {
+		t.Errorf("router of a single spec = %s, want site1", got)
+	}
+	if got := routerName("site1", []shared.RoutingSpec{web, api}, api); got != "site1-api" {
+		t.Errorf("router of one of several specs = %s, want site1-api", got)
+	}
+}
+
+func TestParseBodySize(t *testing.T) {
+	tests := []struct {
+		size    string
+		want    int64
+		wantErr bool
+	}{
+		{"1048576", 1048576, false},
+		{"512K", 512 << 10, false},
+		{"2m", 2 << 20, false},
+		{"1GB", 1 << 30, false},
+		{" 10M ", 10 << 20, false},
+		{"1.5M", 0, true},
+		{"10T", 0, true},
+		{"", 0, true},
+	}
+	for _, test := range tests {
+		got, err := parseBodySize(test.size)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("parseBodySize(%q) = %d, %v, want %d (error %v)", test.size, got, err, test.want, test.wantErr)
+		}
+	}
+}
+
+func TestValidateRoutingSpecs(t *testing.T) {
+	services := map[string]bool{"web": true, "api": true}
+	valid := shared.RoutingSpec{Service: "web", Hosts: []string{"${HOSTNAME}", "example.com"}, Port: 80}
+	tests := []struct {
+		name string
+		spec shared.RoutingSpec
+		want string
+	}{
+		{"valid", valid, ""},
+		{"no service", shared.RoutingSpec{Hosts: []string{"a.com"}, Port: 80}, "has no service"},
+		{"unknown service", shared.RoutingSpec{Service: "db", Hosts: []string{"a.com"}, Port: 80}, "does not define"},
+		{"no hosts", shared.RoutingSpec{Service: "web", Port: 80}, "has no hosts"},
+		{"invalid host", shared.RoutingSpec{Service: "web", Hosts: []string{"exa mple.com"}, Port: 80}, "invalid host"},
+		{"port", shared.RoutingSpec{Service: "web", Hosts: []string{"a.com"}, Port: 70000}, "port between"},
+		{"unescaped basic auth", shared.RoutingSpec{Service: "web", Hosts: []string{"a.com"}, Port: 80, BasicAuth: "admin:$apr1$x"}, "must escape $"},
+		{"body size", shared.RoutingSpec{Service: "web", Hosts: []string{"a.com"}, Port: 80, MaxBodySize: "big"}, "invalid body size"},
+		{"redirect regex", shared.RoutingSpec{Service: "web", Hosts: []string{"a.com"}, Port: 80,
+			Redirects: []shared.RedirectSpec{{From: "(", To: "/"}}}, "invalid regex"},
+	}
+	for _, test := range tests {
+		problems := validateRoutingSpecs([]shared.RoutingSpec{test.spec}, services)
+		joined := strings.Join(problems, "; ")
+		if test.want == "" && len(problems) > 0 {
+			t.Errorf("%s: unexpected problems %s", test.name, joined)
+		}
+		if test.want != "" && !strings.Contains(joined, test.want) {
+			t.Errorf("%s: problems %q, want %q", test.name, joined, test.want)
+		}
+	}
+
+	if problems := validateRoutingSpecs([]shared.RoutingSpec{valid, valid}, services); !strings.Contains(strings.Join(problems, ";"), "declared twice") {
+		t.Errorf("duplicate specs not reported: %v", problems)
+	}
+}
+
+func TestMergeRoutingSpecs(t *testing.T) {
+	base := []shared.RoutingSpec{{Service: "web", Hosts: []string{"a.com"}, Port: 80, CertResolver: "le"}}
+	overlay := []shared.RoutingSpec{
+		{Service: "web", Hosts: []string{"b.com"}, Compress: true},
+		{Service: "api", Hosts: []string{"api.b.com"}, Port: 3000},
+	}
+	merged := mergeRoutingSpecs(base, overlay)
+	if len(merged) != 2 {
+		t.Fatalf("merged = %v, want web and api", merged)
+	}
+	web := merged[0]
+	if web.Hosts[0] != "b.com" || web.Port != 80 || web.CertResolver != "le" || !web.Compress {
+		t.Errorf("merged web = %+v, want the overlay hosts and compress over the base port and resolver", web)
+	}
+	if base[0].Hosts[0] != "a.com" {
+		t.Errorf("base spec modified by the merge")
+	}
+}
+
+func TestApplyRoutingFollowsLabelStyle(t *testing.T) {
+	tests := []struct {
+		name    string
+		compose string
+		want    []string
+	}{
+		{"list labels", "services:\n  web:\n    image: nginx\n    labels:\n      - keep=me\n",
+			[]string{"- keep=me", "- traefik.enable=true", "- traefik.http.services.site1.loadbalancer.server.port=80"}},
+		{"mapping labels", "services:\n  web:\n    image: nginx\n    labels:\n      keep: me\n",
+			[]string{"keep: me", `traefik.enable: "true"`, `traefik.http.services.site1.loadbalancer.server.port: "80"`}},
+	}
+	for _, test := range tests {
+		resolved := &ResolvedTemplate{Name: "test", Compose: []byte(test.compose)}
+		spec := shared.RoutingSpec{Service: "web", Hosts: []string{"example.com"}, Port: 80}
+		if err := ApplyRouting(resolved, "site1", []shared.RoutingSpec{spec}); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		for _, want := range test.want {
+			if !strings.Contains(string(resolved.Compose), want) {
+				t.Errorf("%s: compose lacks %q:\n%s", test.name, want, resolved.Compose)
+			}
+		}
+	}
+
+	resolved := &ResolvedTemplate{Name: "test", Compose: []byte("services:\n  web:\n    image: nginx\n")}
+	if err := ApplyRouting(resolved, "site1", []shared.RoutingSpec{{Service: "db", Hosts: []string{"a.com"}, Port: 80}}); err == nil {
+		t.Errorf("routing of an unknown service accepted")
+	}
+}
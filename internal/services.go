@@ -0,0 +1,283 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// ServiceInfo describes a service of a module and its containers
+type ServiceInfo struct {
+	Name       string             `json:"name"`
+	Image      string             `json:"image"`
+	Containers []ComposeContainer `json:"containers"`
+}
+
+// serviceModuleDir returns the directory of a module after checking that it exists and
+// that every service name is defined in its compose file
+func serviceModuleDir(config shared.Configuration, moduleName string, services []string) (string, error) {
+	moduleDir := filepath.Join(config.ComposeDir, moduleName)
+	if _, err := os.Stat(moduleDir); os.IsNotExist(err) {
+		return "", fmt.Errorf("module directory for %s does not exist", moduleName)
+	}
+	return moduleDir, validateServices(moduleDir, services)
+}
+
+// validateServices checks that every service name is defined in the module compose file
+func validateServices(moduleDir string, services []string) error {
+	if len(services) == 0 {
+		return nil
+	}
+	defined, err := loadComposeServices(moduleDir)
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		if _, ok := defined[service]; !ok {
+			return fmt.Errorf("service %s is not defined, available services: %s", service, strings.Join(sortedKeys(defined), ", "))
+		}
+	}
+	return nil
+}
+
+// ListServices returns the services of a module with their containers
+func ListServices(config shared.Configuration, moduleName string) ([]ServiceInfo, error) {
+	moduleDir, err := serviceModuleDir(config, moduleName, nil)
+	if err != nil {
+		return nil, err
+	}
+	defined, err := loadComposeServices(moduleDir)
+	if err != nil {
+		return nil, err
+	}
+	env, _ := ReadEnvFile(filepath.Join(moduleDir, ".env"))
+	containers, err := ProjectContainers(moduleName)
+	if err != nil {
+		return nil, err
+	}
+
+	services := []ServiceInfo{}
+	for _, name := range sortedKeys(defined) {
+		image, _ := defined[name]["image"].(string)
+		info := ServiceInfo{Name: name, Image: interpolateEnv(image, env), Containers: []ComposeContainer{}}
+		for _, container := range containers {
+			if container.Service == name {
+				info.Containers = append(info.Containers, container)
+			}
+		}
+		services = append(services, info)
+	}
+	return services, nil
+}
+
+// runServices runs a compose command on the given services of a module, all when empty
+func runServices(config shared.Configuration, moduleName, action string, services []string, args ...string) error {
+	lock, err := LockModule(config, moduleName, action)
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+
+	moduleDir, err := serviceModuleDir(config, moduleName, services)
+	if err != nil {
+		return err
+	}
+
+	args = append(append([]string{action}, args...), services...)
+	output, err := composeCommand(moduleDir, moduleName, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to %s %s: %v, output: %s", action, moduleName, err, output)
+	}
+
+	target := moduleName
+	if len(services) > 0 {
+		target += " (" + strings.Join(services, ", ") + ")"
+	}
+	log.Printf("Ran %s on %s", action, target)
+	return nil
+}
+
+// StopServices stops the containers of a module, or of the given services, keeping them.
+// Stopping a whole module records it as desired stopped.
+func StopServices(config shared.Configuration, moduleName string, services []string) error {
+	if err := runServices(config, moduleName, "stop", services); err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		recordDesiredState(config, moduleName, DesiredStopped)
+	}
+	return nil
+}
+
+// StartServices starts the stopped containers of a module, or of the given services.
+// Starting a whole module records it as desired running.
+func StartServices(config shared.Configuration, moduleName string, services []string) error {
+	if err := runServices(config, moduleName, "start", services); err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		recordDesiredState(config, moduleName, DesiredRunning)
+	}
+	return nil
+}
+
+// PullServices pulls the images of a module, or of the given services
+func PullServices(config shared.Configuration, moduleName string, services []string) error {
+	return runServices(config, moduleName, "pull", services)
+}
+
+// ServiceLogs returns the last lines of the logs of a module, or of the given services
+func ServiceLogs(config shared.Configuration, moduleName string, services []string, tail int) (string, error) {
+	moduleDir, err := serviceModuleDir(config, moduleName, services)
+	if err != nil {
+		return "", err
+	}
+
+	args := append([]string{"logs", "--no-color", "--tail", fmt.Sprint(tail)}, services...)
+	output, err := composeCommand(moduleDir, moduleName, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to read logs of %s: %v, output: %s", moduleName, err, output)
+	}
+	return string(output), nil
+}
+
+// defaultShell opens bash when the image has it and sh otherwise
+var defaultShell = []string{"sh", "-c", "if command -v bash >/dev/null 2>&1; then exec bash; else exec sh; fi"}
+
+// execCommand prepares `docker compose exec` in a service, a shell when command is empty
+func execCommand(config shared.Configuration, moduleName, service string, command []string, tty bool) (*exec.Cmd, error) {
+	if service == "" || strings.Contains(service, ",") {
+		return nil, fmt.Errorf("exactly one service is required to exec in %s", moduleName)
+	}
+	moduleDir, err := serviceModuleDir(config, moduleName, []string{service})
+	if err != nil {
+		return nil, err
+	}
+	if len(command) == 0 {
+		command = defaultShell
+	}
+
+	args := []string{"exec"}
+	if !tty {
+		args = append(args, "-T")
+	}
+	log.Printf("Exec in %s/%s: %s", moduleName, service, strings.Join(command, " "))
+	return composeCommand(moduleDir, moduleName, append(append(args, service), command...)...), nil
+}
+
+// ExecService runs a command in the running container of a service, or a shell when command
+// is empty. With tty a terminal is allocated in the container and stdin must be a terminal.
+func ExecService(config shared.Configuration, moduleName, service string, command []string, tty bool, stdin io.Reader, stdout, stderr io.Writer) error {
+	cmd, err := execCommand(config, moduleName, service, command, tty)
+	if err != nil {
+		return err
+	}
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	return cmd.Run()
+}
+
+// Terminal is an exec session for remote clients, attached to a pseudo terminal when
+// the platform has them and to plain pipes otherwise
+type Terminal struct {
+	// Input receives the keystrokes, Output carries stdout and stderr
+	Input  io.Writer
+	Output io.Reader
+
+	cmd    *exec.Cmd
+	master *os.File
+	done   chan struct{}
+	code   int
+	err    error
+}
+
+// StartTerminal starts a command, or a shell, in a service for a remote client
+func StartTerminal(config shared.Configuration, moduleName, service string, command []string) (*Terminal, error) {
+	master, slave, err := openPTY()
+	cmd, cmdErr := execCommand(config, moduleName, service, command, err == nil)
+	if cmdErr != nil {
+		if err == nil {
+			master.Close()
+			slave.Close()
+		}
+		return nil, cmdErr
+	}
+
+	if err != nil {
+		log.Printf("Terminal for %s/%s uses pipes: %v", moduleName, service, err)
+		input, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		reader, writer := io.Pipe()
+		cmd.Stdout = writer
+		cmd.Stderr = writer
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		terminal := &Terminal{Input: input, Output: reader, cmd: cmd}
+		terminal.wait(writer)
+		return terminal, nil
+	}
+
+	cmd.Stdin = slave
+	cmd.Stdout = slave
+	cmd.Stderr = slave
+	attachTerminal(cmd)
+	err = cmd.Start()
+	slave.Close()
+	if err != nil {
+		master.Close()
+		return nil, err
+	}
+	terminal := &Terminal{Input: master, Output: master, cmd: cmd, master: master}
+	terminal.wait(nil)
+	return terminal, nil
+}
+
+// wait records the exit of the command in the background, then closes the output pipe
+func (t *Terminal) wait(output *io.PipeWriter) {
+	t.done = make(chan struct{})
+	go func() {
+		err := t.cmd.Wait()
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			t.code = exitErr.ExitCode()
+		} else if err != nil {
+			t.code, t.err = -1, err
+		}
+		if output != nil {
+			output.Close()
+		}
+		close(t.done)
+	}()
+}
+
+// Resize changes the size of the terminal, a no-op without a pseudo terminal
+func (t *Terminal) Resize(cols, rows uint16) error {
+	if t.master == nil {
+		return nil
+	}
+	return resizePTY(t.master, cols, rows)
+}
+
+// Wait waits for the command to exit and returns its exit code
+func (t *Terminal) Wait() (int, error) {
+	<-t.done
+	return t.code, t.err
+}
+
+// Close ends the session, killing the command when it still runs
+func (t *Terminal) Close() {
+	// Fails harmlessly once the process has exited
+	t.cmd.Process.Kill()
+	if t.master != nil {
+		t.master.Close()
+	}
+}
@@ -0,0 +1,311 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+	"gopkg.in/yaml.v3"
+)
+
+// SnippetFileSuffix is the file name suffix of a compose snippet
+const SnippetFileSuffix = ".snippet.yml"
+
+// snippetHeader is the x-snippet extension block at the top of a snippet file
+type snippetHeader struct {
+	Description string `yaml:"description"`
+	// Params are the parameters with their default, required when it is empty
+	Params map[string]string `yaml:"params"`
+	Env    yaml.Node         `yaml:"env"`
+}
+
+// ParseSnippetRefs parses a -with value such as "mariadb,redis:network=wordpress-network"
+func ParseSnippetRefs(value string) ([]shared.SnippetRef, error) {
+	refs := []shared.SnippetRef{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		parts := strings.Split(item, ":")
+		ref := shared.SnippetRef{Name: parts[0]}
+		for _, param := range parts[1:] {
+			keyValue := strings.SplitN(param, "=", 2)
+			if len(keyValue) != 2 || keyValue[0] == "" {
+				return nil, fmt.Errorf("invalid parameter %q for snippet %s, expected key=value", param, ref.Name)
+			}
+			if ref.Params == nil {
+				ref.Params = make(map[string]string)
+			}
+			ref.Params[keyValue[0]] = keyValue[1]
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// findSnippet looks up a snippet file, preferring the most specific template of the chain
+// over the shared snippets directory
+func findSnippet(config shared.Configuration, chain []string, name string) (string, error) {
+	candidates := []string{}
+	for i := len(chain) - 1; i >= 0; i-- {
+		candidates = append(candidates, filepath.Join(config.TemplatesDir, chain[i], name+SnippetFileSuffix))
+	}
+	if config.SnippetsDir != "" {
+		candidates = append(candidates, filepath.Join(config.SnippetsDir, name+SnippetFileSuffix))
+	}
+
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("snippet %s does not exist (available: %s)", name, strings.Join(ListSnippets(config, chain), ", "))
+}
+
+// renderSnippet renders a snippet file with its parameters and returns the compose
+// fragment along with the env defaults it declares
+func renderSnippet(path, moduleName string, ref shared.SnippetRef) (*yaml.Node, string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read snippet %s: %v", ref.Name, err)
+	}
+
+	// First pass: read the declared parameter defaults
+	var raw struct {
+		Header snippetHeader `yaml:"x-snippet"`
+	}
+	if err := yaml.Unmarshal(content, &raw); err != nil {
+		return nil, "", fmt.Errorf("failed to parse snippet %s: %v", ref.Name, err)
+	}
+
+	params := map[string]string{"module": moduleName}
+	for key, value := range ref.Params {
+		if _, declared := raw.Header.Params[key]; !declared {
+			return nil, "", fmt.Errorf("snippet %s has no parameter %s", ref.Name, key)
+		}
+		params[key] = value
+	}
+	// A parameter declared without default is required
+	for _, key := range sortedKeys(raw.Header.Params) {
+		value, overridden := ref.Params[key]
+		if !overridden {
+			value = raw.Header.Params[key]
+		}
+		if value == "" {
+			return nil, "", fmt.Errorf("snippet %s requires parameter %s, for instance %s:%s=value", ref.Name, key, ref.Name, key)
+		}
+	}
+
+	// Defaults may use other parameters, so they are rendered in passes, in name order, each
+	// once the parameters it uses are known
+	pending := []string{}
+	for _, key := range sortedKeys(raw.Header.Params) {
+		if _, overridden := ref.Params[key]; !overridden {
+			pending = append(pending, key)
+		}
+	}
+	for len(pending) > 0 {
+		remaining := []string{}
+		var renderErr error
+		for _, key := range pending {
+			rendered, err := renderSnippetText(ref.Name, raw.Header.Params[key], params)
+			if err != nil {
+				remaining = append(remaining, key)
+				renderErr = err
+				continue
+			}
+			params[key] = rendered
+		}
+		if len(remaining) == len(pending) {
+			return nil, "", renderErr
+		}
+		pending = remaining
+	}
+
+	// Second pass: render the whole file with the final parameters
+	rendered, err := renderSnippetText(ref.Name, string(content), params)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fragment, err := parseComposeNode([]byte(rendered))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse rendered snippet %s: %v", ref.Name, err)
+	}
+
+	var header struct {
+		Header snippetHeader `yaml:"x-snippet"`
+	}
+	if err := yaml.Unmarshal([]byte(rendered), &header); err != nil {
+		return nil, "", fmt.Errorf("failed to parse rendered snippet %s: %v", ref.Name, err)
+	}
+
+	// Collect the env defaults in declaration order
+	envLines := []string{}
+	env := &header.Header.Env
+	for i := 0; i+1 < len(env.Content); i += 2 {
+		envLines = append(envLines, fmt.Sprintf("%s=%s", env.Content[i].Value, env.Content[i+1].Value))
+	}
+
+	// Keys were quoted only to protect template expressions, let the encoder decide
+	unquoteMappingKeys(fragment)
+
+	// Drop the extension block before merging
+	for i := 0; i+1 < len(fragment.Content); i += 2 {
+		if fragment.Content[i].Value == "x-snippet" {
+			fragment.Content = append(fragment.Content[:i], fragment.Content[i+2:]...)
+			break
+		}
+	}
+
+	envTemplate := ""
+	if len(envLines) > 0 {
+		envTemplate = fmt.Sprintf("# Snippet %s\n%s\n", ref.Name, strings.Join(envLines, "\n"))
+	}
+	return fragment, envTemplate, nil
+}
+
+// unquoteMappingKeys resets the quoting style of every mapping key below node
+func unquoteMappingKeys(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			node.Content[i].Style = 0
+		}
+	}
+	for _, child := range node.Content {
+		unquoteMappingKeys(child)
+	}
+}
+
+// renderSnippetText renders text/template expressions such as {{ .service }} in a snippet
+func renderSnippetText(name, text string, params map[string]string) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse snippet %s: %v", name, err)
+	}
+
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, params); err != nil {
+		return "", fmt.Errorf("failed to render snippet %s: %v", name, err)
+	}
+	return buffer.String(), nil
+}
+
+// ApplySnippets renders the given snippets and merges them into the resolved template.
+// Env defaults declared by a snippet are only added when the template does not define them.
+func ApplySnippets(config shared.Configuration, resolved *ResolvedTemplate, moduleName string, refs []shared.SnippetRef) error {
+	if len(refs) == 0 {
+		return nil
+	}
+
+	compose, err := parseComposeNode(resolved.Compose)
+	if err != nil {
+		return fmt.Errorf("failed to parse docker-compose.yml of template %s: %v", resolved.Name, err)
+	}
+
+	// Template-local snippets live next to the resolved chain, which may be a catalog
+	templateConfig := config
+	templateConfig.TemplatesDir = resolved.TemplatesDir
+
+	for _, ref := range refs {
+		path, err := findSnippet(templateConfig, resolved.Chain, ref.Name)
+		if err != nil {
+			return err
+		}
+
+		fragment, envTemplate, err := renderSnippet(path, moduleName, ref)
+		if err != nil {
+			return err
+		}
+		mergeComposeNodes(compose, fragment)
+		resolved.EnvTemplate = appendMissingEnv(resolved.EnvTemplate, envTemplate)
+		log.Printf("Included snippet %s", ref.Name)
+	}
+
+	resolved.Compose, err = encodeComposeNode(compose)
+	if err != nil {
+		return fmt.Errorf("failed to render docker-compose.yml of template %s: %v", resolved.Name, err)
+	}
+	return nil
+}
+
+// appendMissingEnv appends the lines of addition whose keys are not yet declared in base
+func appendMissingEnv(base, addition string) string {
+	declared := make(map[string]bool)
+	for _, line := range strings.Split(base, "\n") {
+		if key, ok := envLineKey(line); ok {
+			declared[key] = true
+		}
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(strings.TrimRight(addition, "\n"), "\n") {
+		if key, ok := envLineKey(line); ok && declared[key] {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 || (len(lines) == 1 && strings.HasPrefix(lines[0], "#")) {
+		return base
+	}
+
+	if base != "" && !strings.HasSuffix(base, "\n") {
+		base += "\n"
+	}
+	return base + "\n" + strings.Join(lines, "\n") + "\n"
+}
+
+// mergeSnippetRefs combines snippet lists, later entries replacing earlier ones with the same name
+func mergeSnippetRefs(lists ...[]shared.SnippetRef) []shared.SnippetRef {
+	merged := []shared.SnippetRef{}
+	positions := make(map[string]int)
+	for _, list := range lists {
+		for _, ref := range list {
+			if i, exists := positions[ref.Name]; exists {
+				merged[i] = ref
+				continue
+			}
+			positions[ref.Name] = len(merged)
+			merged = append(merged, ref)
+		}
+	}
+	return merged
+}
+
+// ListSnippets returns the names of the snippets available to a template
+func ListSnippets(config shared.Configuration, chain []string) []string {
+	dirs := []string{}
+	for _, name := range chain {
+		dirs = append(dirs, filepath.Join(config.TemplatesDir, name))
+	}
+	if config.SnippetsDir != "" {
+		dirs = append(dirs, config.SnippetsDir)
+	}
+
+	seen := make(map[string]bool)
+	names := []string{}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			name := strings.TrimSuffix(entry.Name(), SnippetFileSuffix)
+			if entry.IsDir() || name == entry.Name() || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
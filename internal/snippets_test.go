@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// testSnippet declares a service named by a parameter whose default uses another one
+const testSnippet = `x-snippet:
+  params:
+    service: cache
+    network: "{{ .module }}-net"
+  env:
+    CACHE_IMAGE: redis:7
+services:
+  "{{ .service }}":
+    image: ${CACHE_IMAGE}
+    networks:
+      - "{{ .network }}"
+`
+
+func TestParseSnippetRefs(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []shared.SnippetRef
+		wantErr bool
+	}{
+		{"", []shared.SnippetRef{}, false},
+		{"redis", []shared.SnippetRef{{Name: "redis"}}, false},
+		{"mariadb, redis:network=web:maxmemory=64mb", []shared.SnippetRef{
+			{Name: "mariadb"},
+			{Name: "redis", Params: map[string]string{"network": "web", "maxmemory": "64mb"}},
+		}, false},
+		{"backup:volume=a=b", []shared.SnippetRef{{Name: "backup", Params: map[string]string{"volume": "a=b"}}}, false},
+		{"redis:network", nil, true},
+		{"redis:=web", nil, true},
+	}
+	for _, test := range tests {
+		got, err := ParseSnippetRefs(test.value)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("ParseSnippetRefs(%q) accepted an invalid value", test.value)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseSnippetRefs(%q): %v", test.value, err)
+			continue
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("ParseSnippetRefs(%q) = %v, want %v", test.value, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i].Name != test.want[i].Name || len(got[i].Params) != len(test.want[i].Params) {
+				t.Errorf("ParseSnippetRefs(%q)[%d] = %v, want %v", test.value, i, got[i], test.want[i])
+				continue
+			}
+			for key, value := range test.want[i].Params {
+				if got[i].Params[key] != value {
+					t.Errorf("ParseSnippetRefs(%q)[%d].%s = %q, want %q", test.value, i, key, got[i].Params[key], value)
+				}
+			}
+		}
+	}
+}
+
+func TestRenderSnippet(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.snippet.yml")
+	if err := os.WriteFile(path, []byte(testSnippet), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		params      map[string]string
+		wantService string
+		wantNetwork string
+		wantErr     string
+	}{
+		{"defaults", nil, "cache", "site1-net", ""},
+		{"overridden", map[string]string{"service": "redis", "network": "web"}, "redis", "web", ""},
+		{"undeclared", map[string]string{"port": "6379"}, "", "", "has no parameter port"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fragment, env, err := renderSnippet(path, "site1", shared.SnippetRef{Name: "cache", Params: test.params})
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("renderSnippet error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mappingValue(fragment, "x-snippet") != nil {
+				t.Errorf("the x-snippet block is kept in the fragment")
+			}
+			service := mappingValue(mappingValue(fragment, "services"), test.wantService)
+			if service == nil {
+				t.Fatalf("service %s missing from the fragment, services: %v", test.wantService, mappingKeys(mappingValue(fragment, "services")))
+			}
+			networks := mappingValue(service, "networks")
+			if networks == nil || len(networks.Content) != 1 || networks.Content[0].Value != test.wantNetwork {
+				t.Errorf("networks of %s = %v, want [%s]", test.wantService, networks, test.wantNetwork)
+			}
+			if env != "# Snippet cache\nCACHE_IMAGE=redis:7\n" {
+				t.Errorf("env = %q", env)
+			}
+		})
+	}
+}
+
+// chainedSnippet has defaults using other parameters, one of them sorting after its user
+const chainedSnippet = `x-snippet:
+  params:
+    archive: "{{ .volume }}-backup"
+    volume: "{{ .module }}-data"
+    target: "/backups/{{ .archive }}"
+services:
+  "{{ .archive }}":
+    image: alpine
+    command: ["tar", "czf", "{{ .target }}.tar.gz", "/data"]
+    volumes:
+      - "{{ .volume }}:/data:ro"
+`
+
+func TestRenderSnippetChainedDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chained.snippet.yml")
+	if err := os.WriteFile(path, []byte(chainedSnippet), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		params      map[string]string
+		wantService string
+		wantVolume  string
+		wantCommand string
+	}{
+		{"defaults", nil, "site1-data-backup", "site1-data:/data:ro", "/backups/site1-data-backup.tar.gz"},
+		{"overridden dependency", map[string]string{"volume": "uploads"}, "uploads-backup", "uploads:/data:ro", "/backups/uploads-backup.tar.gz"},
+		{"overridden dependent", map[string]string{"volume": "uploads", "archive": "nightly"}, "nightly", "uploads:/data:ro", "/backups/nightly.tar.gz"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Map order varies between runs, the result must not
+			for i := 0; i < 10; i++ {
+				fragment, _, err := renderSnippet(path, "site1", shared.SnippetRef{Name: "chained", Params: test.params})
+				if err != nil {
+					t.Fatal(err)
+				}
+				service := mappingValue(mappingValue(fragment, "services"), test.wantService)
+				if service == nil {
+					t.Fatalf("service %s missing, services: %v", test.wantService, mappingKeys(mappingValue(fragment, "services")))
+				}
+				if volumes := mappingValue(service, "volumes"); volumes == nil || volumes.Content[0].Value != test.wantVolume {
+					t.Errorf("volumes = %v, want %s", volumes, test.wantVolume)
+				}
+				if command := mappingValue(service, "command"); command == nil || command.Content[2].Value != test.wantCommand {
+					t.Errorf("command = %v, want archive %s", command, test.wantCommand)
+				}
+			}
+		})
+	}
+
+	// A default using an undeclared parameter cannot be rendered
+	broken := strings.Replace(chainedSnippet, "{{ .module }}-data", "{{ .missing }}-data", 1)
+	if err := os.WriteFile(path, []byte(broken), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := renderSnippet(path, "site1", shared.SnippetRef{Name: "chained"}); err == nil {
+		t.Errorf("default using an undeclared parameter rendered")
+	}
+}
+
+func TestBackupSnippetRequiresVolume(t *testing.T) {
+	path := filepath.Join("..", "snippets", "backup.snippet.yml")
+	if _, _, err := renderSnippet(path, "site1", shared.SnippetRef{Name: "backup"}); err == nil || !strings.Contains(err.Error(), "requires parameter volume") {
+		t.Errorf("backup without volume: error = %v, want a required parameter error", err)
+	}
+
+	fragment, _, err := renderSnippet(path, "site1", shared.SnippetRef{Name: "backup", Params: map[string]string{"volume": "wordpress-data"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mappingValue(mappingValue(fragment, "services"), "wordpress-data-backup") == nil {
+		t.Errorf("backup service missing from the fragment")
+	}
+}
+
+func TestAppendMissingEnv(t *testing.T) {
+	base := "A=1\nB=2\n"
+	got := appendMissingEnv(base, "# Snippet x\nB=3\nC=4\n")
+	if strings.Contains(got, "B=3") || !strings.Contains(got, "C=4") || !strings.HasPrefix(got, base) {
+		t.Errorf("appendMissingEnv = %q, want B kept at 2 and C added", got)
+	}
+}
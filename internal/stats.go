@@ -0,0 +1,417 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// byteSizePattern matches sizes as printed by docker (12.5MiB, 1.2GB) or set in compose (512m)
+var byteSizePattern = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)?)\s*([kmgt]?)(i?)b?$`)
+
+// Module states derived from their containers
+const (
+	ModuleRunning = "running"
+	ModulePartial = "partial"
+	ModuleStopped = "stopped"
+	ModuleMissing = "missing"
+)
+
+// ServiceStats is the resource usage of a service container
+type ServiceStats struct {
+	Service   string `json:"service"`
+	Container string `json:"container"`
+	State     string `json:"state"`
+	Health    string `json:"health"`
+	Restarts  int    `json:"restarts"`
+	// CPUPercent is relative to one core, as docker stats reports it
+	CPUPercent  float64 `json:"cpu_percent"`
+	MemoryBytes int64   `json:"memory_bytes"`
+	// Limits come from deploy.resources.limits in the compose file, 0 when unset
+	MemoryLimitBytes int64   `json:"memory_limit_bytes"`
+	CPULimit         float64 `json:"cpu_limit"`
+}
+
+// ModuleStats is the resource usage of a module, summed over its services
+type ModuleStats struct {
+	Module       string         `json:"module"`
+	State        string         `json:"state"`
+	DesiredState string         `json:"desired_state"`
+	Health       string         `json:"health"`
+	Services     []ServiceStats `json:"services"`
+	CPUPercent   float64        `json:"cpu_percent"`
+	MemoryBytes  int64          `json:"memory_bytes"`
+	Restarts     int            `json:"restarts"`
+	VolumeBytes  int64          `json:"volume_bytes"`
+	// LastBackup is the time of the newest backup in the backup directory, zero without one
+	LastBackup time.Time `json:"last_backup,omitempty"`
+}
+
+// containerUsage is the usage of a running container reported by docker stats
+type containerUsage struct {
+	cpu    float64
+	memory int64
+}
+
+// CollectStats gathers the state, health, restarts, CPU, memory and volume usage of every
+// module, or of the given one, with one docker stats call for all containers
+func CollectStats(config shared.Configuration, moduleName string) ([]ModuleStats, error) {
+	modules := []string{moduleName}
+	if moduleName == "" {
+		var err error
+		if modules, err = ListModuleNames(config); err != nil {
+			return nil, err
+		}
+	}
+
+	usage, err := containerUsages()
+	if err != nil {
+		return nil, err
+	}
+	volumeSizes, err := cachedVolumeSizes()
+	if err != nil {
+		log.Printf("Volume sizes are not refreshed: %v", err)
+	}
+
+	stats := []ModuleStats{}
+	for _, module := range modules {
+		moduleStats, err := collectModuleStats(config, module, usage, volumeSizes)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, moduleStats)
+	}
+	return stats, nil
+}
+
+// volumeSizeCache keeps the volume sizes between stats collections, since measuring them walks
+// every volume of the host
+var volumeSizeCache struct {
+	mu       sync.Mutex
+	sizes    map[string]int64
+	measured time.Time
+}
+
+// cachedVolumeSizes returns the size of every volume, measured again once the last
+// measurement is older than the disk usage sample interval. The previous sizes are
+// returned along with the error when measuring fails.
+func cachedVolumeSizes() (map[string]int64, error) {
+	volumeSizeCache.mu.Lock()
+	defer volumeSizeCache.mu.Unlock()
+	if volumeSizeCache.sizes != nil && time.Since(volumeSizeCache.measured) < duSampleInterval {
+		return volumeSizeCache.sizes, nil
+	}
+
+	sizes, _, err := dockerDiskUsage()
+	if err != nil {
+		return volumeSizeCache.sizes, err
+	}
+	volumeSizeCache.sizes, volumeSizeCache.measured = sizes, time.Now()
+	return sizes, nil
+}
+
+// collectModuleStats assembles the stats of a module from the usage of every container
+func collectModuleStats(config shared.Configuration, module string, usage map[string]containerUsage, volumeSizes map[string]int64) (ModuleStats, error) {
+	moduleDir := filepath.Join(config.ComposeDir, module)
+	metadata, err := LoadModuleMetadata(config, module)
+	if err != nil && !os.IsNotExist(err) {
+		return ModuleStats{}, fmt.Errorf("failed to read metadata of %s: %v", module, err)
+	}
+	containers, err := ProjectContainers(module)
+	if err != nil {
+		return ModuleStats{}, err
+	}
+	services, _ := loadComposeServices(moduleDir)
+	env := moduleEnv(config, module)
+
+	stats := ModuleStats{Module: module, DesiredState: desiredState(metadata), Services: []ServiceStats{}, LastBackup: lastBackup(config, module)}
+	restarts := restartCounts(containers)
+	running := 0
+	for _, container := range containers {
+		service := ServiceStats{
+			Service:   container.Service,
+			Container: container.Name,
+			State:     container.State,
+			Health:    containerHealth(container),
+			Restarts:  restarts[container.Name],
+		}
+		if container.State == "running" {
+			running++
+		}
+		if used, ok := usage[container.Name]; ok {
+			service.CPUPercent, service.MemoryBytes = used.cpu, used.memory
+		}
+		service.MemoryLimitBytes, service.CPULimit = serviceLimits(services[container.Service], env)
+
+		stats.CPUPercent += service.CPUPercent
+		stats.MemoryBytes += service.MemoryBytes
+		stats.Restarts += service.Restarts
+		stats.Services = append(stats.Services, service)
+	}
+	sort.SliceStable(stats.Services, func(i, j int) bool { return stats.Services[i].Service < stats.Services[j].Service })
+
+	switch {
+	case len(containers) == 0:
+		stats.State = ModuleMissing
+	case running == 0:
+		stats.State = ModuleStopped
+	case running < len(containers):
+		stats.State = ModulePartial
+	default:
+		stats.State = ModuleRunning
+	}
+	stats.Health = moduleHealth(stats.Services)
+
+	if files, err := readModuleFiles(moduleDir); err == nil {
+		volumes, _ := projectObjects(module, files, "volumes")
+		for _, volume := range volumes {
+			if !volume.external {
+				stats.VolumeBytes += volumeSizes[volume.name]
+			}
+		}
+	}
+	return stats, nil
+}
+
+// moduleHealth returns the worst health of the services of a module
+func moduleHealth(services []ServiceStats) string {
+	rank := map[string]int{HealthUnhealthy: 5, HealthStopped: 4, HealthStarting: 3, HealthRunning: 2, HealthHealthy: 1, HealthCompleted: 0}
+	health := HealthStopped
+	worst := -1
+	for _, service := range services {
+		if rank[service.Health] > worst {
+			health, worst = service.Health, rank[service.Health]
+		}
+	}
+	return health
+}
+
+// containerUsages runs docker stats once for every running container
+func containerUsages() (map[string]containerUsage, error) {
+	output, err := exec.Command("docker", "stats", "--no-stream", "--format", "{{.Name}}\t{{.CPUPerc}}\t{{.MemUsage}}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read container stats: %v", err)
+	}
+
+	usage := make(map[string]containerUsage)
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			continue
+		}
+		cpu, _ := strconv.ParseFloat(strings.TrimSuffix(fields[1], "%"), 64)
+		used, _, _ := strings.Cut(fields[2], " / ")
+		memory, _ := parseByteSize(used, 1024)
+		usage[fields[0]] = containerUsage{cpu: cpu, memory: memory}
+	}
+	return usage, nil
+}
+
+// restartCounts returns how many times docker restarted each container
+func restartCounts(containers []ComposeContainer) map[string]int {
+	counts := make(map[string]int)
+	if len(containers) == 0 {
+		return counts
+	}
+	args := []string{"inspect", "--format", "{{.Name}}\t{{.RestartCount}}"}
+	for _, container := range containers {
+		args = append(args, container.Name)
+	}
+	output, err := exec.Command("docker", args...).Output()
+	if err != nil {
+		return counts
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		name, count, found := strings.Cut(line, "\t")
+		if found {
+			counts[strings.TrimPrefix(name, "/")], _ = strconv.Atoi(count)
+		}
+	}
+	return counts
+}
+
+// serviceLimits returns the memory and CPU limits of a compose service, 0 when unset
+func serviceLimits(service composeService, env map[string]string) (int64, float64) {
+	limits := composeMapping(composeMapping(composeMapping(service["deploy"])["resources"])["limits"])
+
+	var memory int64
+	var cpus float64
+	if value, ok := limits["memory"]; ok {
+		memory, _ = parseByteSize(interpolateEnv(fmt.Sprint(value), env), 1024)
+	}
+	if value, ok := limits["cpus"]; ok {
+		cpus, _ = strconv.ParseFloat(interpolateEnv(fmt.Sprint(value), env), 64)
+	}
+	return memory, cpus
+}
+
+// composeMapping returns a nested compose mapping, decoded with the type of its parent
+func composeMapping(value interface{}) composeService {
+	switch typed := value.(type) {
+	case composeService:
+		return typed
+	case map[string]interface{}:
+		return typed
+	}
+	return nil
+}
+
+// parseByteSize parses a size such as 12.5MiB, 1.2GB or 512m. Prefixes without i multiply by
+// base: docker prints them in powers of 1000, while compose and docker stats mean 1024.
+func parseByteSize(size string, base float64) (int64, error) {
+	match := byteSizePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(size)))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	value, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", size, err)
+	}
+	if match[3] == "i" {
+		base = 1024
+	}
+	for i := strings.Index("kmgt", match[2]); match[2] != "" && i >= 0; i-- {
+		value *= base
+	}
+	return int64(value), nil
+}
+
+// lastBackup returns the time of the newest backup of a module: the archives written in
+// the backups dir of the module by the backup snippet, by modification time, and the
+// backups of destroy -backup, named after their time
+func lastBackup(config shared.Configuration, module string) time.Time {
+	var last time.Time
+	archives, _ := filepath.Glob(filepath.Join(config.ComposeDir, module, "backups", "*.tar.gz"))
+	for _, archive := range archives {
+		if info, err := os.Stat(archive); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(config.BackupDir, module))
+	for _, entry := range entries {
+		if at, err := time.ParseInLocation("20060102-150405", entry.Name(), time.Local); err == nil && at.After(last) {
+			last = at
+		}
+	}
+	return last
+}
+
+// formatBytes prints a size in powers of 1024
+func formatBytes(size int64) string {
+	value := float64(size)
+	for _, unit := range []string{"B", "KiB", "MiB", "GiB"} {
+		if value < 1024 {
+			return fmt.Sprintf("%.1f%s", value, unit)
+		}
+		value /= 1024
+	}
+	return fmt.Sprintf("%.1fTiB", value)
+}
+
+// PrintStats prints the usage of every module followed by its services, like top
+func PrintStats(stats []ModuleStats) {
+	fmt.Printf("%-28s %-8s %-10s %7s %10s %10s %6s %9s %10s\n", "MODULE / SERVICE", "STATE", "HEALTH", "CPU%", "MEMORY", "LIMIT", "MEM%", "RESTARTS", "VOLUMES")
+	for _, module := range stats {
+		fmt.Printf("%-28s %-8s %-10s %7.1f %10s %10s %6s %9d %10s\n", module.Module, module.State, module.Health,
+			module.CPUPercent, formatBytes(module.MemoryBytes), "", "", module.Restarts, formatBytes(module.VolumeBytes))
+		for _, service := range module.Services {
+			limit, percent := "-", "-"
+			if service.MemoryLimitBytes > 0 {
+				limit = formatBytes(service.MemoryLimitBytes)
+				percent = fmt.Sprintf("%.0f%%", float64(service.MemoryBytes)*100/float64(service.MemoryLimitBytes))
+			}
+			fmt.Printf("  %-26s %-8s %-10s %7.1f %10s %10s %6s %9d\n", service.Service, service.State, service.Health,
+				service.CPUPercent, formatBytes(service.MemoryBytes), limit, percent, service.Restarts)
+		}
+	}
+}
+
+// WriteMetrics writes the stats in the Prometheus text exposition format
+func WriteMetrics(w io.Writer, stats []ModuleStats) {
+	metric := func(name, kind, help string, samples func(sample func(labels string, value float64))) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		samples(func(labels string, value float64) {
+			fmt.Fprintf(w, "%s{%s} %g\n", name, labels, value)
+		})
+	}
+	moduleLabels := func(module ModuleStats) string {
+		return fmt.Sprintf("module=%q", module.Module)
+	}
+	serviceLabels := func(module ModuleStats, service ServiceStats) string {
+		return fmt.Sprintf("module=%q,service=%q", module.Module, service.Service)
+	}
+	forServices := func(value func(ServiceStats) (float64, bool)) func(func(string, float64)) {
+		return func(sample func(string, float64)) {
+			for _, module := range stats {
+				for _, service := range module.Services {
+					if v, ok := value(service); ok {
+						sample(serviceLabels(module, service), v)
+					}
+				}
+			}
+		}
+	}
+
+	metric("gdm_module_state", "gauge", "State of the module containers, 1 for the current state", func(sample func(string, float64)) {
+		for _, module := range stats {
+			for _, state := range []string{ModuleRunning, ModulePartial, ModuleStopped, ModuleMissing} {
+				sample(fmt.Sprintf("%s,state=%q", moduleLabels(module), state), boolValue(module.State == state))
+			}
+		}
+	})
+	metric("gdm_module_desired_running", "gauge", "1 when the module is desired running, 0 when desired stopped", func(sample func(string, float64)) {
+		for _, module := range stats {
+			sample(moduleLabels(module), boolValue(module.DesiredState == DesiredRunning))
+		}
+	})
+	metric("gdm_service_healthy", "gauge", "1 when the service is healthy, or running without healthcheck", forServices(func(service ServiceStats) (float64, bool) {
+		return boolValue(healthReady(service.Health) && service.Health != HealthCompleted), true
+	}))
+	metric("gdm_service_restarts_total", "counter", "Restarts of the service container by docker", forServices(func(service ServiceStats) (float64, bool) {
+		return float64(service.Restarts), true
+	}))
+	metric("gdm_service_cpu_percent", "gauge", "CPU usage of the service container, 100 per core", forServices(func(service ServiceStats) (float64, bool) {
+		return service.CPUPercent, true
+	}))
+	metric("gdm_service_cpu_limit_cores", "gauge", "CPU limit of the service from deploy.resources.limits", forServices(func(service ServiceStats) (float64, bool) {
+		return service.CPULimit, service.CPULimit > 0
+	}))
+	metric("gdm_service_memory_bytes", "gauge", "Memory usage of the service container", forServices(func(service ServiceStats) (float64, bool) {
+		return float64(service.MemoryBytes), true
+	}))
+	metric("gdm_service_memory_limit_bytes", "gauge", "Memory limit of the service from deploy.resources.limits", forServices(func(service ServiceStats) (float64, bool) {
+		return float64(service.MemoryLimitBytes), service.MemoryLimitBytes > 0
+	}))
+	metric("gdm_module_volume_bytes", "gauge", "Disk usage of the volumes owned by the module", func(sample func(string, float64)) {
+		for _, module := range stats {
+			sample(moduleLabels(module), float64(module.VolumeBytes))
+		}
+	})
+	metric("gdm_module_last_backup_age_seconds", "gauge", "Age of the newest backup of the module, absent without backup", func(sample func(string, float64)) {
+		for _, module := range stats {
+			if !module.LastBackup.IsZero() {
+				sample(moduleLabels(module), time.Since(module.LastBackup).Seconds())
+			}
+		}
+	})
+}
+
+// boolValue returns 1 for true and 0 for false
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// backupFixture creates a compose dir with the modules given and an empty backup dir
+func backupFixture(t *testing.T, modules ...string) shared.Configuration {
+	t.Helper()
+	root := t.TempDir()
+	config := shared.Configuration{ComposeDir: filepath.Join(root, "compose"), BackupDir: filepath.Join(root, "backups")}
+	for _, module := range modules {
+		if err := os.MkdirAll(filepath.Join(config.ComposeDir, module, "backups"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(config.ComposeDir, module, "docker-compose.yml"), []byte("services: {}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return config
+}
+
+// writeArchive writes a backup archive of the backup snippet modified at the given time
+func writeArchive(t *testing.T, config shared.Configuration, module, name string, at time.Time) {
+	t.Helper()
+	path := filepath.Join(config.ComposeDir, module, "backups", name)
+	if err := os.WriteFile(path, []byte("archive"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, at, at); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLastBackup(t *testing.T) {
+	config := backupFixture(t, "site1", "site2", "site3")
+	day := time.Date(2026, 10, 18, 3, 0, 0, 0, time.Local)
+
+	// Archives of the backup snippet, by modification time
+	writeArchive(t, config, "site1", "site1-data-old.tar.gz", day.Add(-24*time.Hour))
+	writeArchive(t, config, "site1", "site1-data-new.tar.gz", day)
+	writeArchive(t, config, "site1", "notes.txt.tmp", day.Add(time.Hour))
+
+	// Backups of destroy -backup, named after their time
+	if err := os.MkdirAll(filepath.Join(config.BackupDir, "site2", "20261017-030000"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeArchive(t, config, "site2", "site2-data.tar.gz", day.Add(-48*time.Hour))
+
+	tests := []struct {
+		module string
+		want   time.Time
+	}{
+		{"site1", day},
+		{"site2", day.Add(-24 * time.Hour)},
+		{"site3", time.Time{}},
+	}
+	for _, test := range tests {
+		if got := lastBackup(config, test.module); !got.Equal(test.want) {
+			t.Errorf("lastBackup(%s) = %v, want %v", test.module, got, test.want)
+		}
+	}
+}
+
+func TestBackupAgeRule(t *testing.T) {
+	config := backupFixture(t, "fresh", "stale", "none")
+	writeArchive(t, config, "fresh", "fresh-data.tar.gz", time.Now().Add(-time.Hour))
+	writeArchive(t, config, "stale", "stale-data.tar.gz", time.Now().Add(-72*time.Hour))
+
+	rule := AlertRule{Name: "backup-age", Type: RuleBackupAge, MaxAge: 48 * time.Hour}
+	alerts, err := evaluateRule(config, rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]bool)
+	for _, alert := range alerts {
+		got[alert.Key] = true
+	}
+	want := map[string]bool{"backup-age/none": true, "backup-age/stale": true}
+	if len(got) != len(want) {
+		t.Fatalf("alerts = %v, want %v", got, want)
+	}
+	for key := range want {
+		if !got[key] {
+			t.Errorf("missing alert %s in %v", key, got)
+		}
+	}
+}
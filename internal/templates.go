@@ -0,0 +1,329 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// TemplateManifestFile is the optional manifest describing a template
+	TemplateManifestFile = "template.yml"
+	// ModuleMetadataFile records how a module was docked
+	ModuleMetadataFile = "module.yml"
+)
+
+// TemplateInfo describes an available template
+type TemplateInfo struct {
+	Name        string `json:"name"`
+	Extends     string `json:"extends,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// ResolvedTemplate holds the compose and env content of a template after inheritance
+type ResolvedTemplate struct {
+	Name         string
+	TemplatesDir string
+	Chain        []string
+	Compose      []byte
+	EnvTemplate  string
+	Includes     []shared.SnippetRef
+	Networks     []shared.NetworkSpec
+	Routing      []shared.RoutingSpec
+	// Infrastructure and Requires are inherited along the chain
+	Infrastructure bool
+	Requires       []string
+}
+
+// LoadTemplateManifest reads the template.yml manifest of a template, if any
+func LoadTemplateManifest(config shared.Configuration, templateName string) (shared.TemplateManifest, error) {
+	var manifest shared.TemplateManifest
+
+	content, err := os.ReadFile(filepath.Join(config.TemplatesDir, templateName, TemplateManifestFile))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, fmt.Errorf("failed to read manifest of template %s: %v", templateName, err)
+	}
+
+	if err := yaml.Unmarshal(content, &manifest); err != nil {
+		return manifest, fmt.Errorf("failed to parse manifest of template %s: %v", templateName, err)
+	}
+	return manifest, nil
+}
+
+// ResolveTemplate walks the extends chain of a template and deep-merges the compose
+// and .env.template overlays of every child onto its parent
+func ResolveTemplate(config shared.Configuration, templateName string) (*ResolvedTemplate, error) {
+	// Templates referenced as catalog/template@version resolve inside the cached catalog
+	if IsCatalogReference(templateName) {
+		catalogConfig, catalogTemplate, err := catalogTemplateConfig(config, templateName)
+		if err != nil {
+			return nil, err
+		}
+		resolved, err := ResolveTemplate(catalogConfig, catalogTemplate)
+		if err != nil {
+			return nil, err
+		}
+		resolved.Name = templateName
+		return resolved, nil
+	}
+
+	// Collect the chain from the root parent down to the requested template
+	chain := []string{}
+	seen := make(map[string]bool)
+	for name := templateName; name != ""; {
+		if seen[name] {
+			return nil, fmt.Errorf("template %s has an inheritance cycle: %s -> %s", templateName, strings.Join(chain, " -> "), name)
+		}
+		seen[name] = true
+
+		if _, err := os.Stat(filepath.Join(config.TemplatesDir, name)); os.IsNotExist(err) {
+			return nil, fmt.Errorf("template %s does not exist", name)
+		}
+
+		manifest, err := LoadTemplateManifest(config, name)
+		if err != nil {
+			return nil, err
+		}
+		chain = append([]string{name}, chain...)
+		name = manifest.Extends
+	}
+
+	var compose *yaml.Node
+	envTemplate := ""
+	includes := []shared.SnippetRef{}
+	networks := []shared.NetworkSpec{}
+	routing := []shared.RoutingSpec{}
+	infrastructure := false
+	requires := []string{}
+	for _, name := range chain {
+		templateDir := filepath.Join(config.TemplatesDir, name)
+
+		composeContent, err := os.ReadFile(filepath.Join(templateDir, "docker-compose.yml"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read docker-compose.yml of template %s: %v", name, err)
+		}
+		if err == nil {
+			node, err := parseComposeNode(composeContent)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse docker-compose.yml of template %s: %v", name, err)
+			}
+			if compose == nil {
+				compose = node
+			} else {
+				mergeComposeNodes(compose, node)
+			}
+		}
+
+		envContent, err := os.ReadFile(filepath.Join(templateDir, ".env.template"))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read .env.template of template %s: %v", name, err)
+		}
+		if err == nil {
+			envTemplate = mergeEnvTemplates(envTemplate, string(envContent))
+		}
+
+		manifest, err := LoadTemplateManifest(config, name)
+		if err != nil {
+			return nil, err
+		}
+		includes = mergeSnippetRefs(includes, manifest.Snippets)
+		networks = mergeNetworkSpecs(networks, manifest.Networks)
+		routing = mergeRoutingSpecs(routing, manifest.Routing)
+		infrastructure = infrastructure || manifest.Infrastructure
+		for _, required := range manifest.Requires {
+			if !containsString(requires, required) {
+				requires = append(requires, required)
+			}
+		}
+	}
+
+	if compose == nil {
+		return nil, fmt.Errorf("template %s has no docker-compose.yml in its inheritance chain", templateName)
+	}
+
+	composeContent, err := encodeComposeNode(compose)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render docker-compose.yml of template %s: %v", templateName, err)
+	}
+
+	return &ResolvedTemplate{
+		Name:           templateName,
+		TemplatesDir:   config.TemplatesDir,
+		Chain:          chain,
+		Compose:        composeContent,
+		EnvTemplate:    envTemplate,
+		Includes:       includes,
+		Networks:       networks,
+		Routing:        routing,
+		Infrastructure: infrastructure,
+		Requires:       requires,
+	}, nil
+}
+
+// mergeEnvTemplates overlays the KEY=VALUE lines of overlay onto base.
+// Existing keys keep their position, new lines are appended.
+func mergeEnvTemplates(base, overlay string) string {
+	if base == "" {
+		return overlay
+	}
+
+	lines := strings.Split(strings.TrimRight(base, "\n"), "\n")
+	positions := make(map[string]int)
+	for i, line := range lines {
+		if key, ok := envLineKey(line); ok {
+			positions[key] = i
+		}
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(overlay))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if key, ok := envLineKey(line); ok {
+			if i, exists := positions[key]; exists {
+				lines[i] = line
+				continue
+			}
+			positions[key] = len(lines)
+		}
+		lines = append(lines, line)
+	}
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// envLineKey returns the variable name of a KEY=VALUE line
+func envLineKey(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", false
+	}
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	return strings.TrimSpace(parts[0]), true
+}
+
+// ListTemplates returns every template in the templates directory with its manifest info
+func ListTemplates(config shared.Configuration) ([]TemplateInfo, error) {
+	templates := []TemplateInfo{}
+
+	entries, err := os.ReadDir(config.TemplatesDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read templates directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		templateDir := filepath.Join(config.TemplatesDir, entry.Name())
+		_, composeErr := os.Stat(filepath.Join(templateDir, "docker-compose.yml"))
+		_, manifestErr := os.Stat(filepath.Join(templateDir, TemplateManifestFile))
+		if composeErr != nil && manifestErr != nil {
+			continue
+		}
+
+		manifest, err := LoadTemplateManifest(config, entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		templates = append(templates, TemplateInfo{
+			Name:        entry.Name(),
+			Extends:     manifest.Extends,
+			Description: manifest.Description,
+		})
+	}
+
+	return templates, nil
+}
+
+// PrintTemplateTree prints the available templates as an inheritance tree
+func PrintTemplateTree(config shared.Configuration) error {
+	templates, err := ListTemplates(config)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	children := make(map[string][]TemplateInfo)
+	for _, template := range templates {
+		known[template.Name] = true
+	}
+
+	roots := []TemplateInfo{}
+	for _, template := range templates {
+		if template.Extends == "" || !known[template.Extends] {
+			roots = append(roots, template)
+		} else {
+			children[template.Extends] = append(children[template.Extends], template)
+		}
+	}
+	sort.Slice(roots, func(i, j int) bool { return roots[i].Name < roots[j].Name })
+
+	var printNode func(template TemplateInfo, prefix string, last, root bool)
+	printNode = func(template TemplateInfo, prefix string, last, root bool) {
+		label := template.Name
+		if template.Extends != "" && !known[template.Extends] {
+			label += fmt.Sprintf(" (extends missing template %s)", template.Extends)
+		}
+		if template.Description != "" {
+			label += " - " + template.Description
+		}
+
+		childPrefix := prefix
+		if root {
+			fmt.Println(label)
+		} else if last {
+			fmt.Printf("%s└── %s\n", prefix, label)
+			childPrefix += "    "
+		} else {
+			fmt.Printf("%s├── %s\n", prefix, label)
+			childPrefix += "│   "
+		}
+
+		nodes := children[template.Name]
+		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+		for i, child := range nodes {
+			printNode(child, childPrefix, i == len(nodes)-1, false)
+		}
+	}
+
+	for _, root := range roots {
+		printNode(root, "", true, true)
+	}
+	return nil
+}
+
+// LoadModuleMetadata reads the module.yml metadata of a docked module
+func LoadModuleMetadata(config shared.Configuration, moduleName string) (shared.ModuleMetadata, error) {
+	var metadata shared.ModuleMetadata
+
+	content, err := os.ReadFile(filepath.Join(config.ComposeDir, moduleName, ModuleMetadataFile))
+	if err != nil {
+		return metadata, err
+	}
+	if err := yaml.Unmarshal(content, &metadata); err != nil {
+		return metadata, fmt.Errorf("failed to parse metadata of module %s: %v", moduleName, err)
+	}
+	return metadata, nil
+}
+
+// SaveModuleMetadata writes the module.yml metadata of a module
+func SaveModuleMetadata(config shared.Configuration, moduleName string, metadata shared.ModuleMetadata) error {
+	content, err := yaml.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata of module %s: %v", moduleName, err)
+	}
+	return os.WriteFile(filepath.Join(config.ComposeDir, moduleName, ModuleMetadataFile), content, 0644)
+}
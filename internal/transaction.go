@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// stagingDirName is the directory of the compose dir where new modules are rendered
+const stagingDirName = ".staging"
+
+// What DockContainer does with a new module that fails to start
+const (
+	DockFailureAsk      = "ask"
+	DockFailureRollback = "rollback"
+	DockFailureKeep     = "keep"
+)
+
+// Docking outcomes recorded in the module metadata
+const (
+	DockOutcomeDocked = "docked"
+	DockOutcomeFailed = "failed"
+)
+
+// ValidDockFailurePolicy reports whether policy is a known failure policy
+func ValidDockFailurePolicy(policy string) bool {
+	return policy == DockFailureAsk || policy == DockFailureRollback || policy == DockFailureKeep
+}
+
+// stageModule renders a new module into a staging directory, validates it and moves it
+// into place, so that a failing render or an invalid compose file leaves nothing behind
+func stageModule(config shared.Configuration, moduleName, templateName string, snippets []shared.SnippetRef) error {
+	// Render the module files from the template, prompting for placeholder values
+	rendered, err := renderNewModule(config, moduleName, templateName, snippets, os.Stdin)
+	if err != nil {
+		return err
+	}
+
+	// Leftovers of an interrupted docking are replaced
+	stagingDir := filepath.Join(config.ComposeDir, stagingDirName, moduleName)
+	if err := os.RemoveAll(stagingDir); err != nil {
+		return fmt.Errorf("failed to clean staging directory: %v", err)
+	}
+	if err := os.MkdirAll(stagingDir, 0755); err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer func() {
+		os.RemoveAll(stagingDir)
+		// Only succeeds once no other docking is staged
+		os.Remove(filepath.Dir(stagingDir))
+	}()
+
+	if err := writeModuleFiles(stagingDir, rendered); err != nil {
+		return fmt.Errorf("failed to write module files: %v", err)
+	}
+
+	output, err := composeCommand(stagingDir, moduleName, "config", "--quiet").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("rendered module %s is not valid: %v, output: %s", moduleName, err, output)
+	}
+
+	moduleDir := filepath.Join(config.ComposeDir, moduleName)
+	if _, err := os.Stat(moduleDir); err == nil {
+		return fmt.Errorf("module directory for %s was created while docking", moduleName)
+	}
+	if err := os.Rename(stagingDir, moduleDir); err != nil {
+		return fmt.Errorf("failed to move module into place: %v", err)
+	}
+	log.Printf("Module %s validated and moved into place", moduleName)
+	return nil
+}
+
+// missingVolumes lists the volumes of a module that do not exist yet, the ones a rollback removes
+func missingVolumes(config shared.Configuration, moduleName string) []string {
+	module, err := readModuleFiles(filepath.Join(config.ComposeDir, moduleName))
+	if err != nil {
+		return nil
+	}
+	volumes, _ := projectObjects(moduleName, module, "volumes")
+
+	missing := []string{}
+	for _, volume := range volumes {
+		if !volume.external && !dockerObjectExists("volume", volume.name) {
+			missing = append(missing, volume.name)
+		}
+	}
+	return missing
+}
+
+// handleDockFailure rolls back or keeps a new module that failed to start
+func handleDockFailure(config shared.Configuration, moduleName, policy string, createdVolumes []string, dockErr error) error {
+	if policy == DockFailureAsk {
+		policy = askDockFailure(moduleName, dockErr)
+	}
+
+	if policy == DockFailureKeep {
+		recordDock(config, moduleName, DockOutcomeFailed, dockErr)
+		moduleDir := filepath.Join(config.ComposeDir, moduleName)
+		log.Printf("Kept module %s in %s for debugging", moduleName, moduleDir)
+		fmt.Printf("Module %s kept in %s for debugging, run dock again once fixed\n", moduleName, moduleDir)
+		return dockErr
+	}
+
+	if err := rollbackModule(config, moduleName, createdVolumes); err != nil {
+		return fmt.Errorf("%v; rollback failed: %v", dockErr, err)
+	}
+	log.Printf("Rolled back module %s", moduleName)
+	fmt.Printf("Module %s rolled back\n", moduleName)
+	return dockErr
+}
+
+// askDockFailure asks whether a failed module is rolled back or kept, defaulting to rollback
+func askDockFailure(moduleName string, dockErr error) string {
+	fmt.Printf("Docking of %s failed: %v\n", moduleName, dockErr)
+	fmt.Print("Roll back the module or keep it for debugging? [rollback/keep] (rollback): ")
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(answer)) {
+	case "k", "keep":
+		return DockFailureKeep
+	default:
+		return DockFailureRollback
+	}
+}
+
+// rollbackModule removes what a failed docking created: containers, project networks,
+// the volumes that did not exist before and the module directory
+func rollbackModule(config shared.Configuration, moduleName string, createdVolumes []string) error {
+	moduleDir := filepath.Join(config.ComposeDir, moduleName)
+	output, err := composeCommand(moduleDir, moduleName, "down", "--remove-orphans").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove containers: %v, output: %s", err, output)
+	}
+
+	for _, volume := range createdVolumes {
+		if !dockerObjectExists("volume", volume) {
+			continue
+		}
+		output, err := exec.Command("docker", "volume", "rm", volume).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("failed to remove volume %s: %v, output: %s", volume, err, output)
+		}
+	}
+
+	if err := os.RemoveAll(moduleDir); err != nil {
+		return fmt.Errorf("failed to remove module directory: %v", err)
+	}
+	return nil
+}
+
+// recordDock writes the outcome of a docking into the module metadata
+func recordDock(config shared.Configuration, moduleName, outcome string, dockErr error) {
+	metadata, err := LoadModuleMetadata(config, moduleName)
+	if os.IsNotExist(err) {
+		// Modules docked before metadata existed have nowhere to record it
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to record docking outcome of %s: %v", moduleName, err)
+		return
+	}
+
+	metadata.LastDock = &shared.DockRecord{Outcome: outcome, Time: time.Now().Format(time.RFC3339)}
+	if dockErr != nil {
+		metadata.LastDock.Error = dockErr.Error()
+	}
+	if err := SaveModuleMetadata(config, moduleName, metadata); err != nil {
+		log.Printf("Failed to record docking outcome of %s: %v", moduleName, err)
+	}
+}
@@ -1,22 +1,34 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"flag"
 	"io"
 	"log"
 	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
 	"github.com/FrancescoCorbosiero/go-docker-manager/internal"
 	//"github.com/FrancescoCorbosiero/go-docker-manager/pkg/utils"
 )
 
+// alertInterval is how often the daemons evaluate the alert rules
+const alertInterval = time.Minute
+
 func main() {
 	// Set up logging
-	logFile, err := os.OpenFile("go-docker-manager.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	logFile, err := os.OpenFile("go-docker-manager.log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
 	if err != nil {
 		log.Fatalf("Failed to open log file: %v", err)
 	}
+	// Log files created by earlier versions were world-writable
+	logFile.Chmod(0640)
 	defer logFile.Close()
 	log.SetOutput(io.MultiWriter(logFile, os.Stdout))
 
@@ -24,13 +36,124 @@ func main() {
 	config := shared.Configuration{
 		TemplatesDir: "templates",
 		ComposeDir:   "compose",
+		SnippetsDir:  "snippets",
+		CatalogsFile: "catalogs.yml",
+		CatalogDir:   "catalog",
+		BackupDir:    "backups",
+		NetworksFile: "networks.yml",
+		AlertsFile:   "alerts.yml",
 	}
 
 	// Parse command-line arguments
-	command := flag.String("command", "", "Command to execute (dock, list, logs, down, restart)")
+	command := flag.String("command", "", "Command to execute (dock, list, locks, networks, networks-gc, routes, certs, graph, up-all, down-all, reconcile, events, history, top, du, alerts, serve, list-templates, catalog-sync, catalog-list, lint-template, logs, down, destroy, restart, stop, start, pull, exec, upgrade, set-env)")
 	container := flag.String("container", "", "Container/module name")
 	template := flag.String("template", "", "Template name to use")
+	catalog := flag.String("catalog", "", "Catalog name for catalog commands")
+	version := flag.String("version", "", "Catalog version (git ref or release label)")
+	dryRun := flag.Bool("dry-run", false, "Show the plan of dock, upgrade, set-env, down, destroy or reconcile without changing anything")
+	output := flag.String("output", "text", "Output format of -dry-run plans (text, json), graph (text, dot, json) and history (text, json)")
+	var assignments envAssignments
+	flag.Var(&assignments, "set", "KEY=VALUE to set with set-env (repeatable)")
+	with := flag.String("with", "", "Comma-separated snippets to include when docking (name[:key=value...])")
+	onFailure := flag.String("on-failure", internal.DockFailureAsk, "What dock does with a new module that fails to start (ask, rollback, keep)")
+	wait := flag.Bool("wait", false, "Wait until the services of the module are healthy after dock, restart, upgrade or set-env")
+	timeout := flag.Duration("timeout", 5*time.Minute, "How long -wait, and rolling restarts, wait for the services to become healthy")
+	logLines := flag.Int("log-lines", 50, "Log lines shown for each failing service when -wait fails")
+	strategy := flag.String("strategy", internal.RestartInPlace, "Restart strategy (restart, recreate, rolling)")
+	service := flag.String("service", "", "Comma-separated services targeted by logs, restart, stop, start, pull and exec, all when empty")
+	yes := flag.Bool("yes", false, "Destroy without asking for confirmation")
+	force := flag.Bool("force", false, "Destroy volumes that still contain data")
+	backup := flag.Bool("backup", false, "Archive the module files and volumes before destroying them")
+	selector := flag.String("select", "", "Run dock, restart, down, stop, start, pull or upgrade on the selected modules (all, name=GLOB, template=T, label=K[=V], tag=T)")
+	parallel := flag.Int("parallel", 4, "Modules processed at the same time with -select")
+	lockTimeout := flag.Duration("lock-timeout", 2*time.Minute, "How long to wait for a module locked by another operation")
+	traefikAPI := flag.String("traefik-api", "http://127.0.0.1:8080", "Base URL of the Traefik API compared by routes, empty to skip it")
+	days := flag.Int("days", 21, "Certificates expiring within this many days are reported by certs")
+	interval := flag.Duration("interval", 0, "Run reconcile, or refresh top, again after this long until stopped, once when 0")
+	tail := flag.Int("tail", 20, "Recorded events shown by events, or audit entries shown by history")
+	follow := flag.Bool("follow", false, "Keep printing new events with events until interrupted")
+	port := flag.String("port", "8081", "Port the API server listens on with serve")
+	origins := flag.String("origins", "", "Comma-separated web origins, besides the API host, allowed to open exec terminals with serve")
+	test := flag.Bool("test", false, "Send a test alert through every notifier to a local webhook stand-in with alerts")
 	flag.Parse()
+	config.LockTimeout = *lockTimeout
+	config.TraefikAPI = *traefikAPI
+
+	// Keep stdout clean for machine readable plans
+	if *dryRun && *output == "json" {
+		log.SetOutput(io.MultiWriter(logFile, os.Stderr))
+	}
+
+	// Operations changing modules are recorded in the audit log
+	audited := func(module string, run func() error) error {
+		entry := internal.AuditEntry{User: internal.CurrentUser(), Source: internal.AuditCLI, Operation: *command, Module: module, Args: os.Args[1:]}
+		return internal.Audited(config, entry, run)
+	}
+
+	// With -select the command runs on every selected module instead of -container
+	if *selector != "" {
+		if *container != "" || *dryRun {
+			log.Fatal("-select cannot be combined with -container or -dry-run")
+		}
+		var run func(module string) error
+		// Set for commands that may prompt on stdin, which concurrent modules would share
+		prompts := false
+		// Set for commands leaving the services running, the only ones -wait applies to
+		waits := false
+		switch *command {
+		case "dock":
+			// Selected modules exist, so docking them never asks for values
+			waits = true
+			run = func(module string) error {
+				metadata, _ := internal.LoadModuleMetadata(config, module)
+				return internal.DockContainer(config, module, metadata.Template, nil, internal.DockFailureKeep)
+			}
+		case "restart":
+			if !internal.ValidRestartStrategy(*strategy) {
+				log.Fatalf("Invalid -strategy value %q, expected restart, recreate or rolling", *strategy)
+			}
+			waits = true
+			run = func(module string) error {
+				return internal.RestartContainer(config, module, *strategy, splitList(*service), *timeout)
+			}
+		case "down":
+			run = func(module string) error { return internal.DownContainer(config, module) }
+		case "stop":
+			run = func(module string) error { return internal.StopServices(config, module, splitList(*service)) }
+		case "start":
+			waits = true
+			run = func(module string) error { return internal.StartServices(config, module, splitList(*service)) }
+		case "pull":
+			run = func(module string) error { return internal.PullServices(config, module, splitList(*service)) }
+		case "upgrade":
+			prompts = true
+			waits = true
+			run = func(module string) error { return internal.UpgradeContainer(config, module) }
+		default:
+			log.Fatalf("Command %s cannot be run with -select", *command)
+		}
+		if prompts && *parallel > 1 {
+			fmt.Printf("%s may ask for values, modules are processed one at a time\n", *command)
+			*parallel = 1
+		}
+		if *wait && !waits {
+			log.Fatalf("-wait cannot be used with %s, it does not leave the services running", *command)
+		}
+		if *wait {
+			operation := run
+			run = func(module string) error {
+				if err := operation(module); err != nil {
+					return err
+				}
+				return internal.WaitHealthy(module, *timeout, *logLines)
+			}
+		}
+		operation := run
+		run = func(module string) error {
+			return audited(module, func() error { return operation(module) })
+		}
+		os.Exit(runBulk(config, *command, *selector, *parallel, run))
+	}
 
 	// Execute the requested command
 	switch *command {
@@ -38,20 +161,222 @@ func main() {
 		if *container == "" || *template == "" {
 			log.Fatal("Container name and template are required for dock command")
 		}
-		err := internal.DockContainer(config, *container, *template)
+		snippets, err := internal.ParseSnippetRefs(*with)
+		if err != nil {
+			log.Fatalf("Invalid -with value: %v", err)
+		}
+		if *dryRun {
+			plan, err := internal.PlanDock(config, *container, *template, snippets)
+			printPlan(plan, err, *output)
+			return
+		}
+		if !internal.ValidDockFailurePolicy(*onFailure) {
+			log.Fatalf("Invalid -on-failure value %q, expected ask, rollback or keep", *onFailure)
+		}
+		err = audited(*container, func() error {
+			return internal.DockContainer(config, *container, *template, snippets, *onFailure)
+		})
 		if err != nil {
 			log.Fatalf("Failed to dock container: %v", err)
 		}
+		if *wait {
+			waitHealthy(*container, *timeout, *logLines)
+		}
 	case "list":
 		err := internal.ListContainers()
 		if err != nil {
 			log.Fatalf("Failed to list containers: %v", err)
 		}
+		if err := internal.PrintQuotaWarnings(config); err != nil {
+			log.Printf("Failed to check quotas: %v", err)
+		}
+	case "locks":
+		err := internal.PrintLocks(config)
+		if err != nil {
+			log.Fatalf("Failed to list locks: %v", err)
+		}
+	case "networks":
+		err := internal.PrintNetworks(config)
+		if err != nil {
+			log.Fatalf("Failed to list networks: %v", err)
+		}
+	case "networks-gc":
+		var removed []string
+		err := audited("", func() (err error) {
+			removed, err = internal.GCNetworks(config)
+			return err
+		})
+		if err != nil {
+			log.Fatalf("Failed to remove unused networks: %v", err)
+		}
+		if len(removed) == 0 {
+			fmt.Println("No unused shared network")
+		}
+		for _, name := range removed {
+			fmt.Printf("Removed network %s\n", name)
+		}
+	case "routes":
+		report, err := internal.ModuleRoutes(config, config.TraefikAPI)
+		if err != nil {
+			log.Fatalf("Failed to list routes: %v", err)
+		}
+		if internal.PrintRoutes(report) > 0 {
+			os.Exit(1)
+		}
+	case "certs":
+		report, err := internal.ListCertificates(config, *days)
+		if err != nil {
+			log.Fatalf("Failed to list certificates: %v", err)
+		}
+		if internal.PrintCertificates(report) > 0 {
+			os.Exit(1)
+		}
+	case "graph":
+		graph, err := internal.BuildModuleGraph(config)
+		if err == nil {
+			err = internal.PrintGraph(graph, *output)
+		}
+		if err != nil {
+			log.Fatalf("Failed to build the module graph: %v", err)
+		}
+	case "up-all", "down-all":
+		var results []internal.BulkResult
+		var err error
+		if *command == "up-all" {
+			results, err = internal.UpAll(config, *timeout, *logLines)
+		} else {
+			results, err = internal.DownAll(config)
+		}
+		if err != nil {
+			log.Fatalf("Failed to order modules: %v", err)
+		}
+		if internal.PrintBulkSummary(*command, results) > 0 {
+			os.Exit(1)
+		}
+	case "reconcile":
+		if *dryRun {
+			actions, err := internal.PlanReconcile(config)
+			if err != nil {
+				log.Fatalf("Failed to plan reconcile: %v", err)
+			}
+			internal.PrintReconcileActions(actions, true)
+			break
+		}
+		if reconcile(config, *interval, *timeout) > 0 {
+			os.Exit(1)
+		}
+	case "events":
+		events, err := internal.ReadEvents(config, *container, *tail)
+		if err != nil {
+			log.Fatalf("Failed to list events: %v", err)
+		}
+		for _, event := range events {
+			internal.PrintEvent(event)
+		}
+		if *follow {
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			internal.WatchEvents(ctx, config, func(event internal.ModuleEvent) {
+				if *container == "" || event.Module == *container {
+					internal.PrintEvent(event)
+				}
+			})
+			stop()
+		} else if len(events) == 0 {
+			fmt.Println("No event recorded")
+		}
+	case "history":
+		entries, err := internal.ReadAudit(config, *container, *tail)
+		if err != nil {
+			log.Fatalf("Failed to read history: %v", err)
+		}
+		if *output == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			for _, entry := range entries {
+				encoder.Encode(entry)
+			}
+			break
+		}
+		if len(entries) == 0 {
+			fmt.Println("No operation recorded")
+		}
+		internal.PrintAudit(entries)
+	case "top":
+		for {
+			stats, err := internal.CollectStats(config, *container)
+			if err != nil {
+				log.Fatalf("Failed to collect stats: %v", err)
+			}
+			if *interval > 0 {
+				fmt.Print("\033[H\033[2J")
+			}
+			internal.PrintStats(stats)
+			if *interval <= 0 {
+				break
+			}
+			time.Sleep(*interval)
+		}
+	case "du":
+		usages, err := internal.DiskUsageReport(config, *container)
+		if err != nil {
+			log.Fatalf("Failed to measure disk usage: %v", err)
+		}
+		internal.PrintDiskUsage(usages)
+	case "alerts":
+		alerts, err := internal.LoadAlertsConfig(config)
+		if err != nil {
+			log.Fatalf("Failed to load alerts: %v", err)
+		}
+		if alerts == nil {
+			log.Fatalf("No alert rules, copy alerts.yml.template to %s", config.AlertsFile)
+		}
+		if *test {
+			if err := internal.TestNotifiers(alerts, os.Stdout); err != nil {
+				log.Fatalf("Test failed: %v", err)
+			}
+			break
+		}
+		if !*dryRun {
+			sent, err := internal.ProcessAlerts(config, alerts)
+			if err != nil {
+				log.Fatalf("Failed to process alerts: %v", err)
+			}
+			for _, notification := range sent {
+				fmt.Printf("Notified %s\n", notification.Text())
+			}
+		}
+		if err := internal.PrintAlerts(config, alerts); err != nil {
+			log.Fatalf("Failed to list alerts: %v", err)
+		}
+	case "serve":
+		startAPIServer(config, *port, splitList(*origins))
+	case "list-templates":
+		err := internal.PrintTemplateTree(config)
+		if err != nil {
+			log.Fatalf("Failed to list templates: %v", err)
+		}
+	case "catalog-sync":
+		err := syncCatalogs(config, *catalog, *version)
+		if err != nil {
+			log.Fatalf("Failed to sync catalog: %v", err)
+		}
+	case "catalog-list":
+		err := internal.PrintCatalogs(config)
+		if err != nil {
+			log.Fatalf("Failed to list catalogs: %v", err)
+		}
+	case "lint-template":
+		errors, err := lintTemplates(config, *template)
+		if err != nil {
+			log.Fatalf("Failed to lint template: %v", err)
+		}
+		if errors > 0 {
+			os.Exit(1)
+		}
 	case "logs":
 		if *container == "" {
 			log.Fatal("Container name is required for logs command")
 		}
-		err := internal.ShowLogs(*container)
+		err := internal.ShowLogs(config, *container, splitList(*service))
 		if err != nil {
 			log.Fatalf("Failed to show logs: %v", err)
 		}
@@ -59,30 +384,343 @@ func main() {
 		if *container == "" {
 			log.Fatal("Container name is required for down command")
 		}
-		err := internal.StopContainer(*container)
+		if *dryRun {
+			plan, err := internal.PlanDown(config, *container)
+			printPlan(plan, err, *output)
+			return
+		}
+		err := audited(*container, func() error { return internal.DownContainer(config, *container) })
 		if err != nil {
 			log.Fatalf("Failed to stop container: %v", err)
 		}
+	case "destroy":
+		if *container == "" {
+			log.Fatal("Container name is required for destroy command")
+		}
+		if *dryRun {
+			plan, err := internal.PlanDestroy(config, *container)
+			printPlan(plan, err, *output)
+			return
+		}
+		options := internal.DestroyOptions{Yes: *yes, Force: *force, Backup: *backup}
+		err := audited(*container, func() error { return internal.DestroyContainer(config, *container, options) })
+		if err != nil {
+			log.Fatalf("Failed to destroy container: %v", err)
+		}
 	case "restart":
 		if *container == "" {
 			log.Fatal("Container name is required for restart command")
 		}
-		err := internal.RestartContainer(*container)
+		if !internal.ValidRestartStrategy(*strategy) {
+			log.Fatalf("Invalid -strategy value %q, expected restart, recreate or rolling", *strategy)
+		}
+		err := audited(*container, func() error {
+			return internal.RestartContainer(config, *container, *strategy, splitList(*service), *timeout)
+		})
 		if err != nil {
 			log.Fatalf("Failed to restart container: %v", err)
 		}
+		if *wait {
+			waitHealthy(*container, *timeout, *logLines)
+		}
+	case "stop":
+		if *container == "" {
+			log.Fatal("Container name is required for stop command")
+		}
+		err := audited(*container, func() error { return internal.StopServices(config, *container, splitList(*service)) })
+		if err != nil {
+			log.Fatalf("Failed to stop container: %v", err)
+		}
+	case "start":
+		if *container == "" {
+			log.Fatal("Container name is required for start command")
+		}
+		err := audited(*container, func() error { return internal.StartServices(config, *container, splitList(*service)) })
+		if err != nil {
+			log.Fatalf("Failed to start container: %v", err)
+		}
+		if *wait {
+			waitHealthy(*container, *timeout, *logLines)
+		}
+	case "pull":
+		if *container == "" {
+			log.Fatal("Container name is required for pull command")
+		}
+		err := audited(*container, func() error { return internal.PullServices(config, *container, splitList(*service)) })
+		if err != nil {
+			log.Fatalf("Failed to pull images: %v", err)
+		}
+	case "exec":
+		if *container == "" || *service == "" {
+			log.Fatal("Container name and service are required for exec command")
+		}
+		// Without a command after -- a shell is opened
+		err := audited(*container, func() error {
+			return internal.ExecService(config, *container, *service, flag.Args(), stdinIsTerminal(), os.Stdin, os.Stdout, os.Stderr)
+		})
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			os.Exit(exitErr.ExitCode())
+		}
+		if err != nil {
+			log.Fatalf("Failed to exec: %v", err)
+		}
+	case "upgrade":
+		if *container == "" {
+			log.Fatal("Container name is required for upgrade command")
+		}
+		if *dryRun {
+			plan, err := internal.PlanUpgrade(config, *container)
+			printPlan(plan, err, *output)
+			return
+		}
+		err := audited(*container, func() error { return internal.UpgradeContainer(config, *container) })
+		if err != nil {
+			log.Fatalf("Failed to upgrade container: %v", err)
+		}
+		if *wait {
+			waitHealthy(*container, *timeout, *logLines)
+		}
+	case "set-env":
+		if *container == "" || len(assignments) == 0 {
+			log.Fatal("Container name and at least one -set KEY=VALUE are required for set-env command")
+		}
+		changes, err := internal.ParseEnvAssignments(assignments)
+		if err != nil {
+			log.Fatalf("Invalid -set value: %v", err)
+		}
+		if *dryRun {
+			plan, err := internal.PlanSetEnv(config, *container, changes)
+			printPlan(plan, err, *output)
+			return
+		}
+		// SetEnv leaves a stopped module stopped, there is nothing to wait for then
+		running := internal.ProjectRunning(*container)
+		err = audited(*container, func() error { return internal.SetEnv(config, *container, changes) })
+		if err != nil {
+			log.Fatalf("Failed to set environment: %v", err)
+		}
+		if *wait && !running {
+			fmt.Printf("Not waiting for %s to become healthy, it is not running\n", *container)
+		} else if *wait {
+			waitHealthy(*container, *timeout, *logLines)
+		}
 	default:
 		printHelp()
 	}
 }
 
+// envAssignments collects repeated -set KEY=VALUE flags
+type envAssignments []string
+
+func (a *envAssignments) String() string {
+	return strings.Join(*a, ",")
+}
+
+func (a *envAssignments) Set(value string) error {
+	*a = append(*a, value)
+	return nil
+}
+
+// splitList splits a comma-separated flag value, ignoring empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// runBulk runs an operation on the selected modules and returns the exit code
+func runBulk(config shared.Configuration, command, selector string, parallel int, run func(module string) error) int {
+	parsed, err := internal.ParseSelector(selector)
+	if err != nil {
+		log.Fatalf("Invalid -select value: %v", err)
+	}
+	modules, err := internal.SelectModules(config, parsed)
+	if err != nil {
+		log.Fatalf("Failed to select modules: %v", err)
+	}
+	if len(modules) == 0 {
+		fmt.Println("No module matches the selector")
+		return 0
+	}
+
+	fmt.Printf("Running %s on %d modules (%d at a time): %s\n", command, len(modules), parallel, strings.Join(modules, ", "))
+	results := internal.RunBulk(modules, parallel, command, run)
+	for _, result := range results {
+		if result.Err != nil {
+			log.Printf("%s of %s failed: %v", command, result.Module, result.Err)
+		}
+	}
+	if internal.PrintBulkSummary(command, results) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// stdinIsTerminal reports whether stdin is an interactive terminal
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// waitHealthy waits for the services of a module to become healthy, exiting on failure
+func waitHealthy(container string, timeout time.Duration, logLines int) {
+	if err := internal.WaitHealthy(container, timeout, logLines); err != nil {
+		log.Fatalf("Container %s is not healthy: %v", container, err)
+	}
+}
+
+// printPlan prints the plan of a dry run, exiting on planning errors
+func printPlan(plan *internal.Plan, err error, format string) {
+	if err != nil {
+		log.Fatalf("Failed to plan: %v", err)
+	}
+	if err := internal.PrintPlan(os.Stdout, plan, format); err != nil {
+		log.Fatalf("Failed to print plan: %v", err)
+	}
+}
+
+// syncCatalogs syncs one catalog, or every configured catalog at its default ref
+func syncCatalogs(config shared.Configuration, catalog, version string) error {
+	if catalog != "" {
+		return internal.SyncCatalog(config, catalog, version)
+	}
+
+	catalogs, err := internal.LoadCatalogs(config)
+	if err != nil {
+		return err
+	}
+	for _, source := range catalogs {
+		if err := internal.SyncCatalog(config, source.Name, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcile converges the modules to their desired state once, or every interval until
+// SIGINT or SIGTERM while recording docker events, and returns the number of actions that
+// failed in the last pass
+func reconcile(config shared.Configuration, interval, timeout time.Duration) int {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+	if interval > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go internal.WatchEvents(ctx, config, nil)
+		go watchAlerts(config)
+	}
+
+	for {
+		failures := 0
+		actions, err := internal.Reconcile(config, timeout)
+		if err != nil {
+			log.Printf("Reconcile failed: %v", err)
+			fmt.Fprintf(os.Stderr, "Reconcile failed: %v\n", err)
+			failures = 1
+		} else {
+			failures = internal.PrintReconcileActions(actions, false)
+		}
+		if interval <= 0 {
+			return failures
+		}
+
+		select {
+		case sig := <-stop:
+			log.Printf("Reconcile stopped by %v", sig)
+			return 0
+		case <-time.After(interval):
+		}
+	}
+}
+
+// watchAlerts evaluates the alert rules every alertInterval, forever, when there are rules
+func watchAlerts(config shared.Configuration) {
+	for {
+		alerts, err := internal.LoadAlertsConfig(config)
+		if err != nil {
+			log.Printf("Alerts are not evaluated: %v", err)
+		} else if alerts != nil {
+			if _, err := internal.ProcessAlerts(config, alerts); err != nil {
+				log.Printf("Failed to process alerts: %v", err)
+			}
+		}
+		time.Sleep(alertInterval)
+	}
+}
+
+// lintTemplates lints one template, or every template when none is given,
+// and returns the total number of errors found
+func lintTemplates(config shared.Configuration, template string) (int, error) {
+	templates := []string{template}
+	if template == "" {
+		infos, err := internal.ListTemplates(config)
+		if err != nil {
+			return 0, err
+		}
+		templates = templates[:0]
+		for _, info := range infos {
+			templates = append(templates, info.Name)
+		}
+	}
+
+	errors := 0
+	for _, name := range templates {
+		findings, err := internal.LintTemplate(config, name)
+		if err != nil {
+			return errors, err
+		}
+		errors += internal.PrintLintFindings(name, findings)
+	}
+	return errors, nil
+}
+
 // printHelp prints the help message
 func printHelp() {
 	fmt.Println("Docker Manager - Container orchestration tool")
 	fmt.Println("Commands:")
 	fmt.Println("  -command=dock -container=NAME -template=TEMPLATE  Create and start a new container")
-	fmt.Println("  -command=list                                    List running containers")
-	fmt.Println("  -command=logs -container=NAME                    Show logs for a container")
-	fmt.Println("  -command=down -container=NAME                    Stop and remove a container")
+	fmt.Println("               [-with=SNIPPET[:key=value...],...]   Include compose snippets in the new module")
+	fmt.Println("               [-on-failure=ask|rollback|keep]     Roll back or keep a new module that fails to start")
+	fmt.Println("  -command=list                                    List running containers and modules over their disk quota")
+	fmt.Println("  -command=locks                                   List module locks held by running operations")
+	fmt.Println("  -command=networks                                List shared networks and the modules using them")
+	fmt.Println("  -command=networks-gc                             Remove managed networks no module uses")
+	fmt.Println("  -command=routes [-traefik-api=URL]               List Traefik routers of every module and check them")
+	fmt.Println("  -command=certs [-days=21]                        List TLS certificates and those expiring soon")
+	fmt.Println("  -command=graph [-output=text|dot|json]           Show the module dependency graph")
+	fmt.Println("  -command=up-all [-timeout=5m]                    Start every module, dependencies first")
+	fmt.Println("  -command=down-all                                Stop every module, dependents first")
+	fmt.Println("  -command=reconcile [-interval=1m] [-dry-run]     Start, stop or recreate modules to match their desired state")
+	fmt.Println("  -command=events [-container=NAME] [-tail=20] [-follow]  Show container events (crashes, OOM kills, health) per module")
+	fmt.Println("  -command=history [-container=NAME] [-tail=20]    Show who changed modules, how it ended and the resulting diff")
+	fmt.Println("  -command=top [-container=NAME] [-interval=5s]    Show CPU, memory, restarts and volume usage per module and service")
+	fmt.Println("  -command=du [-container=NAME]                    Show the disk used by the volumes, logs and images of each module")
+	fmt.Println("  -command=alerts [-dry-run] [-test]               Evaluate alert rules and notify, list without notifying, or test notifiers")
+	fmt.Println("  -command=serve [-port=8081]                      Run the API server, recording container events, serving /metrics and alerting")
+	fmt.Println("  -command=list-templates                          List templates as an inheritance tree")
+	fmt.Println("  -command=catalog-sync [-catalog=NAME] [-version=V] Fetch catalog templates into the local cache")
+	fmt.Println("  -command=catalog-list                            List catalogs and their cached versions")
+	fmt.Println("  -command=lint-template [-template=TEMPLATE]       Check templates for common mistakes")
+	fmt.Println("  -command=logs -container=NAME [-service=a,b]     Show logs for a container")
+	fmt.Println("  -command=down -container=NAME                    Remove containers, keeping volumes and configuration")
+	fmt.Println("  -command=destroy -container=NAME [-yes] [-force] [-backup]  Remove containers, volumes and module directory")
 	fmt.Println("  -command=restart -container=NAME                 Restart a container")
+	fmt.Println("               [-strategy=restart|recreate|rolling] [-service=a,b]  In place, recreated or replaced behind Traefik")
+	fmt.Println("  -command=stop -container=NAME [-service=a,b]     Stop containers, keeping them")
+	fmt.Println("  -command=start -container=NAME [-service=a,b]    Start stopped containers")
+	fmt.Println("  -command=pull -container=NAME [-service=a,b]     Pull the images of a module")
+	fmt.Println("  -command=exec -container=NAME -service=S [-- CMD] Run a command, or a shell, in a service container")
+	fmt.Println("  -command=upgrade -container=NAME                 Re-render a module from its template and recreate it")
+	fmt.Println("  -command=set-env -container=NAME -set=KEY=VALUE  Update module variables and apply them")
+	fmt.Println("  -select=SELECTOR [-parallel=4]                   Run dock, restart, down, stop, start, pull or upgrade on many modules")
+	fmt.Println("                                                   all, name=GLOB, template=T, label=K[=V], tag=T (comma = and)")
+	fmt.Println("  -lock-timeout=2m                                 Wait for modules locked by another operation")
+	fmt.Println("  -traefik-api=http://127.0.0.1:8080               Traefik API compared with the module routes")
+	fmt.Println("  -wait [-timeout=5m] [-log-lines=50]              Wait for healthy services after dock, restart, upgrade or set-env")
+	fmt.Println("  -dry-run [-output=json]                          Show the plan of dock, upgrade, set-env, down or destroy only")
 }
\ No newline at end of file
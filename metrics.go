@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/FrancescoCorbosiero/go-docker-manager/internal"
+	"github.com/FrancescoCorbosiero/go-docker-manager/shared"
+)
+
+// statsInterval is how often the API server collects the stats of the modules
+const statsInterval = 30 * time.Second
+
+// statsCollector keeps the last stats collected in the background, so that scrapes never
+// wait for docker stats
+type statsCollector struct {
+	mu    sync.Mutex
+	stats []internal.ModuleStats
+	err   error
+}
+
+// run collects the stats every statsInterval, forever
+func (c *statsCollector) run(config shared.Configuration) {
+	for {
+		stats, err := internal.CollectStats(config, "")
+		if err != nil {
+			log.Printf("Failed to collect stats: %v", err)
+		}
+		c.mu.Lock()
+		if err == nil {
+			c.stats = stats
+		}
+		c.err = err
+		c.mu.Unlock()
+		time.Sleep(statsInterval)
+	}
+}
+
+// serveMetrics writes the last collected stats in the Prometheus text format
+func (c *statsCollector) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	stats, err := c.stats, c.err
+	c.mu.Unlock()
+	if stats == nil && err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	internal.WriteMetrics(w, stats)
+}
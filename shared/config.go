@@ -1,9 +1,21 @@
 package shared
 
+import "time"
+
 // Represents the application configuration
 type Configuration struct {
 	TemplatesDir string
 	ComposeDir   string
+	SnippetsDir  string
+	CatalogsFile string
+	CatalogDir   string
+	BackupDir    string
+	NetworksFile string
+	AlertsFile   string
+	// TraefikAPI is the base URL of the Traefik API, empty to never query it
+	TraefikAPI string
+	// LockTimeout is how long mutating operations wait for a module held by another one
+	LockTimeout time.Duration
 }
 
 // Holds the data needed to create a new module
@@ -11,4 +23,83 @@ type ModuleConfig struct {
 	Name     string
 	Template string
 	EnvVars  map[string]string
-}
\ No newline at end of file
+	Snippets []SnippetRef
+}
+
+// References a compose snippet and the parameters used to render it
+type SnippetRef struct {
+	Name   string            `yaml:"name" json:"name"`
+	Params map[string]string `yaml:"params,omitempty" json:"params,omitempty"`
+}
+
+// Represents the optional template.yml manifest of a template
+type TemplateManifest struct {
+	Description string        `yaml:"description,omitempty" json:"description,omitempty"`
+	Extends     string        `yaml:"extends,omitempty" json:"extends,omitempty"`
+	Snippets    []SnippetRef  `yaml:"snippets,omitempty" json:"snippets,omitempty"`
+	Networks    []NetworkSpec `yaml:"networks,omitempty" json:"networks,omitempty"`
+	Routing     []RoutingSpec `yaml:"routing,omitempty" json:"routing,omitempty"`
+	// Infrastructure templates run shared services such as the edge proxy
+	Infrastructure bool `yaml:"infrastructure,omitempty" json:"infrastructure,omitempty"`
+	// Requires lists the infrastructure templates that must be healthy before docking
+	Requires []string `yaml:"requires,omitempty" json:"requires,omitempty"`
+}
+
+// Declares how Traefik routes to a service, turned into traefik labels when rendering
+type RoutingSpec struct {
+	Service string   `yaml:"service" json:"service"`
+	Hosts   []string `yaml:"hosts" json:"hosts"`
+	// WWW also routes the www. alias of every host
+	WWW          bool     `yaml:"www,omitempty" json:"www,omitempty"`
+	Port         int      `yaml:"port" json:"port"`
+	EntryPoints  []string `yaml:"entrypoints,omitempty" json:"entrypoints,omitempty"`
+	TLS          bool     `yaml:"tls,omitempty" json:"tls,omitempty"`
+	CertResolver string   `yaml:"cert_resolver,omitempty" json:"cert_resolver,omitempty"`
+	Network      string   `yaml:"network,omitempty" json:"network,omitempty"`
+	// BasicAuth holds htpasswd users, comma-separated, with $ escaped as $$
+	BasicAuth   string         `yaml:"basic_auth,omitempty" json:"basic_auth,omitempty"`
+	Compress    bool           `yaml:"compress,omitempty" json:"compress,omitempty"`
+	MaxBodySize string         `yaml:"max_body_size,omitempty" json:"max_body_size,omitempty"`
+	Redirects   []RedirectSpec `yaml:"redirects,omitempty" json:"redirects,omitempty"`
+}
+
+// Declares a regex redirection of a routed service
+type RedirectSpec struct {
+	From      string `yaml:"from" json:"from"`
+	To        string `yaml:"to" json:"to"`
+	Permanent bool   `yaml:"permanent,omitempty" json:"permanent,omitempty"`
+}
+
+// Declares a shared docker network created and removed by the tool
+type NetworkSpec struct {
+	Name     string            `yaml:"name" json:"name"`
+	Driver   string            `yaml:"driver,omitempty" json:"driver,omitempty"`
+	Subnet   string            `yaml:"subnet,omitempty" json:"subnet,omitempty"`
+	Labels   map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Internal bool              `yaml:"internal,omitempty" json:"internal,omitempty"`
+}
+
+// Represents the module.yml metadata written next to a docked module
+type ModuleMetadata struct {
+	Template string       `yaml:"template" json:"template"`
+	Snippets []SnippetRef `yaml:"snippets,omitempty" json:"snippets,omitempty"`
+	// DependsOn lists the modules that must run before this one
+	DependsOn []string `yaml:"depends_on,omitempty" json:"depends_on,omitempty"`
+	// Routing overrides the routing of the template, per service
+	Routing []RoutingSpec `yaml:"routing,omitempty" json:"routing,omitempty"`
+	// Labels and tags are set by hand to group modules for bulk operations
+	Labels map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Tags   []string          `yaml:"tags,omitempty" json:"tags,omitempty"`
+	// Quota is a soft limit, such as 5G, of the disk used by the volumes and logs of the module
+	Quota string `yaml:"quota,omitempty" json:"quota,omitempty"`
+	// DesiredState is "running" or "stopped", enforced by the reconcile command
+	DesiredState string      `yaml:"desired_state,omitempty" json:"desired_state,omitempty"`
+	LastDock     *DockRecord `yaml:"last_dock,omitempty" json:"last_dock,omitempty"`
+}
+
+// Records the outcome of the last docking of a module
+type DockRecord struct {
+	Outcome string `yaml:"outcome" json:"outcome"`
+	Time    string `yaml:"time" json:"time"`
+	Error   string `yaml:"error,omitempty" json:"error,omitempty"`
+}